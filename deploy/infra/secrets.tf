@@ -9,6 +9,7 @@ locals {
     "s3_access_key",
     "s3_secret_key",
     "gha_mycrocloud_private_key",
+    "build_secrets_key",
   ]
 
   dbmigrator_secrets = [
@@ -38,6 +39,7 @@ locals {
   webapp_spa_build_worker_secrets = [
     "database_url",
     "auth0_secret",
+    "secrets_key",
   ]
 
   ssm_prefix = "/mycrocloud"
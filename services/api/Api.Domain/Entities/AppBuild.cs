@@ -23,7 +23,18 @@ public static class BuildMetadataKeys
     public const string CommitSha = "commitSha";
     public const string CommitMessage = "commitMessage";
     public const string Branch = "branch";
+    public const string Preview = "preview"; // "true" for builds of a branch other than the app's configured one
     public const string Author = "author";
+    public const string FailureReason = "failureReason";
+    public const string FailureCode = "failureCode";
+
+    // Resource usage reported by the worker once the build container exits
+    public const string PeakMemoryBytes = "peakMemoryBytes";
+    public const string CpuSeconds = "cpuSeconds";
+    public const string NetworkRxBytes = "networkRxBytes";
+    public const string NetworkTxBytes = "networkTxBytes";
+    public const string PeakDiskBytes = "peakDiskBytes";
+    public const string DurationSeconds = "durationSeconds";
 }
 
 public class AppBuildState
@@ -32,4 +43,7 @@ public class AppBuildState
     public const string running = "running";
     public const string succeeded = "succeeded";
     public const string failed = "failed";
+    public const string cancelled = "cancelled";
+    public const string superseded = "superseded";
+    public const string rejected = "rejected";
 }
\ No newline at end of file
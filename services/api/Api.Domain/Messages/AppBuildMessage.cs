@@ -7,6 +7,12 @@ namespace Api.Domain.Messages;
 /// </summary>
 public class PlanLimits
 {
+    /// <summary>
+    /// The plan the limits come from, recorded with the build's usage
+    /// </summary>
+    [JsonPropertyName("tier")]
+    public string Tier { get; set; } = "";
+
     [JsonPropertyName("memory_mb")]
     public int MemoryMB { get; set; }
 
@@ -19,15 +25,43 @@ public class PlanLimits
     [JsonPropertyName("artifact_size_mb")]
     public int ArtifactSizeMB { get; set; }
 
+    /// <summary>
+    /// Disk the build may write to its container and output directory
+    /// </summary>
+    [JsonPropertyName("disk_mb")]
+    public int DiskMB { get; set; }
+
+    /// <summary>
+    /// Builds of the same account that may run at once across all workers
+    /// </summary>
+    [JsonPropertyName("max_concurrent_builds")]
+    public int MaxConcurrentBuilds { get; set; }
+
+    /// <summary>
+    /// Build minutes the account may use per calendar month (UTC), 0 for unlimited
+    /// </summary>
+    [JsonPropertyName("build_minutes_per_month")]
+    public int BuildMinutesPerMonth { get; set; }
+
+    /// <summary>
+    /// Added to the build queue priority so paid plans are built ahead of free ones
+    /// </summary>
+    [JsonIgnore]
+    public int QueuePriorityBoost { get; set; }
+
     /// <summary>
     /// Default limits for free tier
     /// </summary>
     public static PlanLimits Free => new()
     {
+        Tier = "free",
         MemoryMB = 1024,        // 1 GB
         CPUPercent = 100,       // 1 core
         BuildTimeoutS = 600,    // 10 min
-        ArtifactSizeMB = 100    // 100 MB
+        ArtifactSizeMB = 100,   // 100 MB
+        DiskMB = 5120,          // 5 GB
+        MaxConcurrentBuilds = 1,
+        BuildMinutesPerMonth = 300
     };
 
     /// <summary>
@@ -35,10 +69,15 @@ public class PlanLimits
     /// </summary>
     public static PlanLimits Pro => new()
     {
+        Tier = "pro",
         MemoryMB = 2048,        // 2 GB
         CPUPercent = 200,       // 2 cores
         BuildTimeoutS = 1800,   // 30 min
-        ArtifactSizeMB = 500    // 500 MB
+        ArtifactSizeMB = 500,   // 500 MB
+        DiskMB = 10240,         // 10 GB
+        MaxConcurrentBuilds = 3,
+        BuildMinutesPerMonth = 3000,
+        QueuePriorityBoost = 5
     };
 
     /// <summary>
@@ -46,18 +85,57 @@ public class PlanLimits
     /// </summary>
     public static PlanLimits Enterprise => new()
     {
+        Tier = "enterprise",
         MemoryMB = 4096,        // 4 GB
         CPUPercent = 400,       // 4 cores
         BuildTimeoutS = 3600,   // 60 min
-        ArtifactSizeMB = 1024   // 1 GB
+        ArtifactSizeMB = 1024,  // 1 GB
+        DiskMB = 20480,         // 20 GB
+        MaxConcurrentBuilds = 10,
+        QueuePriorityBoost = 10
     };
 }
 
+/// <summary>
+/// AES-256-GCM encrypted JSON object of variable names to values, with the build id as associated data
+/// </summary>
+public class EncryptedBuildSecrets
+{
+    [JsonPropertyName("kid")]
+    public required string KeyId { get; set; }
+
+    [JsonPropertyName("nonce")]
+    public required string Nonce { get; set; }
+
+    /// <summary>
+    /// Ciphertext followed by the 16 byte authentication tag, base64 encoded
+    /// </summary>
+    [JsonPropertyName("ciphertext")]
+    public required string Ciphertext { get; set; }
+}
+
 public class AppBuildMessage
 {
+    /// <summary>
+    /// Schema version; bump it (and teach workers to migrate the old one) when fields change meaning
+    /// </summary>
+    public const int CurrentVersion = 2;
+
+    [JsonPropertyName("version")]
+    public int Version { get; set; } = CurrentVersion;
+
     [JsonPropertyName("build_id")]
     public string BuildId { get; set; }
 
+    [JsonPropertyName("app_id")]
+    public int AppId { get; set; }
+
+    /// <summary>
+    /// Account the build is scheduled and rate limited for
+    /// </summary>
+    [JsonPropertyName("tenant_id")]
+    public string TenantId { get; set; }
+
     [JsonPropertyName("repo_full_name")]
     public string RepoFullName { get; set; }
 
@@ -88,6 +166,13 @@ public class AppBuildMessage
     [JsonPropertyName("env_vars")]
     public Dictionary<string, string> EnvVars { get; set; } = new();
 
+    /// <summary>
+    /// Secret variables, encrypted so only workers can read them
+    /// </summary>
+    [JsonPropertyName("secret_env_vars")]
+    [JsonIgnore(Condition = JsonIgnoreCondition.WhenWritingNull)]
+    public EncryptedBuildSecrets? SecretEnvVars { get; set; }
+
     [JsonPropertyName("artifacts_upload_path")]
     public string ArtifactsUploadPath { get; set; }
 
@@ -97,4 +182,19 @@ public class AppBuildMessage
     [JsonPropertyName("limits")]
     [JsonIgnore(Condition = JsonIgnoreCondition.WhenWritingNull)]
     public PlanLimits? Limits { get; set; }
+
+    /// <summary>
+    /// Labels a worker must advertise to claim this build, e.g. tier=paid or custom-images=true
+    /// </summary>
+    [JsonPropertyName("required_labels")]
+    [JsonIgnore(Condition = JsonIgnoreCondition.WhenWritingNull)]
+    public Dictionary<string, string>? RequiredLabels { get; set; }
+
+    /// <summary>
+    /// This message signed by the API as an HS256 JWS. Workers that require signatures
+    /// only run the signed copy, so payloads written straight into build_queue are rejected.
+    /// </summary>
+    [JsonPropertyName("signed")]
+    [JsonIgnore(Condition = JsonIgnoreCondition.WhenWritingNull)]
+    public string? Signed { get; set; }
 }
\ No newline at end of file
@@ -0,0 +1,159 @@
+using System.Text.Json;
+using System.Text.Json.Serialization;
+
+namespace Api.Domain.Messages;
+
+// Messages exchanged with build workers that pull jobs over HTTP instead of reading build_queue directly.
+
+public class ClaimBuildJobRequest
+{
+    [JsonPropertyName("worker_id")]
+    public required string WorkerId { get; set; }
+
+    [JsonPropertyName("labels")]
+    public Dictionary<string, string>? Labels { get; set; }
+
+    [JsonPropertyName("lease_seconds")]
+    public int LeaseSeconds { get; set; }
+
+    // Only jobs whose resource limits fit are claimed; any job if null
+    [JsonPropertyName("budget")]
+    public BuildJobBudget? Budget { get; set; }
+}
+
+// Memory and CPU a worker has free. A job's limits are its plan's capped at the maximum, or the default if unset.
+public class BuildJobBudget
+{
+    [JsonPropertyName("memory_mb")]
+    public int MemoryMb { get; set; }
+
+    [JsonPropertyName("cpu_percent")]
+    public int CpuPercent { get; set; }
+
+    [JsonPropertyName("default_memory_mb")]
+    public int DefaultMemoryMb { get; set; }
+
+    [JsonPropertyName("max_memory_mb")]
+    public int MaxMemoryMb { get; set; }
+
+    [JsonPropertyName("default_cpu_percent")]
+    public int DefaultCpuPercent { get; set; }
+
+    [JsonPropertyName("max_cpu_percent")]
+    public int MaxCpuPercent { get; set; }
+}
+
+public class ClaimedBuildJob
+{
+    [JsonPropertyName("id")]
+    public Guid Id { get; set; }
+
+    [JsonPropertyName("payload")]
+    public JsonElement Payload { get; set; }
+
+    [JsonPropertyName("attempt")]
+    public int Attempt { get; set; }
+
+    /// <summary>
+    /// Cancellation was requested while a previous worker held the job; the worker only reports it
+    /// </summary>
+    [JsonPropertyName("cancel_requested")]
+    public bool CancelRequested { get; set; }
+
+    [JsonPropertyName("superseded")]
+    public bool Superseded { get; set; }
+}
+
+public class AckBuildJobRequest
+{
+    [JsonPropertyName("worker_id")]
+    public required string WorkerId { get; set; }
+
+    [JsonPropertyName("status")]
+    public required string Status { get; set; }
+
+    [JsonPropertyName("exit_code")]
+    public int? ExitCode { get; set; }
+
+    [JsonPropertyName("failure_reason")]
+    public string? FailureReason { get; set; }
+
+    [JsonPropertyName("artifact_id")]
+    public Guid? ArtifactId { get; set; }
+
+    /// <summary>
+    /// How long the build container ran, recorded in the build_usage ledger
+    /// </summary>
+    [JsonPropertyName("billable_seconds")]
+    public int BillableSeconds { get; set; }
+}
+
+public class NackBuildJobRequest
+{
+    [JsonPropertyName("worker_id")]
+    public required string WorkerId { get; set; }
+
+    [JsonPropertyName("delay_seconds")]
+    public double DelaySeconds { get; set; }
+
+    [JsonPropertyName("reason")]
+    public string? Reason { get; set; }
+}
+
+public class RequeueBuildJobRequest
+{
+    [JsonPropertyName("worker_id")]
+    public required string WorkerId { get; set; }
+
+    [JsonPropertyName("reason")]
+    public string? Reason { get; set; }
+}
+
+public class ExtendBuildJobLeaseRequest
+{
+    [JsonPropertyName("worker_id")]
+    public required string WorkerId { get; set; }
+
+    [JsonPropertyName("lease_seconds")]
+    public int LeaseSeconds { get; set; }
+}
+
+public class BuildJobLease
+{
+    [JsonPropertyName("held")]
+    public bool Held { get; set; }
+
+    [JsonPropertyName("cancel_requested")]
+    public bool CancelRequested { get; set; }
+
+    [JsonPropertyName("superseded")]
+    public bool Superseded { get; set; }
+}
+
+public class BuildJobEvent
+{
+    [JsonPropertyName("type")]
+    public required string Type { get; set; } // available, cancelled or superseded
+
+    [JsonPropertyName("job_id")]
+    [JsonIgnore(Condition = JsonIgnoreCondition.WhenWritingNull)]
+    public string? JobId { get; set; }
+}
+
+public class BuildLogEntry
+{
+    [JsonPropertyName("log")]
+    public string Log { get; set; } = "";
+
+    [JsonPropertyName("source")]
+    public string Source { get; set; } = "";
+
+    [JsonPropertyName("tag")]
+    public string Tag { get; set; } = "";
+
+    [JsonPropertyName("time")]
+    public string Time { get; set; } = "";
+
+    [JsonPropertyName("uuid")]
+    public string Uuid { get; set; } = "";
+}
@@ -7,6 +7,9 @@ public enum BuildStatus
     Started,
     Done,
     Failed,
+    Cancelled,
+    Superseded,
+    Rejected,
 }
 
 public class BuildStatusChangedMessage
@@ -22,4 +25,43 @@ public class BuildStatusChangedMessage
 
     [JsonPropertyName("artifact_id")]
     public Guid? ArtifactId { get; set; }
+
+    /// <summary>
+    /// Why the build failed as a code, e.g. out_of_memory, timeout or build_failed
+    /// </summary>
+    [JsonPropertyName("failure_code")]
+    public string? FailureCode { get; set; }
+
+    /// <summary>
+    /// Why the build failed, for the user
+    /// </summary>
+    [JsonPropertyName("failure_reason")]
+    public string? FailureReason { get; set; }
+
+    /// <summary>
+    /// What the build used, sent once its container has exited
+    /// </summary>
+    [JsonPropertyName("usage")]
+    public BuildUsage? Usage { get; set; }
+}
+
+public class BuildUsage
+{
+    [JsonPropertyName("peak_memory_bytes")]
+    public long PeakMemoryBytes { get; set; }
+
+    [JsonPropertyName("cpu_seconds")]
+    public double CpuSeconds { get; set; }
+
+    [JsonPropertyName("network_rx_bytes")]
+    public long NetworkRxBytes { get; set; }
+
+    [JsonPropertyName("network_tx_bytes")]
+    public long NetworkTxBytes { get; set; }
+
+    [JsonPropertyName("peak_disk_bytes")]
+    public long PeakDiskBytes { get; set; }
+
+    [JsonPropertyName("duration_seconds")]
+    public double DurationSeconds { get; set; }
 }
\ No newline at end of file
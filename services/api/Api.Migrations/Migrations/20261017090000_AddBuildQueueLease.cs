@@ -0,0 +1,37 @@
+using Api.Infrastructure;
+using Microsoft.EntityFrameworkCore.Infrastructure;
+using Microsoft.EntityFrameworkCore.Migrations;
+
+namespace Api.Migrations.Migrations;
+
+[DbContext(typeof(AppDbContext))]
+[Migration("20261017090000_AddBuildQueueLease")]
+public class AddBuildQueueLease : Migration
+{
+    protected override void Up(MigrationBuilder migrationBuilder)
+    {
+        migrationBuilder.Sql("""
+            ALTER TABLE build_queue
+                ADD COLUMN heartbeat_at TIMESTAMPTZ,
+                ADD COLUMN lease_expires_at TIMESTAMPTZ,
+                ADD COLUMN reclaim_count INT NOT NULL DEFAULT 0;
+
+            -- Existing claims get a short lease so a dead worker's jobs are picked up again
+            UPDATE build_queue SET lease_expires_at = claimed_at + interval '5 minutes' WHERE status = 'claimed';
+
+            CREATE INDEX idx_build_queue_lease ON build_queue (lease_expires_at) WHERE status = 'claimed';
+            """);
+    }
+
+    protected override void Down(MigrationBuilder migrationBuilder)
+    {
+        migrationBuilder.Sql("""
+            DROP INDEX IF EXISTS idx_build_queue_lease;
+
+            ALTER TABLE build_queue
+                DROP COLUMN IF EXISTS heartbeat_at,
+                DROP COLUMN IF EXISTS lease_expires_at,
+                DROP COLUMN IF EXISTS reclaim_count;
+            """);
+    }
+}
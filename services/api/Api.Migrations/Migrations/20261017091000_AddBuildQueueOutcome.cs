@@ -0,0 +1,39 @@
+using Api.Infrastructure;
+using Microsoft.EntityFrameworkCore.Infrastructure;
+using Microsoft.EntityFrameworkCore.Migrations;
+
+namespace Api.Migrations.Migrations;
+
+[DbContext(typeof(AppDbContext))]
+[Migration("20261017091000_AddBuildQueueOutcome")]
+public class AddBuildQueueOutcome : Migration
+{
+    protected override void Up(MigrationBuilder migrationBuilder)
+    {
+        migrationBuilder.Sql("""
+            ALTER TABLE build_queue
+                ADD COLUMN finished_at TIMESTAMPTZ,
+                ADD COLUMN exit_code INT,
+                ADD COLUMN failure_reason TEXT,
+                ADD COLUMN artifact_id UUID;
+
+            -- Rows completed by the API before the worker recorded outcomes
+            UPDATE build_queue SET finished_at = claimed_at WHERE status = 'completed';
+
+            CREATE INDEX idx_build_queue_finished ON build_queue (finished_at) WHERE finished_at IS NOT NULL;
+            """);
+    }
+
+    protected override void Down(MigrationBuilder migrationBuilder)
+    {
+        migrationBuilder.Sql("""
+            DROP INDEX IF EXISTS idx_build_queue_finished;
+
+            ALTER TABLE build_queue
+                DROP COLUMN IF EXISTS finished_at,
+                DROP COLUMN IF EXISTS exit_code,
+                DROP COLUMN IF EXISTS failure_reason,
+                DROP COLUMN IF EXISTS artifact_id;
+            """);
+    }
+}
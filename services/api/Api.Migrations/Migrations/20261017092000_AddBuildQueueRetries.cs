@@ -0,0 +1,30 @@
+using Api.Infrastructure;
+using Microsoft.EntityFrameworkCore.Infrastructure;
+using Microsoft.EntityFrameworkCore.Migrations;
+
+namespace Api.Migrations.Migrations;
+
+[DbContext(typeof(AppDbContext))]
+[Migration("20261017092000_AddBuildQueueRetries")]
+public class AddBuildQueueRetries : Migration
+{
+    protected override void Up(MigrationBuilder migrationBuilder)
+    {
+        migrationBuilder.Sql("""
+            ALTER TABLE build_queue
+                ADD COLUMN attempts INT NOT NULL DEFAULT 0,
+                ADD COLUMN next_attempt_at TIMESTAMPTZ,
+                ADD COLUMN last_error TEXT;
+            """);
+    }
+
+    protected override void Down(MigrationBuilder migrationBuilder)
+    {
+        migrationBuilder.Sql("""
+            ALTER TABLE build_queue
+                DROP COLUMN IF EXISTS attempts,
+                DROP COLUMN IF EXISTS next_attempt_at,
+                DROP COLUMN IF EXISTS last_error;
+            """);
+    }
+}
@@ -0,0 +1,22 @@
+using Api.Infrastructure;
+using Microsoft.EntityFrameworkCore.Infrastructure;
+using Microsoft.EntityFrameworkCore.Migrations;
+
+namespace Api.Migrations.Migrations;
+
+[DbContext(typeof(AppDbContext))]
+[Migration("20261017093000_AddBuildQueueCancellation")]
+public class AddBuildQueueCancellation : Migration
+{
+    protected override void Up(MigrationBuilder migrationBuilder)
+    {
+        migrationBuilder.Sql("""
+            ALTER TABLE build_queue ADD COLUMN cancel_requested_at TIMESTAMPTZ;
+            """);
+    }
+
+    protected override void Down(MigrationBuilder migrationBuilder)
+    {
+        migrationBuilder.Sql("ALTER TABLE build_queue DROP COLUMN IF EXISTS cancel_requested_at;");
+    }
+}
@@ -0,0 +1,33 @@
+using Api.Infrastructure;
+using Microsoft.EntityFrameworkCore.Infrastructure;
+using Microsoft.EntityFrameworkCore.Migrations;
+
+namespace Api.Migrations.Migrations;
+
+[DbContext(typeof(AppDbContext))]
+[Migration("20261017094000_AddBuildQueueSupersede")]
+public class AddBuildQueueSupersede : Migration
+{
+    protected override void Up(MigrationBuilder migrationBuilder)
+    {
+        migrationBuilder.Sql("""
+            ALTER TABLE build_queue ADD COLUMN superseded_by UUID;
+
+            -- Lookup of queued and running builds for the same app and branch
+            CREATE INDEX idx_build_queue_app_branch ON build_queue (
+                (COALESCE(payload->>'app_id', split_part(payload->>'artifacts_upload_path', '/', 3))),
+                (COALESCE(payload->>'branch', '')),
+                created_at
+            ) WHERE status IN ('pending', 'claimed');
+            """);
+    }
+
+    protected override void Down(MigrationBuilder migrationBuilder)
+    {
+        migrationBuilder.Sql("""
+            DROP INDEX IF EXISTS idx_build_queue_app_branch;
+
+            ALTER TABLE build_queue DROP COLUMN IF EXISTS superseded_by;
+            """);
+    }
+}
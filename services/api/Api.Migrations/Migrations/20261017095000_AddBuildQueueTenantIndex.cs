@@ -0,0 +1,25 @@
+using Api.Infrastructure;
+using Microsoft.EntityFrameworkCore.Infrastructure;
+using Microsoft.EntityFrameworkCore.Migrations;
+
+namespace Api.Migrations.Migrations;
+
+[DbContext(typeof(AppDbContext))]
+[Migration("20261017095000_AddBuildQueueTenantIndex")]
+public class AddBuildQueueTenantIndex : Migration
+{
+    protected override void Up(MigrationBuilder migrationBuilder)
+    {
+        migrationBuilder.Sql("""
+            -- Running builds per tenant, counted by the workers' fair-scheduling claim query
+            CREATE INDEX idx_build_queue_tenant_running ON build_queue (
+                (COALESCE(payload->>'tenant_id', payload->>'app_id', split_part(payload->>'artifacts_upload_path', '/', 3)))
+            ) WHERE status = 'claimed';
+            """);
+    }
+
+    protected override void Down(MigrationBuilder migrationBuilder)
+    {
+        migrationBuilder.Sql("DROP INDEX IF EXISTS idx_build_queue_tenant_running;");
+    }
+}
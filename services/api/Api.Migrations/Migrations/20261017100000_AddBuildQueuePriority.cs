@@ -0,0 +1,34 @@
+using Api.Infrastructure;
+using Microsoft.EntityFrameworkCore.Infrastructure;
+using Microsoft.EntityFrameworkCore.Migrations;
+
+namespace Api.Migrations.Migrations;
+
+[DbContext(typeof(AppDbContext))]
+[Migration("20261017100000_AddBuildQueuePriority")]
+public class AddBuildQueuePriority : Migration
+{
+    protected override void Up(MigrationBuilder migrationBuilder)
+    {
+        migrationBuilder.Sql("""
+            ALTER TABLE build_queue
+                ADD COLUMN priority INT NOT NULL DEFAULT 0,
+                ADD COLUMN run_after TIMESTAMPTZ;
+
+            DROP INDEX IF EXISTS idx_build_queue_pending;
+            CREATE INDEX idx_build_queue_pending ON build_queue (priority DESC, created_at) WHERE status = 'pending';
+            """);
+    }
+
+    protected override void Down(MigrationBuilder migrationBuilder)
+    {
+        migrationBuilder.Sql("""
+            DROP INDEX IF EXISTS idx_build_queue_pending;
+            CREATE INDEX idx_build_queue_pending ON build_queue (created_at) WHERE status = 'pending';
+
+            ALTER TABLE build_queue
+                DROP COLUMN IF EXISTS priority,
+                DROP COLUMN IF EXISTS run_after;
+            """);
+    }
+}
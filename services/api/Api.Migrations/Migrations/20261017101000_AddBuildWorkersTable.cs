@@ -0,0 +1,36 @@
+using Api.Infrastructure;
+using Microsoft.EntityFrameworkCore.Infrastructure;
+using Microsoft.EntityFrameworkCore.Migrations;
+
+namespace Api.Migrations.Migrations;
+
+[DbContext(typeof(AppDbContext))]
+[Migration("20261017101000_AddBuildWorkersTable")]
+public class AddBuildWorkersTable : Migration
+{
+    protected override void Up(MigrationBuilder migrationBuilder)
+    {
+        migrationBuilder.Sql("""
+            CREATE TABLE build_workers (
+                id TEXT PRIMARY KEY,
+                hostname TEXT NOT NULL,
+                version TEXT NOT NULL,
+                labels JSONB NOT NULL DEFAULT '{}',
+                total_slots INT NOT NULL,
+                used_slots INT NOT NULL DEFAULT 0,
+                running_jobs TEXT[] NOT NULL DEFAULT '{}',
+                status TEXT NOT NULL DEFAULT 'online',
+                started_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+                heartbeat_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+                stopped_at TIMESTAMPTZ
+            );
+
+            CREATE INDEX idx_build_workers_heartbeat ON build_workers (heartbeat_at) WHERE status = 'online';
+            """);
+    }
+
+    protected override void Down(MigrationBuilder migrationBuilder)
+    {
+        migrationBuilder.Sql("DROP TABLE IF EXISTS build_workers;");
+    }
+}
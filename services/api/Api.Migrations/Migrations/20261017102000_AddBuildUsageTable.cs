@@ -0,0 +1,35 @@
+using Api.Infrastructure;
+using Microsoft.EntityFrameworkCore.Infrastructure;
+using Microsoft.EntityFrameworkCore.Migrations;
+
+namespace Api.Migrations.Migrations;
+
+[DbContext(typeof(AppDbContext))]
+[Migration("20261017102000_AddBuildUsageTable")]
+public class AddBuildUsageTable : Migration
+{
+    protected override void Up(MigrationBuilder migrationBuilder)
+    {
+        migrationBuilder.Sql("""
+            CREATE TABLE build_usage (
+                id BIGSERIAL PRIMARY KEY,
+                build_id UUID NOT NULL,
+                tenant TEXT NOT NULL,
+                app_id TEXT,
+                tier TEXT,
+                billable_seconds INT NOT NULL DEFAULT 0,
+                outcome TEXT NOT NULL,
+                recorded_at TIMESTAMPTZ NOT NULL DEFAULT now()
+            );
+
+            CREATE INDEX idx_build_usage_tenant ON build_usage (tenant, recorded_at);
+            -- One row per build, so a repeated Ack records it once (ON CONFLICT (build_id))
+            CREATE UNIQUE INDEX idx_build_usage_build ON build_usage (build_id);
+            """);
+    }
+
+    protected override void Down(MigrationBuilder migrationBuilder)
+    {
+        migrationBuilder.Sql("DROP TABLE IF EXISTS build_usage;");
+    }
+}
@@ -0,0 +1,113 @@
+using Api.Domain.Messages;
+using Api.Services;
+using Microsoft.AspNetCore.Authentication.JwtBearer;
+using Microsoft.AspNetCore.Authorization;
+using Microsoft.AspNetCore.Mvc;
+
+namespace Api.Controllers;
+
+/// <summary>
+/// Build queue for workers that pull jobs over HTTP rather than connecting to the database,
+/// e.g. on untrusted or remote build hosts.
+/// </summary>
+[Route("build-jobs")]
+[Authorize(Policy = "M2M", AuthenticationSchemes = JwtBearerDefaults.AuthenticationScheme)]
+public class BuildJobsController(BuildJobQueue queue) : BaseController
+{
+    private static readonly TimeSpan MaxEventsWait = TimeSpan.FromSeconds(30);
+
+    [HttpPost("claim")]
+    public async Task<IActionResult> Claim(ClaimBuildJobRequest request)
+    {
+        var job = await queue.ClaimAsync(request, HttpContext.RequestAborted);
+        return job == null ? NoContent() : Ok(job);
+    }
+
+    [HttpPost("{id:guid}/ack")]
+    public async Task<IActionResult> Ack(Guid id, AckBuildJobRequest request)
+    {
+        return await queue.AckAsync(id, request) ? NoContent() : Conflict("Job is not leased to this worker");
+    }
+
+    [HttpPost("{id:guid}/nack")]
+    public async Task<IActionResult> Nack(Guid id, NackBuildJobRequest request)
+    {
+        return await queue.NackAsync(id, request) ? NoContent() : Conflict("Job is not leased to this worker");
+    }
+
+    [HttpPost("{id:guid}/requeue")]
+    public async Task<IActionResult> Requeue(Guid id, RequeueBuildJobRequest request)
+    {
+        return await queue.RequeueAsync(id, request) ? NoContent() : Conflict("Job is not leased to this worker");
+    }
+
+    [HttpPost("{id:guid}/lease")]
+    public async Task<IActionResult> ExtendLease(Guid id, ExtendBuildJobLeaseRequest request)
+    {
+        return Ok(await queue.ExtendLeaseAsync(id, request));
+    }
+
+    /// <summary>
+    /// Takes a job back up after a worker restart, if it is still claimed by the worker.
+    /// </summary>
+    [HttpPost("{id:guid}/resume")]
+    public async Task<IActionResult> Resume(Guid id, ExtendBuildJobLeaseRequest request)
+    {
+        var job = await queue.ResumeAsync(id, request);
+        return job == null ? NoContent() : Ok(job);
+    }
+
+    /// <summary>
+    /// Build seconds the tenant used since the given time, for the build minutes quota.
+    /// </summary>
+    [HttpGet("usage")]
+    public async Task<IActionResult> Usage([FromQuery] string tenant, [FromQuery] DateTime since)
+    {
+        return Ok(new { used_seconds = await queue.UsedSecondsAsync(tenant, since) });
+    }
+
+    [HttpGet("next-due")]
+    public async Task<IActionResult> NextDue()
+    {
+        return Ok(new { due = await queue.NextDueAsync() });
+    }
+
+    [HttpPost("{id:guid}/supersede-older")]
+    public async Task<IActionResult> SupersedeOlder(Guid id)
+    {
+        return Ok(await queue.SupersedeOlderAsync(id));
+    }
+
+    [HttpPost("{id:guid}/supersede-running")]
+    public async Task<IActionResult> SupersedeRunning(Guid id)
+    {
+        return Ok(await queue.SupersedeRunningAsync(id));
+    }
+
+    /// <summary>
+    /// Long-polls for queue wakeups: jobs becoming available and cancellation requests.
+    /// Returns an empty list if nothing happened within the timeout.
+    /// </summary>
+    [HttpGet("events")]
+    public async Task<IActionResult> Events([FromQuery] int timeoutSeconds = 25)
+    {
+        var timeout = TimeSpan.FromSeconds(Math.Clamp(timeoutSeconds, 1, (int)MaxEventsWait.TotalSeconds));
+        try
+        {
+            return Ok(await queue.WaitAsync(timeout, HttpContext.RequestAborted));
+        }
+        catch (OperationCanceledException)
+        {
+            return new EmptyResult();
+        }
+    }
+
+    /// <summary>
+    /// Live build logs from workers without database access, relayed to the log stream viewers.
+    /// </summary>
+    [HttpPost("{id:guid}/logs")]
+    public async Task<IActionResult> PublishLogs(Guid id, [FromQuery(Name = "worker_id")] string workerId, List<BuildLogEntry> entries)
+    {
+        return await queue.PublishLogsAsync(id, workerId, entries) ? NoContent() : Conflict("Job is not leased to this worker");
+    }
+}
@@ -1,3 +1,4 @@
+using System.Globalization;
 using System.Text.Json;
 using Api.Filters;
 using Api.Models.Builds;
@@ -70,7 +71,9 @@ public class SpaBuildsController(
             cloneUrl,
             repo.FullName,
             artifactsUploadPath,
-            deploymentName: request.Name
+            deploymentName: request.Name,
+            branch: request.Branch,
+            runAfter: request.RunAfter?.ToUniversalTime()
         );
 
         return NoContent();
@@ -227,6 +230,9 @@ public class SpaBuildsController(
         if (app == null)
             return NotFound();
 
+        if (statusMessage.Usage != null)
+            RecordUsage(build, statusMessage.Usage);
+
         switch (statusMessage.Status)
         {
             case BuildStatus.Started:
@@ -305,6 +311,15 @@ public class SpaBuildsController(
                     break;
                 }
 
+                if (build.Metadata.GetValueOrDefault(BuildMetadataKeys.Preview) == "true")
+                {
+                    // Previews are deployed but left for the user to activate
+                    await appDbContext.SaveChangesAsync();
+                    logger.LogInformation("Deployed preview build {BuildId} as {DeploymentId} without activating it",
+                        build.Id, deployment.Id);
+                    break;
+                }
+
                 app.ActiveSpaDeploymentId = deployment.Id;
                 await appDbContext.SaveChangesAsync();
 
@@ -318,6 +333,16 @@ public class SpaBuildsController(
                 build.Status = "failed";
                 build.UpdatedAt = DateTime.UtcNow;
                 build.FinishedAt = DateTime.UtcNow;
+                if (!string.IsNullOrEmpty(statusMessage.FailureReason) || !string.IsNullOrEmpty(statusMessage.FailureCode))
+                {
+                    // Reassigned so the JSONB column is seen as changed
+                    var metadata = new Dictionary<string, string>(build.Metadata);
+                    if (!string.IsNullOrEmpty(statusMessage.FailureReason))
+                        metadata[BuildMetadataKeys.FailureReason] = statusMessage.FailureReason;
+                    if (!string.IsNullOrEmpty(statusMessage.FailureCode))
+                        metadata[BuildMetadataKeys.FailureCode] = statusMessage.FailureCode;
+                    build.Metadata = metadata;
+                }
 
                 var failedDeployment = await appDbContext.SpaDeployments
                     .FirstOrDefaultAsync(d => d.BuildId == buildId);
@@ -330,6 +355,22 @@ public class SpaBuildsController(
                 await appDbContext.SaveChangesAsync();
                 break;
 
+            case BuildStatus.Cancelled:
+                await MarkCancelledAsync(build, AppBuildState.cancelled);
+                await appDbContext.SaveChangesAsync();
+                break;
+
+            case BuildStatus.Superseded:
+                await MarkCancelledAsync(build, AppBuildState.superseded);
+                await appDbContext.SaveChangesAsync();
+                break;
+
+            case BuildStatus.Rejected:
+                logger.LogWarning("Worker rejected build {BuildId}: payload failed signature verification", buildId);
+                await MarkCancelledAsync(build, AppBuildState.rejected);
+                await appDbContext.SaveChangesAsync();
+                break;
+
             default:
                 return BadRequest("Unknown status");
         }
@@ -337,13 +378,6 @@ public class SpaBuildsController(
         // Publish real-time update to UI subscribers
         publisher.Publish(app.Id, build.Status);
 
-        // Mark queue item as completed
-        await using var conn = await pubSubDataSource.DataSource.OpenConnectionAsync();
-        await using var cmd = conn.CreateCommand();
-        cmd.CommandText = "UPDATE build_queue SET status = 'completed' WHERE id = @id";
-        cmd.Parameters.AddWithValue("id", buildId);
-        await cmd.ExecuteNonQueryAsync();
-
         // Send Slack notifications
         try
         {
@@ -358,6 +392,9 @@ public class SpaBuildsController(
                     BuildStatus.Started => "\ud83d\udfe1",
                     BuildStatus.Done => "\u2705",
                     BuildStatus.Failed => "\u274c",
+                    BuildStatus.Cancelled => "\u26d4",
+                    BuildStatus.Superseded => "\u23ed\ufe0f",
+                    BuildStatus.Rejected => "\ud83d\udee1\ufe0f",
                     _ => "\u2139\ufe0f"
                 };
 
@@ -369,8 +406,15 @@ public class SpaBuildsController(
                     BuildStatus.Started => $"{emoji} *Build started* for *{app.Slug}* (Build #{build.Id})",
                     BuildStatus.Done => $"{emoji} *Build completed successfully!* \ud83c\udf89\nApp: *{app.Slug}*  \nBuild Id: `{build.Id}`",
                     BuildStatus.Failed => $"{emoji} *Build failed!* \ud83d\udca5\nApp: *{app.Slug}*  \nBuild Id: `{build.Id}`",
+                    BuildStatus.Cancelled => $"{emoji} *Build cancelled*\nApp: *{app.Slug}*  \nBuild Id: `{build.Id}`",
+                    BuildStatus.Superseded => $"{emoji} *Build superseded by a newer build*\nApp: *{app.Slug}*  \nBuild Id: `{build.Id}`",
+                    BuildStatus.Rejected => $"{emoji} *Build rejected: job failed signature verification*\nApp: *{app.Slug}*  \nBuild Id: `{build.Id}`",
                     _ => $"{emoji} Build status changed for *{app.Slug}*"
                 };
+                if (!string.IsNullOrEmpty(statusMessage.FailureReason))
+                    text += string.IsNullOrEmpty(statusMessage.FailureCode)
+                        ? $"\nReason: {statusMessage.FailureReason}"
+                        : $"\nReason: {statusMessage.FailureReason} (`{statusMessage.FailureCode}`)";
                 text += $"\n<{detailsUrl}|View build details>";
 
                 foreach (var subscription in subscriptions)
@@ -387,6 +431,80 @@ public class SpaBuildsController(
         return Ok();
     }
 
+    /// <summary>
+    /// Requests cancellation of a build. Queued builds are cancelled immediately; running builds
+    /// are stopped by the worker, which reports the Cancelled status back.
+    /// </summary>
+    [HttpPost("{buildId:guid}/cancel")]
+    public async Task<IActionResult> Cancel(int appId, Guid buildId)
+    {
+        var build = await appDbContext.AppBuildJobs
+            .SingleOrDefaultAsync(b => b.AppId == appId && b.Id == buildId);
+        if (build == null)
+            return NotFound();
+
+        await using var conn = await pubSubDataSource.DataSource.OpenConnectionAsync();
+        await using var cmd = conn.CreateCommand();
+        cmd.CommandText = """
+            UPDATE build_queue
+            SET cancel_requested_at = now(),
+                status = CASE WHEN status = 'pending' THEN 'cancelled' ELSE status END,
+                finished_at = CASE WHEN status = 'pending' THEN now() ELSE finished_at END
+            WHERE id = @id AND status IN ('pending', 'claimed')
+            RETURNING status;
+            """;
+        cmd.Parameters.AddWithValue("id", buildId);
+        var queueStatus = (string?)await cmd.ExecuteScalarAsync();
+
+        if (queueStatus == null)
+            return Conflict("Build is not queued or running");
+
+        if (queueStatus == "cancelled")
+        {
+            // Never claimed by a worker, so nobody else will report the final status
+            await MarkCancelledAsync(build, AppBuildState.cancelled);
+            await appDbContext.SaveChangesAsync();
+            publisher.Publish(appId, build.Status);
+            return NoContent();
+        }
+
+        await using var notify = conn.CreateCommand();
+        notify.CommandText = "SELECT pg_notify('build_job_cancelled', @id)";
+        notify.Parameters.AddWithValue("id", buildId.ToString());
+        await notify.ExecuteNonQueryAsync();
+
+        return Accepted();
+    }
+
+    private static void RecordUsage(AppBuild build, BuildUsage usage)
+    {
+        // Reassigned so the JSONB column is seen as changed
+        build.Metadata = new Dictionary<string, string>(build.Metadata)
+        {
+            [BuildMetadataKeys.PeakMemoryBytes] = usage.PeakMemoryBytes.ToString(CultureInfo.InvariantCulture),
+            [BuildMetadataKeys.CpuSeconds] = usage.CpuSeconds.ToString(CultureInfo.InvariantCulture),
+            [BuildMetadataKeys.NetworkRxBytes] = usage.NetworkRxBytes.ToString(CultureInfo.InvariantCulture),
+            [BuildMetadataKeys.NetworkTxBytes] = usage.NetworkTxBytes.ToString(CultureInfo.InvariantCulture),
+            [BuildMetadataKeys.PeakDiskBytes] = usage.PeakDiskBytes.ToString(CultureInfo.InvariantCulture),
+            [BuildMetadataKeys.DurationSeconds] = usage.DurationSeconds.ToString(CultureInfo.InvariantCulture),
+        };
+    }
+
+    private async Task MarkCancelledAsync(AppBuild build, string status)
+    {
+        build.Status = status;
+        build.UpdatedAt = DateTime.UtcNow;
+        build.FinishedAt = DateTime.UtcNow;
+
+        var deployment = await appDbContext.SpaDeployments
+            .FirstOrDefaultAsync(d => d.BuildId == build.Id);
+        if (deployment is { Status: DeploymentStatus.Building })
+        {
+            deployment.Status = DeploymentStatus.Failed;
+            deployment.UpdatedAt = DateTime.UtcNow;
+        }
+    }
+
     [HttpPut("{buildId:guid}/logs")]
     [Consumes("multipart/form-data")]
     [DisableRequestSizeLimit]
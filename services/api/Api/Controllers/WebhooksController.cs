@@ -45,6 +45,14 @@ public class WebhooksController(
         var repoId = (long)payloadNode["repository"]!["id"]!;
         var repoFullName = (string)payloadNode["repository"]!["full_name"]!;
         var cloneUrl = (string)payloadNode["repository"]!["clone_url"]!;
+        var gitRef = (string?)payloadNode["ref"] ?? "";
+
+        // Deleting a branch or tag is also a push, with nothing to build
+        if ((bool?)payloadNode["deleted"] == true)
+            return Ok();
+
+        // Pushed branches are built; a tag push rebuilds the app's configured branch
+        var branch = gitRef.StartsWith("refs/heads/") ? gitRef["refs/heads/".Length..] : null;
 
         logger.LogInformation("Received GitHub push webhook for installation {InstallationId} and repository {RepoId}", installationId, repoId);
 
@@ -75,7 +83,8 @@ public class WebhooksController(
                 app,
                 authenticatedCloneUrl,
                 repoFullName,
-                artifactsUploadPath
+                artifactsUploadPath,
+                branch: branch
             );
         }
 
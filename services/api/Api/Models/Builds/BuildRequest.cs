@@ -1,6 +1,21 @@
+using System.ComponentModel.DataAnnotations;
+using System.Text.Json.Serialization;
+
 namespace Api.Models.Builds;
 
 public class BuildRequest
 {
     public string Name { get; set; }
+
+    /// <summary>
+    /// Branch to build; the app's configured branch if empty. Other branches are built as previews.
+    /// </summary>
+    [StringLength(255, ErrorMessage = "Branch name cannot exceed 255 characters")]
+    public string? Branch { get; set; }
+
+    /// <summary>
+    /// Holds the build in the queue until this time
+    /// </summary>
+    [JsonPropertyName("run_after")]
+    public DateTime? RunAfter { get; set; }
 }
\ No newline at end of file
@@ -104,6 +104,9 @@ builder.Services.AddScoped<IRouteService, RouteService>();
 builder.Services.AddScoped<ILogRepository, LogRepository>();
 builder.Services.AddSingleton<PubSubDataSource>();
 builder.Services.AddSingleton<BuildQueuePublisher>();
+builder.Services.AddSingleton<BuildJobQueue>();
+builder.Services.AddSingleton<BuildPayloadSigner>();
+builder.Services.AddSingleton<BuildSecretEncryptor>();
 builder.Services.AddHttpClient();
 builder.Services.AddSingleton<IAppBuildPublisher, InMemoryAppBuildPublisher>();
 builder.Services.AddScoped<SlackAppService>();
@@ -0,0 +1,422 @@
+using System.Text.Json;
+using System.Text.Json.Nodes;
+using Api.Domain.Messages;
+using Npgsql;
+
+namespace Api.Services;
+
+/// <summary>
+/// Leases build_queue jobs to workers that pull over HTTP instead of connecting to the database.
+/// Mirrors the worker's Postgres queue, so both kinds of worker can share one queue.
+/// </summary>
+public class BuildJobQueue(PubSubDataSource pubSub, BuildPayloadSigner signer, ILogger<BuildJobQueue> logger)
+{
+    private const string TenantKey = """
+        COALESCE({0}.payload->>'tenant_id', {0}.payload->>'app_id',
+            split_part({0}.payload->>'artifacts_upload_path', '/', 3))
+        """;
+
+    private const string BuildKey = """
+        (COALESCE({0}.payload->>'app_id', split_part({0}.payload->>'artifacts_upload_path', '/', 3)),
+            COALESCE({0}.payload->>'branch', ''))
+        """;
+
+    // A job's limit ({1} in payload.limits) capped at the maximum {2}, or the default {3} if it has none
+    private const string JobLimit = """
+        CASE WHEN COALESCE(({0}.payload->'limits'->>'{1}')::int, 0) > 0
+            THEN LEAST(({0}.payload->'limits'->>'{1}')::int, {2}) ELSE {3} END
+        """;
+
+    // Same lock as the worker's Postgres queue, so claims from both are serialized
+    private const string ClaimLockKey = "build_queue_claim";
+
+    private static readonly string[] Channels = ["build_job_available", "build_job_cancelled", "build_job_superseded"];
+
+    public async Task<ClaimedBuildJob?> ClaimAsync(ClaimBuildJobRequest request, CancellationToken cancellationToken)
+    {
+        await using var conn = await pubSub.DataSource.OpenConnectionAsync(cancellationToken);
+        await using var tx = await conn.BeginTransactionAsync(cancellationToken);
+
+        await using (var lockCmd = new NpgsqlCommand("SELECT pg_advisory_xact_lock(hashtext(@key))", conn, tx))
+        {
+            lockCmd.Parameters.AddWithValue("key", ClaimLockKey);
+            await lockCmd.ExecuteNonQueryAsync(cancellationToken);
+        }
+
+        await using var cmd = new NpgsqlCommand($$"""
+            WITH running AS (
+                SELECT {{string.Format(TenantKey, "r")}} AS tenant, count(*) AS n
+                FROM build_queue r
+                WHERE r.status = 'claimed' AND r.lease_expires_at >= now()
+                GROUP BY 1
+            ),
+            next AS (
+                SELECT c.id, c.status, c.claimed_by FROM build_queue c
+                LEFT JOIN running ON running.tenant = {{string.Format(TenantKey, "c")}}
+                WHERE ((c.status = 'pending' AND COALESCE(GREATEST(c.run_after, c.next_attempt_at), now()) <= now())
+                    OR (c.status = 'claimed' AND c.lease_expires_at < now()))
+                    AND COALESCE(c.payload->'required_labels', '{}'::jsonb) <@ @labels::jsonb
+                    AND (COALESCE((c.payload->'limits'->>'max_concurrent_builds')::int, 0) <= 0
+                        OR COALESCE(running.n, 0) < (c.payload->'limits'->>'max_concurrent_builds')::int)
+                    AND (@memory::int IS NULL OR ({{string.Format(JobLimit, "c", "memory_mb", "@maxMemory::int", "@defaultMemory::int")}} <= @memory::int
+                        AND {{string.Format(JobLimit, "c", "cpu_percent", "@maxCpu::int", "@defaultCpu::int")}} <= @cpu::int))
+                ORDER BY c.priority DESC, COALESCE(running.n, 0), c.created_at
+                LIMIT 1
+                FOR UPDATE OF c SKIP LOCKED
+            )
+            UPDATE build_queue q
+            SET status = 'claimed', claimed_by = @workerId, claimed_at = now(),
+                heartbeat_at = now(), lease_expires_at = now() + make_interval(secs => @lease),
+                reclaim_count = q.reclaim_count + CASE WHEN next.status = 'claimed' THEN 1 ELSE 0 END,
+                attempts = q.attempts + 1
+            FROM next
+            WHERE q.id = next.id
+            RETURNING q.id, q.payload::text, q.attempts, q.cancel_requested_at IS NOT NULL, q.superseded_by IS NOT NULL,
+                next.status, next.claimed_by
+            """, conn, tx);
+        cmd.Parameters.AddWithValue("workerId", request.WorkerId);
+        cmd.Parameters.AddWithValue("lease", (double)request.LeaseSeconds);
+        cmd.Parameters.AddWithValue("labels", JsonSerializer.Serialize(request.Labels ?? new Dictionary<string, string>()));
+
+        var budget = request.Budget;
+        cmd.Parameters.AddWithValue("memory", NpgsqlTypes.NpgsqlDbType.Integer, (object?)budget?.MemoryMb ?? DBNull.Value);
+        cmd.Parameters.AddWithValue("maxMemory", NpgsqlTypes.NpgsqlDbType.Integer, (object?)budget?.MaxMemoryMb ?? DBNull.Value);
+        cmd.Parameters.AddWithValue("defaultMemory", NpgsqlTypes.NpgsqlDbType.Integer, (object?)budget?.DefaultMemoryMb ?? DBNull.Value);
+        cmd.Parameters.AddWithValue("cpu", NpgsqlTypes.NpgsqlDbType.Integer, (object?)budget?.CpuPercent ?? DBNull.Value);
+        cmd.Parameters.AddWithValue("maxCpu", NpgsqlTypes.NpgsqlDbType.Integer, (object?)budget?.MaxCpuPercent ?? DBNull.Value);
+        cmd.Parameters.AddWithValue("defaultCpu", NpgsqlTypes.NpgsqlDbType.Integer, (object?)budget?.DefaultCpuPercent ?? DBNull.Value);
+
+        ClaimedBuildJob? job = null;
+        string? prevStatus = null, prevWorker = null;
+        await using (var reader = await cmd.ExecuteReaderAsync(cancellationToken))
+        {
+            if (await reader.ReadAsync(cancellationToken))
+            {
+                job = new ClaimedBuildJob
+                {
+                    Id = reader.GetGuid(0),
+                    Payload = JsonDocument.Parse(reader.GetString(1)).RootElement,
+                    Attempt = reader.GetInt32(2),
+                    CancelRequested = reader.GetBoolean(3),
+                    Superseded = reader.GetBoolean(4),
+                };
+                prevStatus = reader.GetString(5);
+                prevWorker = reader.IsDBNull(6) ? null : reader.GetString(6);
+            }
+        }
+
+        if (job == null)
+            return null;
+
+        job.Payload = SignedForClaim(job.Payload, request.WorkerId, job.Attempt);
+
+        await tx.CommitAsync(cancellationToken);
+
+        if (prevStatus == "claimed")
+            logger.LogInformation("Reclaimed build job {BuildId} from worker {WorkerId} (lease expired)", job.Id, prevWorker);
+
+        return job;
+    }
+
+    public async Task<bool> AckAsync(Guid id, AckBuildJobRequest request)
+    {
+        await using var conn = await pubSub.DataSource.OpenConnectionAsync();
+        await using var cmd = conn.CreateCommand();
+        // The usage row is only written if the worker still held the job, so it is recorded once
+        cmd.CommandText = $"""
+            WITH acked AS (
+                UPDATE build_queue
+                SET status = @status, finished_at = now(), exit_code = @exitCode,
+                    failure_reason = @reason, artifact_id = @artifactId, lease_expires_at = NULL,
+                    last_error = CASE WHEN @status = 'dead' THEN @reason ELSE last_error END
+                WHERE id = @id AND claimed_by = @workerId AND status = 'claimed'
+                RETURNING id, payload
+            )
+            INSERT INTO build_usage (build_id, tenant, app_id, tier, billable_seconds, outcome)
+            SELECT id, {string.Format(TenantKey, "acked")},
+                COALESCE(payload->>'app_id', split_part(payload->>'artifacts_upload_path', '/', 3)),
+                payload->'limits'->>'tier', @billableSeconds, @status
+            FROM acked
+            ON CONFLICT (build_id) DO NOTHING
+            """;
+        cmd.Parameters.AddWithValue("id", id);
+        cmd.Parameters.AddWithValue("workerId", request.WorkerId);
+        cmd.Parameters.AddWithValue("status", request.Status);
+        cmd.Parameters.AddWithValue("exitCode", NpgsqlTypes.NpgsqlDbType.Integer, (object?)request.ExitCode ?? DBNull.Value);
+        cmd.Parameters.AddWithValue("reason", NpgsqlTypes.NpgsqlDbType.Text, string.IsNullOrEmpty(request.FailureReason) ? DBNull.Value : (object)request.FailureReason);
+        cmd.Parameters.AddWithValue("artifactId", NpgsqlTypes.NpgsqlDbType.Uuid, (object?)request.ArtifactId ?? DBNull.Value);
+        cmd.Parameters.AddWithValue("billableSeconds", request.BillableSeconds);
+        return await cmd.ExecuteNonQueryAsync() > 0;
+    }
+
+    public async Task<bool> NackAsync(Guid id, NackBuildJobRequest request)
+    {
+        await using var conn = await pubSub.DataSource.OpenConnectionAsync();
+        await using var cmd = conn.CreateCommand();
+        cmd.CommandText = """
+            UPDATE build_queue
+            SET status = 'pending', claimed_by = NULL, claimed_at = NULL, heartbeat_at = NULL, lease_expires_at = NULL,
+                next_attempt_at = CASE WHEN cancel_requested_at IS NULL THEN now() + make_interval(secs => @delay) ELSE now() END,
+                last_error = @reason
+            WHERE id = @id AND claimed_by = @workerId AND status = 'claimed'
+            """;
+        cmd.Parameters.AddWithValue("id", id);
+        cmd.Parameters.AddWithValue("workerId", request.WorkerId);
+        cmd.Parameters.AddWithValue("delay", request.DelaySeconds);
+        cmd.Parameters.AddWithValue("reason", NpgsqlTypes.NpgsqlDbType.Text, string.IsNullOrEmpty(request.Reason) ? DBNull.Value : (object)request.Reason);
+        return await cmd.ExecuteNonQueryAsync() > 0;
+    }
+
+    /// <summary>
+    /// Hands back a job interrupted by its worker shutting down, without counting the attempt.
+    /// </summary>
+    public async Task<bool> RequeueAsync(Guid id, RequeueBuildJobRequest request)
+    {
+        await using var conn = await pubSub.DataSource.OpenConnectionAsync();
+        await using var cmd = conn.CreateCommand();
+        cmd.CommandText = """
+            UPDATE build_queue
+            SET status = 'pending', claimed_by = NULL, claimed_at = NULL, heartbeat_at = NULL, lease_expires_at = NULL,
+                next_attempt_at = now(), attempts = GREATEST(attempts - 1, 0), last_error = @reason
+            WHERE id = @id AND claimed_by = @workerId AND status = 'claimed'
+            """;
+        cmd.Parameters.AddWithValue("id", id);
+        cmd.Parameters.AddWithValue("workerId", request.WorkerId);
+        cmd.Parameters.AddWithValue("reason", NpgsqlTypes.NpgsqlDbType.Text, string.IsNullOrEmpty(request.Reason) ? DBNull.Value : (object)request.Reason);
+        return await cmd.ExecuteNonQueryAsync() > 0;
+    }
+
+    public async Task<BuildJobLease> ExtendLeaseAsync(Guid id, ExtendBuildJobLeaseRequest request)
+    {
+        await using var conn = await pubSub.DataSource.OpenConnectionAsync();
+        await using var cmd = conn.CreateCommand();
+        cmd.CommandText = """
+            UPDATE build_queue SET heartbeat_at = now(), lease_expires_at = now() + make_interval(secs => @lease)
+            WHERE id = @id AND claimed_by = @workerId AND status = 'claimed'
+            RETURNING cancel_requested_at IS NOT NULL, superseded_by IS NOT NULL
+            """;
+        cmd.Parameters.AddWithValue("id", id);
+        cmd.Parameters.AddWithValue("workerId", request.WorkerId);
+        cmd.Parameters.AddWithValue("lease", (double)request.LeaseSeconds);
+
+        await using var reader = await cmd.ExecuteReaderAsync();
+        if (!await reader.ReadAsync())
+            return new BuildJobLease { Held = false };
+
+        return new BuildJobLease
+        {
+            Held = true,
+            CancelRequested = reader.GetBoolean(0),
+            Superseded = reader.GetBoolean(1),
+        };
+    }
+
+    public async Task<ClaimedBuildJob?> ResumeAsync(Guid id, ExtendBuildJobLeaseRequest request)
+    {
+        await using var conn = await pubSub.DataSource.OpenConnectionAsync();
+        await using var cmd = conn.CreateCommand();
+        cmd.CommandText = """
+            UPDATE build_queue SET heartbeat_at = now(), lease_expires_at = now() + make_interval(secs => @lease)
+            WHERE id = @id AND claimed_by = @workerId AND status = 'claimed'
+            RETURNING id, payload::text, attempts
+            """;
+        cmd.Parameters.AddWithValue("id", id);
+        cmd.Parameters.AddWithValue("workerId", request.WorkerId);
+        cmd.Parameters.AddWithValue("lease", (double)request.LeaseSeconds);
+
+        await using var reader = await cmd.ExecuteReaderAsync();
+        if (!await reader.ReadAsync())
+            return null;
+
+        var attempt = reader.GetInt32(2);
+        return new ClaimedBuildJob
+        {
+            Id = reader.GetGuid(0),
+            Payload = SignedForClaim(JsonDocument.Parse(reader.GetString(1)).RootElement, request.WorkerId, attempt),
+            Attempt = attempt,
+        };
+    }
+
+    /// <summary>
+    /// The payload with its token signed again for this claim. Only the response carries it: the row keeps
+    /// the token the API signed, which workers reading the queue from Postgres check.
+    /// </summary>
+    private JsonElement SignedForClaim(JsonElement payload, string workerId, int attempt)
+    {
+        if (!payload.TryGetProperty("signed", out var signed) || signed.GetString() is not { } token ||
+            signer.SignClaim(token, workerId, attempt) is not { } claimToken)
+            return payload;
+
+        var node = JsonNode.Parse(payload.GetRawText())!.AsObject();
+        node["signed"] = claimToken;
+        return JsonSerializer.SerializeToElement(node);
+    }
+
+    /// <summary>
+    /// Billable build seconds the tenant's jobs recorded since the given time.
+    /// </summary>
+    public async Task<long> UsedSecondsAsync(string tenant, DateTime since)
+    {
+        await using var conn = await pubSub.DataSource.OpenConnectionAsync();
+        await using var cmd = conn.CreateCommand();
+        cmd.CommandText = """
+            SELECT COALESCE(sum(billable_seconds), 0) FROM build_usage WHERE tenant = @tenant AND recorded_at >= @since
+            """;
+        cmd.Parameters.AddWithValue("tenant", tenant);
+        cmd.Parameters.AddWithValue("since", since.ToUniversalTime());
+        return Convert.ToInt64(await cmd.ExecuteScalarAsync());
+    }
+
+    public async Task<DateTime?> NextDueAsync()
+    {
+        await using var conn = await pubSub.DataSource.OpenConnectionAsync();
+        await using var cmd = conn.CreateCommand();
+        cmd.CommandText = """
+            SELECT min(GREATEST(run_after, next_attempt_at)) FROM build_queue
+            WHERE status = 'pending' AND cancel_requested_at IS NULL AND GREATEST(run_after, next_attempt_at) > now()
+            """;
+        var due = await cmd.ExecuteScalarAsync();
+        return due is DateTime d ? d : null;
+    }
+
+    /// <summary>
+    /// Marks pending builds of the same app and branch as superseded by the newest queued one,
+    /// including the claimed job itself if a newer build is already queued.
+    /// </summary>
+    public async Task<List<ClaimedBuildJob>> SupersedeOlderAsync(Guid id)
+    {
+        await using var conn = await pubSub.DataSource.OpenConnectionAsync();
+        await using var cmd = conn.CreateCommand();
+        cmd.CommandText = $"""
+            WITH me AS (
+                SELECT {string.Format(BuildKey, "m")} AS build_key FROM build_queue m WHERE m.id = @id
+            ),
+            newest AS (
+                SELECT n.id, n.created_at FROM build_queue n, me
+                WHERE {string.Format(BuildKey, "n")} = me.build_key AND (n.status = 'pending' OR n.id = @id)
+                ORDER BY n.created_at DESC LIMIT 1
+            )
+            UPDATE build_queue q
+            SET status = 'superseded', superseded_by = newest.id, finished_at = now(), lease_expires_at = NULL
+            FROM newest, me
+            WHERE {string.Format(BuildKey, "q")} = me.build_key AND q.created_at < newest.created_at
+                AND (q.status = 'pending' OR q.id = @id)
+            RETURNING q.id, q.payload::text, q.attempts, newest.id
+            """;
+        cmd.Parameters.AddWithValue("id", id);
+
+        var superseded = new List<ClaimedBuildJob>();
+        await using var reader = await cmd.ExecuteReaderAsync();
+        while (await reader.ReadAsync())
+        {
+            logger.LogInformation("Build {BuildId} superseded by {NewestId}", reader.GetGuid(0), reader.GetGuid(3));
+            superseded.Add(new ClaimedBuildJob
+            {
+                Id = reader.GetGuid(0),
+                Payload = JsonDocument.Parse(reader.GetString(1)).RootElement,
+                Attempt = reader.GetInt32(2),
+            });
+        }
+        return superseded;
+    }
+
+    /// <summary>
+    /// Requests cancellation of older running builds of the same app and branch, notifying the workers that run them.
+    /// </summary>
+    public async Task<List<Guid>> SupersedeRunningAsync(Guid id)
+    {
+        await using var conn = await pubSub.DataSource.OpenConnectionAsync();
+        var ids = new List<Guid>();
+        await using (var cmd = conn.CreateCommand())
+        {
+            cmd.CommandText = $"""
+                WITH me AS (
+                    SELECT {string.Format(BuildKey, "m")} AS build_key, m.created_at FROM build_queue m WHERE m.id = @id
+                )
+                UPDATE build_queue q
+                SET cancel_requested_at = now(), superseded_by = @id
+                FROM me
+                WHERE {string.Format(BuildKey, "q")} = me.build_key AND q.status = 'claimed' AND q.id <> @id
+                    AND q.cancel_requested_at IS NULL AND q.created_at < me.created_at
+                RETURNING q.id
+                """;
+            cmd.Parameters.AddWithValue("id", id);
+            await using var reader = await cmd.ExecuteReaderAsync();
+            while (await reader.ReadAsync())
+                ids.Add(reader.GetGuid(0));
+        }
+
+        foreach (var superseded in ids)
+        {
+            await using var notify = conn.CreateCommand();
+            notify.CommandText = "SELECT pg_notify('build_job_superseded', @id)";
+            notify.Parameters.AddWithValue("id", superseded.ToString());
+            await notify.ExecuteNonQueryAsync();
+        }
+        return ids;
+    }
+
+    /// <summary>
+    /// Waits up to timeout for queue notifications, returning as soon as one arrives.
+    /// </summary>
+    public async Task<List<BuildJobEvent>> WaitAsync(TimeSpan timeout, CancellationToken cancellationToken)
+    {
+        // A pooled connection is fine: it is reset, which ends the LISTEN, when returned to the pool
+        await using var conn = await pubSub.DataSource.OpenConnectionAsync(cancellationToken);
+        await using (var listenCmd = conn.CreateCommand())
+        {
+            listenCmd.CommandText = string.Join(' ', Channels.Select(c => $"LISTEN {c};"));
+            await listenCmd.ExecuteNonQueryAsync(cancellationToken);
+        }
+
+        var events = new List<BuildJobEvent>();
+        conn.Notification += (_, e) => events.Add(e.Channel switch
+        {
+            "build_job_cancelled" => new BuildJobEvent { Type = "cancelled", JobId = e.Payload },
+            "build_job_superseded" => new BuildJobEvent { Type = "superseded", JobId = e.Payload },
+            _ => new BuildJobEvent { Type = "available" },
+        });
+
+        // A zero timeout would wait forever, so stop once less than a millisecond is left
+        var deadline = DateTime.UtcNow + timeout;
+        while (events.Count == 0)
+        {
+            var remaining = deadline - DateTime.UtcNow;
+            if (remaining < TimeSpan.FromMilliseconds(1) || !await conn.WaitAsync(remaining, cancellationToken))
+                break;
+        }
+
+        // Collect notifications that arrived together
+        while (events.Count > 0 && await conn.WaitAsync(TimeSpan.FromMilliseconds(50), cancellationToken)) { }
+
+        return events;
+    }
+
+    /// <summary>
+    /// Publishes log lines to the live log stream of a build, like the worker's PostgreSQL NOTIFY.
+    /// Returns false without publishing if the job is not leased to the worker.
+    /// </summary>
+    public async Task<bool> PublishLogsAsync(Guid id, string workerId, IEnumerable<BuildLogEntry> entries)
+    {
+        await using var conn = await pubSub.DataSource.OpenConnectionAsync();
+        await using (var leased = conn.CreateCommand())
+        {
+            leased.CommandText = "SELECT 1 FROM build_queue WHERE id = @id AND claimed_by = @workerId AND status = 'claimed'";
+            leased.Parameters.AddWithValue("id", id);
+            leased.Parameters.AddWithValue("workerId", workerId);
+            if (await leased.ExecuteScalarAsync() == null)
+                return false;
+        }
+
+        var channel = $"build_log_{id:N}";
+        foreach (var entry in entries)
+        {
+            await using var cmd = conn.CreateCommand();
+            cmd.CommandText = "SELECT pg_notify(@channel, @payload)";
+            cmd.Parameters.AddWithValue("channel", channel);
+            cmd.Parameters.AddWithValue("payload", JsonSerializer.Serialize(entry));
+            await cmd.ExecuteNonQueryAsync();
+        }
+        return true;
+    }
+}
@@ -11,13 +11,17 @@ namespace Api.Services;
 public class BuildOrchestrationService(
     AppDbContext appDbContext,
     BuildQueuePublisher buildQueuePublisher,
+    BuildPayloadSigner payloadSigner,
+    BuildSecretEncryptor secretEncryptor,
     IAppBuildPublisher publisher,
     GitHubAppService gitHubAppService,
     IConfiguration configuration,
     ILogger<BuildOrchestrationService> logger)
 {
     /// <summary>
-    /// Creates and queues a build job for the given app
+    /// Creates and queues a build job for the given app. Builds of the app's configured branch
+    /// are production builds; builds of any other branch are previews, queued at a lower
+    /// priority and not activated when they finish.
     /// </summary>
     public async Task<AppBuild> CreateAndQueueBuildAsync(
         App app,
@@ -25,16 +29,30 @@ public class BuildOrchestrationService(
         string repoFullName,
         string artifactsUploadPath,
         Dictionary<string, string>? buildEnvVars = null,
-        string? deploymentName = null)
+        string? deploymentName = null,
+        string? branch = null,
+        DateTime? runAfter = null)
     {
-        // Fetch build environment variables if not provided
-        buildEnvVars ??= await appDbContext.Variables
+        var variables = await appDbContext.Variables
             .Where(v => v.AppId == app.Id && (v.Target == VariableTarget.Build || v.Target == VariableTarget.All))
-            .ToDictionaryAsync(v => v.Name, v => v.Value ?? "");
+            .ToListAsync();
+
+        // Secrets are encrypted for the worker when a key is configured, otherwise they are sent with the rest
+        var encryptSecrets = secretEncryptor.IsConfigured;
+        buildEnvVars ??= variables
+            .Where(v => !(v.IsSecret && encryptSecrets))
+            .ToDictionary(v => v.Name, v => v.Value ?? "");
+        var secretEnvVars = variables
+            .Where(v => v.IsSecret && encryptSecrets)
+            .ToDictionary(v => v.Name, v => v.Value ?? "");
 
         // Fetch latest commit info from GitHub
         var config = app.BuildConfigs ?? AppBuildConfigs.Default;
-        var branch = string.IsNullOrEmpty(config.Branch) ? AppBuildConfigs.Default.Branch : config.Branch;
+        var productionBranch = string.IsNullOrEmpty(config.Branch) ? AppBuildConfigs.Default.Branch : config.Branch;
+        if (string.IsNullOrEmpty(branch))
+            branch = productionBranch;
+        var preview = branch != productionBranch;
+        var priority = preview ? BuildPriority.Preview : BuildPriority.Production;
 
         GitHubCommitInfo? commitInfo = null;
         try
@@ -69,8 +87,9 @@ public class BuildOrchestrationService(
             if (!string.IsNullOrEmpty(commitInfo.Commit.Author.Name))
                 build.Metadata[BuildMetadataKeys.Author] = commitInfo.Commit.Author.Name;
         }
-        if (!string.IsNullOrEmpty(branch))
-            build.Metadata[BuildMetadataKeys.Branch] = branch;
+        build.Metadata[BuildMetadataKeys.Branch] = branch;
+        if (preview)
+            build.Metadata[BuildMetadataKeys.Preview] = "true";
 
         appDbContext.AppBuildJobs.Add(build);
 
@@ -102,9 +121,11 @@ public class BuildOrchestrationService(
         var message = new AppBuildMessage
         {
             BuildId = build.Id.ToString(),
+            AppId = app.Id,
+            TenantId = app.OwnerId,
             RepoFullName = repoFullName,
             CloneUrl = cloneUrl,
-            Branch = buildConfig.Branch,
+            Branch = branch,
             Directory = buildConfig.Directory,
             OutDir = buildConfig.OutDir,
             InstallCommand = buildConfig.InstallCommand,
@@ -112,18 +133,22 @@ public class BuildOrchestrationService(
             NodeVersion = buildConfig.NodeVersion,
             BuilderImage = builderImage,
             EnvVars = buildEnvVars,
+            SecretEnvVars = secretEncryptor.Encrypt(build.Id, secretEnvVars),
             ArtifactsUploadPath = finalArtifactsUploadPath,
             LogsUploadPath = $"/apps/{app.Id}/spa/builds/{build.Id}/logs",
             Limits = planLimits
         };
+        message.Signed = payloadSigner.Sign(message, runAfter);
 
         await appDbContext.SaveChangesAsync();
 
-        await buildQueuePublisher.PublishAsync(build.Id, JsonSerializer.Serialize(message));
+        await buildQueuePublisher.PublishAsync(build.Id, JsonSerializer.Serialize(message),
+            priority + planLimits.QueuePriorityBoost, runAfter);
 
         publisher.Publish(app.Id, build.Status);
 
-        logger.LogInformation("Created and queued build {BuildId} for app {AppId}", build.Id, app.Id);
+        logger.LogInformation("Created and queued {Kind} build {BuildId} of {Branch} for app {AppId}",
+            preview ? "preview" : "production", build.Id, branch, app.Id);
 
         return build;
     }
@@ -0,0 +1,89 @@
+using System.Buffers.Text;
+using System.Security.Cryptography;
+using System.Text;
+using System.Text.Json;
+using System.Text.Json.Nodes;
+using Api.Domain.Messages;
+
+namespace Api.Services;
+
+/// <summary>
+/// Signs build messages as HS256 JWS so workers can reject jobs that were not queued by the API.
+/// The key id is part of the token: to rotate, give workers the new key first, then switch
+/// Build:Signing here, and drop the old key from workers once its tokens have expired.
+/// </summary>
+public class BuildPayloadSigner(IConfiguration configuration)
+{
+    /// <summary>
+    /// Returns the signed message, or null if signing is not configured. Tokens expire
+    /// Build:Signing:TtlHours after the build may first run.
+    /// </summary>
+    public string? Sign(AppBuildMessage message, DateTime? runAfter = null)
+    {
+        var keyId = configuration["Build:Signing:KeyId"];
+        var key = configuration["Build:Signing:Key"];
+        if (string.IsNullOrEmpty(keyId) || string.IsNullOrEmpty(key))
+            return null;
+
+        var ttl = TimeSpan.FromHours(configuration.GetValue("Build:Signing:TtlHours", 24));
+        var now = DateTimeOffset.UtcNow;
+        var start = runAfter > now.UtcDateTime ? new DateTimeOffset(DateTime.SpecifyKind(runAfter.Value, DateTimeKind.Utc)) : now;
+
+        var claims = JsonSerializer.SerializeToNode(message)!.AsObject();
+        claims["iat"] = now.ToUnixTimeSeconds();
+        claims["exp"] = (start + ttl).ToUnixTimeSeconds();
+
+        return SignClaims(keyId, Convert.FromBase64String(key), claims);
+    }
+
+    /// <summary>
+    /// Signs a token again for one claim of its job: the worker it is leased to and the attempt,
+    /// so the worker rejects it if the job is handed back and run again before it expires.
+    /// Returns null if the token is not signed with the current key.
+    /// </summary>
+    public string? SignClaim(string signed, string workerId, int attempt)
+    {
+        var keyId = configuration["Build:Signing:KeyId"];
+        var key = configuration["Build:Signing:Key"];
+        if (string.IsNullOrEmpty(keyId) || string.IsNullOrEmpty(key))
+            return null;
+
+        var keyBytes = Convert.FromBase64String(key);
+        var parts = signed.Split('.');
+        if (parts.Length != 3)
+            return null;
+
+        JsonObject claims;
+        try
+        {
+            var header = JsonNode.Parse(Base64Url.DecodeFromChars(parts[0]));
+            if ((string?)header?["kid"] != keyId)
+                return null;
+
+            // Only what the API signed is signed again
+            var signature = HMACSHA256.HashData(keyBytes, Encoding.ASCII.GetBytes(parts[0] + "." + parts[1]));
+            if (!CryptographicOperations.FixedTimeEquals(signature, Base64Url.DecodeFromChars(parts[2])))
+                return null;
+
+            claims = JsonNode.Parse(Base64Url.DecodeFromChars(parts[1]))!.AsObject();
+        }
+        catch (Exception ex) when (ex is FormatException or JsonException)
+        {
+            return null;
+        }
+
+        claims["worker_id"] = workerId;
+        claims["attempt"] = attempt;
+        return SignClaims(keyId, keyBytes, claims);
+    }
+
+    private static string SignClaims(string keyId, byte[] key, JsonObject claims)
+    {
+        var header = JsonSerializer.SerializeToUtf8Bytes(new { alg = "HS256", kid = keyId, typ = "build+jws" });
+        var signingInput = Base64Url.EncodeToString(header) + "." +
+                           Base64Url.EncodeToString(Encoding.UTF8.GetBytes(claims.ToJsonString()));
+        var signature = HMACSHA256.HashData(key, Encoding.ASCII.GetBytes(signingInput));
+
+        return signingInput + "." + Base64Url.EncodeToString(signature);
+    }
+}
@@ -15,19 +15,33 @@ public class PubSubDataSource : IDisposable
     public void Dispose() => DataSource.Dispose();
 }
 
+/// <summary>
+/// Build queue priorities; workers claim higher values first
+/// </summary>
+public static class BuildPriority
+{
+    public const int Preview = 0;
+    public const int Production = 10;
+}
+
 public class BuildQueuePublisher(PubSubDataSource pubSub, ILogger<BuildQueuePublisher> logger)
 {
-    public async Task PublishAsync(Guid buildId, string payloadJson)
+    /// <summary>
+    /// Queues a build job. Jobs with a runAfter time are held back until then.
+    /// </summary>
+    public async Task PublishAsync(Guid buildId, string payloadJson, int priority = BuildPriority.Production, DateTime? runAfter = null)
     {
         await using var conn = await pubSub.DataSource.OpenConnectionAsync();
         await using var cmd = conn.CreateCommand();
 
         cmd.CommandText = """
-            INSERT INTO build_queue (id, payload) VALUES (@id, @payload::jsonb);
+            INSERT INTO build_queue (id, payload, priority, run_after) VALUES (@id, @payload::jsonb, @priority, @runAfter);
             NOTIFY build_job_available;
             """;
         cmd.Parameters.AddWithValue("id", buildId);
         cmd.Parameters.AddWithValue("payload", payloadJson);
+        cmd.Parameters.AddWithValue("priority", priority);
+        cmd.Parameters.AddWithValue("runAfter", NpgsqlTypes.NpgsqlDbType.TimestampTz, (object?)runAfter ?? DBNull.Value);
         await cmd.ExecuteNonQueryAsync();
 
         logger.LogDebug("Queued build job {BuildId}", buildId);
@@ -0,0 +1,45 @@
+using System.Security.Cryptography;
+using System.Text;
+using System.Text.Json;
+using Api.Domain.Messages;
+
+namespace Api.Services;
+
+/// <summary>
+/// Encrypts secret build variables with AES-256-GCM so they are never stored in plaintext in
+/// build_queue; only workers holding the key can read them. The build id is bound as associated
+/// data, so the ciphertext can't be reused for another build. Rotate keys like the signing key.
+/// </summary>
+public class BuildSecretEncryptor(IConfiguration configuration)
+{
+    private const int NonceSize = 12;
+    private const int TagSize = 16;
+
+    public bool IsConfigured =>
+        !string.IsNullOrEmpty(configuration["Build:Secrets:KeyId"]) && !string.IsNullOrEmpty(configuration["Build:Secrets:Key"]);
+
+    /// <summary>
+    /// Returns the encrypted variables, or null if there are none or no key is configured.
+    /// </summary>
+    public EncryptedBuildSecrets? Encrypt(Guid buildId, Dictionary<string, string> secrets)
+    {
+        if (secrets.Count == 0 || !IsConfigured)
+            return null;
+
+        var key = Convert.FromBase64String(configuration["Build:Secrets:Key"]!);
+        var plaintext = JsonSerializer.SerializeToUtf8Bytes(secrets);
+        var nonce = RandomNumberGenerator.GetBytes(NonceSize);
+        var ciphertext = new byte[plaintext.Length + TagSize];
+
+        using var aes = new AesGcm(key, TagSize);
+        aes.Encrypt(nonce, plaintext, ciphertext.AsSpan(0, plaintext.Length), ciphertext.AsSpan(plaintext.Length),
+            Encoding.UTF8.GetBytes(buildId.ToString()));
+
+        return new EncryptedBuildSecrets
+        {
+            KeyId = configuration["Build:Secrets:KeyId"]!,
+            Nonce = Convert.ToBase64String(nonce),
+            Ciphertext = Convert.ToBase64String(ciphertext),
+        };
+    }
+}
@@ -0,0 +1,124 @@
+package main
+
+import (
+	"encoding/json"
+	"mycrocloud/worker/jobqueue"
+	"sync"
+)
+
+// capacityReporter is implemented by runtimes that know how much memory and CPU they can
+// give to builds.
+type capacityReporter interface {
+	TotalCapacity() (memoryBytes int64, milliCPUs int64)
+}
+
+// hostCapacityReporter is implemented by runtimes that place each build on one of several
+// hosts, so a build has to fit in what is free on a single host.
+type hostCapacityReporter interface {
+	// LargestFree returns the free memory and CPU of the host with the most free memory.
+	LargestFree() (memoryBytes int64, milliCPUs int64)
+}
+
+// admission tracks the memory and CPU reserved by the builds running on this worker, so only
+// jobs whose limits fit in what is left are claimed. A worker can run many small builds or a
+// few large ones, but never more than MaxConcurrentJobs at once.
+type admission struct {
+	limits   Limits
+	capacity func() (memoryBytes int64, milliCPUs int64)
+	hosts    hostCapacityReporter // nil if the runtime doesn't spread builds over hosts
+
+	mu             sync.Mutex
+	reservedMemory int64
+	reservedCPU    int64
+	running        int
+}
+
+// newAdmission sizes the budget from worker.memory_mb and worker.cpus, then the capacity the
+// runtime reports, then MaxConcurrentJobs builds with the default limits.
+func newAdmission(cfg Config, limits Limits, rt BuildRuntime) *admission {
+	a := &admission{limits: limits}
+	a.hosts, _ = rt.(hostCapacityReporter)
+	switch r, ok := rt.(capacityReporter); {
+	case cfg.Worker.MemoryMB > 0 && cfg.Worker.CPUs > 0:
+		memory, cpu := cfg.Worker.MemoryMB*MB, int64(cfg.Worker.CPUs*1000)
+		a.capacity = func() (int64, int64) { return memory, cpu }
+	case ok:
+		a.capacity = r.TotalCapacity
+	default:
+		n := int64(limits.MaxConcurrentJobs)
+		memory, cpu := n*limits.DefaultJob.MemoryBytes, n*limits.DefaultJob.MilliCPUs()
+		a.capacity = func() (int64, int64) { return memory, cpu }
+	}
+	return a
+}
+
+// budget returns what is free for another job, or false if nothing is. On a runtime with
+// several hosts it is no more than the roomiest host has free.
+func (a *admission) budget() (*jobqueue.Budget, bool) {
+	memory, cpu := a.capacity()
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.limits.MaxConcurrentJobs > 0 && a.running >= a.limits.MaxConcurrentJobs {
+		return nil, false
+	}
+	freeMemory, freeCPU := memory-a.reservedMemory, cpu-a.reservedCPU
+	if a.hosts != nil {
+		hostMemory, hostCPU := a.hosts.LargestFree()
+		freeMemory, freeCPU = min(freeMemory, hostMemory), min(freeCPU, hostCPU)
+	}
+	if freeMemory <= 0 || freeCPU <= 0 {
+		return nil, false
+	}
+	return &jobqueue.Budget{
+		MemoryMB:          int(freeMemory / MB),
+		CPUPercent:        int(freeCPU / 10),
+		DefaultMemoryMB:   int(a.limits.DefaultJob.MemoryBytes / MB),
+		MaxMemoryMB:       int(a.limits.System.MaxMemoryBytes / MB),
+		DefaultCPUPercent: int(a.limits.DefaultJob.MilliCPUs() / 10),
+		MaxCPUPercent:     a.limits.System.MaxCPUPercent,
+	}, true
+}
+
+// reserve takes the job's limits out of the budget until release is called.
+func (a *admission) reserve(job JobLimits) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.reservedMemory += job.MemoryBytes
+	a.reservedCPU += job.MilliCPUs()
+	a.running++
+}
+
+func (a *admission) release(job JobLimits) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.reservedMemory -= job.MemoryBytes
+	a.reservedCPU -= job.MilliCPUs()
+	a.running--
+}
+
+// slots returns how many builds with the default limits fit in the budget.
+func (a *admission) slots() int {
+	memory, cpu := a.capacity()
+	n := int(min(memory/max(a.limits.DefaultJob.MemoryBytes, 1), cpu/max(a.limits.DefaultJob.MilliCPUs(), 1)))
+	if a.limits.MaxConcurrentJobs > 0 {
+		n = min(n, a.limits.MaxConcurrentJobs)
+	}
+	return n
+}
+
+// runningJobs returns how many admitted jobs are running.
+func (a *admission) runningJobs() int {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return a.running
+}
+
+// jobLimitsOf returns the limits a claimed job will run with. Payloads that don't parse get
+// the default limits; ProcessJob rejects them before anything is started.
+func (a *admission) jobLimitsOf(job *jobqueue.Job) JobLimits {
+	var payload struct {
+		Limits *PlanLimits `json:"limits"`
+	}
+	_ = json.Unmarshal([]byte(job.Payload), &payload)
+	return a.limits.GetJobLimits(payload.Limits)
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"context"
+	"mycrocloud/worker/jobqueue"
+	"testing"
+)
+
+func TestAdmissionBudget(t *testing.T) {
+	var cfg Config
+	cfg.Worker.MemoryMB = 4096
+	cfg.Worker.CPUs = 2
+	a := newAdmission(cfg, DefaultLimits(), newFakeRuntime(fakeRun{}))
+
+	big := a.jobLimitsOf(&jobqueue.Job{Payload: `{"build_id":"b1","limits":{"memory_mb":3072,"cpu_percent":100}}`})
+	if big.MemoryBytes != 3*GB {
+		t.Fatalf("job memory = %s, want the plan's 3 GB", formatBytes(big.MemoryBytes))
+	}
+	a.reserve(big)
+
+	budget, ok := a.budget()
+	if !ok || budget.MemoryMB != 1024 || budget.CPUPercent != 100 {
+		t.Fatalf("budget = %+v, want 1 GB and 1 CPU left", budget)
+	}
+	if !budget.Fits(0, 0) || budget.Fits(2048, 0) {
+		t.Errorf("budget should fit a default job and not a 2 GB one")
+	}
+
+	small := a.jobLimitsOf(&jobqueue.Job{Payload: `{"build_id":"b2"}`})
+	a.reserve(small)
+	if _, ok := a.budget(); ok {
+		t.Errorf("budget left after reserving everything")
+	}
+	if n := a.runningJobs(); n != 2 {
+		t.Errorf("running = %d, want 2", n)
+	}
+
+	a.release(big)
+	if budget, ok := a.budget(); !ok || budget.MemoryMB != 3072 {
+		t.Errorf("budget after release = %+v, want 3 GB free", budget)
+	}
+}
+
+func TestAdmissionUsesRuntimeCapacity(t *testing.T) {
+	h1, _ := testHost("h1", 8*GB, 4000)
+	h2, e2 := testHost("h2", 2*GB, 2000)
+	e2.setPingErr(errFakeDaemon)
+	p := newTestPool(t, h1, h2)
+	limits := DefaultLimits()
+	limits.MaxConcurrentJobs = 10
+
+	a := newAdmission(Config{}, limits, p)
+	budget, ok := a.budget()
+	if !ok || budget.MemoryMB != 8192 || budget.CPUPercent != 400 {
+		t.Errorf("budget = %+v, want the capacity of the hosts that are up", budget)
+	}
+	if n := a.slots(); n != 4 {
+		t.Errorf("slots = %d, want 4 default builds", n)
+	}
+}
+
+func TestAdmissionBudgetFitsOneHost(t *testing.T) {
+	h1, _ := testHost("h1", 4*GB, 2000)
+	h2, _ := testHost("h2", 4*GB, 2000)
+	p := newTestPool(t, h1, h2)
+	a := newAdmission(Config{}, DefaultLimits(), p)
+
+	job := a.jobLimitsOf(&jobqueue.Job{Payload: `{"build_id":"b1","limits":{"memory_mb":3072,"cpu_percent":100}}`})
+	a.reserve(job)
+	if _, err := p.Create(context.Background(), ContainerSpec{Labels: map[string]string{"build_id": "b1"}, Limits: job}); err != nil {
+		t.Fatal(err)
+	}
+
+	// 5 GB is free in total, but no more than 4 GB on any one host
+	budget, ok := a.budget()
+	if !ok || budget.MemoryMB != 4096 || budget.CPUPercent != 200 {
+		t.Errorf("budget = %+v, want what h2 has free", budget)
+	}
+}
+
+func TestAdmissionCapsConcurrentJobs(t *testing.T) {
+	var cfg Config
+	cfg.Worker.MemoryMB = 64 * 1024
+	cfg.Worker.CPUs = 32
+	limits := DefaultLimits()
+	limits.MaxConcurrentJobs = 2
+	a := newAdmission(cfg, limits, newFakeRuntime(fakeRun{}))
+
+	if n := a.slots(); n != 2 {
+		t.Errorf("slots = %d, want MaxConcurrentJobs", n)
+	}
+	job := a.jobLimitsOf(&jobqueue.Job{Payload: `{"build_id":"b1"}`})
+	a.reserve(job)
+	a.reserve(job)
+	if budget, ok := a.budget(); ok {
+		t.Errorf("budget = %+v with MaxConcurrentJobs builds running, want none", budget)
+	}
+	a.release(job)
+	if _, ok := a.budget(); !ok {
+		t.Errorf("no budget after a build finished")
+	}
+}
@@ -6,6 +6,8 @@ import (
 	"fmt"
 	"io"
 	"net/http"
+	"sync"
+	"time"
 )
 
 type Config struct {
@@ -18,9 +20,18 @@ type Config struct {
 type TokenResponse struct {
 	AccessToken string `json:"access_token"`
 	TokenType   string `json:"token_type"`
+	ExpiresIn   int    `json:"expires_in"` // seconds
 }
 
 func GetAccessToken(cfg Config) (string, error) {
+	tr, err := requestToken(cfg)
+	if err != nil {
+		return "", err
+	}
+	return tr.AccessToken, nil
+}
+
+func requestToken(cfg Config) (TokenResponse, error) {
 	url := cfg.Domain + "/oauth/token"
 
 	payload := map[string]string{
@@ -32,34 +43,65 @@ func GetAccessToken(cfg Config) (string, error) {
 
 	body, err := json.Marshal(payload)
 	if err != nil {
-		return "", fmt.Errorf("marshal payload: %w", err)
+		return TokenResponse{}, fmt.Errorf("marshal payload: %w", err)
 	}
 
 	req, err := http.NewRequest(http.MethodPost, url, bytes.NewReader(body))
 	if err != nil {
-		return "", fmt.Errorf("create request: %w", err)
+		return TokenResponse{}, fmt.Errorf("create request: %w", err)
 	}
 	req.Header.Set("Content-Type", "application/json")
 
 	res, err := http.DefaultClient.Do(req)
 	if err != nil {
-		return "", fmt.Errorf("send request: %w", err)
+		return TokenResponse{}, fmt.Errorf("send request: %w", err)
 	}
 	defer res.Body.Close()
 
 	respBody, err := io.ReadAll(res.Body)
 	if err != nil {
-		return "", fmt.Errorf("read response: %w", err)
+		return TokenResponse{}, fmt.Errorf("read response: %w", err)
 	}
 
 	if res.StatusCode < 200 || res.StatusCode >= 300 {
-		return "", fmt.Errorf("auth failed: %d %s", res.StatusCode, string(respBody))
+		return TokenResponse{}, fmt.Errorf("auth failed: %d %s", res.StatusCode, string(respBody))
 	}
 
 	var tr TokenResponse
 	if err := json.Unmarshal(respBody, &tr); err != nil {
-		return "", fmt.Errorf("unmarshal response: %w", err)
+		return TokenResponse{}, fmt.Errorf("unmarshal response: %w", err)
 	}
 
-	return tr.AccessToken, nil
+	return tr, nil
+}
+
+// TokenSource caches an access token for callers that make frequent requests,
+// fetching a new one shortly before it expires.
+type TokenSource struct {
+	cfg       Config
+	mu        sync.Mutex
+	token     string
+	expiresAt time.Time
+}
+
+func NewTokenSource(cfg Config) *TokenSource {
+	return &TokenSource{cfg: cfg}
+}
+
+func (s *TokenSource) Token() (string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.token != "" && time.Now().Before(s.expiresAt) {
+		return s.token, nil
+	}
+
+	tr, err := requestToken(s.cfg)
+	if err != nil {
+		return "", err
+	}
+	s.token = tr.AccessToken
+	// Refresh a minute early so a token never expires mid-request
+	s.expiresAt = time.Now().Add(time.Duration(tr.ExpiresIn)*time.Second - time.Minute)
+	return s.token, nil
 }
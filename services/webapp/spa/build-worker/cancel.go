@@ -0,0 +1,93 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+)
+
+// errBuildCancelled is the cancellation cause of a job whose build was cancelled by the user.
+var errBuildCancelled = errors.New("build cancelled")
+
+// errBuildSuperseded is the cancellation cause of a job superseded by a newer build of the same app and branch.
+var errBuildSuperseded = fmt.Errorf("%w: superseded by a newer build", errBuildCancelled)
+
+// errWorkerShutdown is the cancellation cause of jobs still running when the shutdown grace period ends.
+var errWorkerShutdown = errors.New("worker shutting down")
+
+// isShutdown reports whether ctx was cancelled because the worker is shutting down.
+func isShutdown(ctx context.Context) bool {
+	return errors.Is(context.Cause(ctx), errWorkerShutdown)
+}
+
+// isCancelled reports whether ctx was cancelled because the build was cancelled or superseded.
+func isCancelled(ctx context.Context) bool {
+	return errors.Is(context.Cause(ctx), errBuildCancelled)
+}
+
+// isSuperseded reports whether ctx was cancelled because a newer build superseded it.
+func isSuperseded(ctx context.Context) bool {
+	return errors.Is(context.Cause(ctx), errBuildSuperseded)
+}
+
+// runningJobs tracks in-flight jobs by build_queue id so they can be cancelled.
+type runningJobs struct {
+	mu      sync.Mutex
+	cancels map[string]context.CancelCauseFunc
+}
+
+func newRunningJobs() *runningJobs {
+	return &runningJobs{cancels: make(map[string]context.CancelCauseFunc)}
+}
+
+// start returns a context for the job that is cancelled when the build is cancelled or parent is done.
+func (r *runningJobs) start(parent context.Context, jobID string) context.Context {
+	ctx, cancel := context.WithCancelCause(parent)
+	r.mu.Lock()
+	r.cancels[jobID] = cancel
+	r.mu.Unlock()
+	return ctx
+}
+
+// finish releases the job's context.
+func (r *runningJobs) finish(jobID string) {
+	r.mu.Lock()
+	cancel, ok := r.cancels[jobID]
+	delete(r.cancels, jobID)
+	r.mu.Unlock()
+	if ok {
+		cancel(nil)
+	}
+}
+
+// ids returns the ids of the jobs running on this worker.
+func (r *runningJobs) ids() []string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	ids := make([]string, 0, len(r.cancels))
+	for id := range r.cancels {
+		ids = append(ids, id)
+	}
+	return ids
+}
+
+// cancelAll cancels every job running on this worker with the given cause.
+func (r *runningJobs) cancelAll(cause error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for _, cancel := range r.cancels {
+		cancel(cause)
+	}
+}
+
+// cancel cancels the job with the given cause if it is running on this worker. Returns false otherwise.
+func (r *runningJobs) cancel(jobID string, cause error) bool {
+	r.mu.Lock()
+	cancel, ok := r.cancels[jobID]
+	r.mu.Unlock()
+	if ok {
+		cancel(cause)
+	}
+	return ok
+}
@@ -2,7 +2,9 @@ package main
 
 import (
 	"encoding/json"
+	"errors"
 	"os"
+	"time"
 )
 
 type Config struct {
@@ -20,7 +22,118 @@ type Config struct {
 	} `json:"api"`
 	Builder struct {
 		AutoRemove bool `json:"auto_remove"`
+		// Where secret env vars are written for the build container. Must be a tmpfs, at the same
+		// path on the Docker host.
+		SecretsDir string `json:"secrets_dir"`
+		// Hosts builds may clone from over https
+		AllowedCloneHosts []string `json:"allowed_clone_hosts"`
+		// How often the resource usage of a running build is sampled
+		StatsIntervalSeconds int `json:"stats_interval_seconds"`
 	} `json:"builder"`
+	Worker struct {
+		ID string `json:"id"` // Unique worker identity; generated from the hostname if empty
+		// Capabilities this worker advertises, e.g. {"memory": "16g", "tier": "paid", "custom-images": "true"}.
+		// Jobs with required_labels are only claimed by workers that have all of them.
+		Labels map[string]string `json:"labels"`
+		// How long a shutdown waits for running builds before handing them back to the queue
+		ShutdownGraceSeconds int `json:"shutdown_grace_seconds"`
+		// Memory and CPUs builds on this worker may use in total. If unset, the capacity of the
+		// docker hosts is used, or MAX_CONCURRENT_JOBS builds with the default limits. Either way
+		// no more than MAX_CONCURRENT_JOBS builds run at once.
+		MemoryMB int64   `json:"memory_mb"`
+		CPUs     float64 `json:"cpus"`
+	} `json:"worker"`
+	Runtime struct {
+		Driver string `json:"driver"` // "docker" (default) or "kubernetes"
+		Docker struct {
+			// Daemons builds are placed on; the one from the DOCKER_* environment variables if empty.
+			// Remote hosts must see build_output_dir and builder.secrets_dir at the same paths.
+			Hosts              []DockerHostConfig `json:"hosts"`
+			HealthCheckSeconds int                `json:"health_check_seconds"` // How often hosts are pinged
+		} `json:"docker"`
+		Kubernetes struct {
+			Kubeconfig string `json:"kubeconfig"` // Uses the in-cluster service account if empty
+			Namespace  string `json:"namespace"`
+			// ReadWriteMany claim mounted in the worker at build_output_dir and in every build pod
+			OutputClaim  string            `json:"output_claim"`
+			NodeSelector map[string]string `json:"node_selector"` // Nodes build pods may run on
+			// The kubelet's podPidsLimit on those nodes. Pods can't set their own, so it is checked
+			// against the build pids limit at startup.
+			PodPidsLimit int64 `json:"pod_pids_limit"`
+		} `json:"kubernetes"`
+	} `json:"runtime"`
+	Signing struct {
+		Require bool `json:"require"` // Reject jobs whose payload is not signed by the API
+		// Key id -> base64 HMAC-SHA256 key. Keep the previous key while rotating until its jobs have expired.
+		Keys             map[string]string `json:"keys"`
+		ClockSkewSeconds int               `json:"clock_skew_seconds"` // Tolerance when checking expiry
+	} `json:"signing"`
+	Secrets struct {
+		// Key id -> base64 AES-256 key. Keep the previous key while rotating until its jobs have run.
+		Keys map[string]string `json:"keys"`
+	} `json:"secrets"`
+	GC struct {
+		Disabled                bool  `json:"disabled"`                  // Leave cleaning up to AutoRemove and external tooling
+		IntervalSeconds         int   `json:"interval_seconds"`          // How often the janitor runs
+		ContainerRetentionHours int   `json:"container_retention_hours"` // How long exited build containers are kept for debugging
+		OutputRetentionHours    int   `json:"output_retention_hours"`    // How long output dirs of finished builds are kept
+		MinFreeDiskMB           int64 `json:"min_free_disk_mb"`          // Below this, builder images and the oldest outputs are removed
+	} `json:"gc"`
+	Queue struct {
+		Driver           string `json:"driver"`             // "postgres" (default), "http" to pull jobs from the API, or "memory" for local development
+		MemoryJobsDir    string `json:"memory_jobs_dir"`    // Build messages (*.json) the memory queue starts with
+		LeaseSeconds     int    `json:"lease_seconds"`      // How long a claim is valid without a heartbeat
+		HeartbeatSeconds int    `json:"heartbeat_seconds"`  // How often in-flight jobs renew their lease
+		MaxAttempts      int    `json:"max_attempts"`       // Attempts before an infrastructure failure is dead-lettered
+		RetryBaseSeconds int    `json:"retry_base_seconds"` // Backoff before the first retry, doubled on each attempt
+		RetryMaxSeconds  int    `json:"retry_max_seconds"`  // Upper bound for the retry backoff
+		SupersedePending bool   `json:"supersede_pending"`  // Skip queued builds that a newer build of the same app and branch replaces
+		SupersedeRunning bool   `json:"supersede_running"`  // Also cancel running builds that a newer build replaces
+	} `json:"queue"`
+}
+
+// DockerHostConfig is a Docker daemon builds can be placed on.
+type DockerHostConfig struct {
+	Name string `json:"name"`
+	Host string `json:"host"` // unix:///var/run/docker.sock, tcp://host:2376 or ssh://user@host
+	TLS  struct {
+		CACert string `json:"ca_cert"`
+		Cert   string `json:"cert"`
+		Key    string `json:"key"`
+	} `json:"tls"` // Client certificates for tcp hosts
+	MemoryMB int64   `json:"memory_mb"` // Memory builds may use; the daemon's total memory if 0
+	CPUs     float64 `json:"cpus"`      // CPUs builds may use; the daemon's CPU count if 0
+}
+
+// ShutdownGracePeriod returns how long a shutdown waits for running builds to finish.
+func (c Config) ShutdownGracePeriod() time.Duration {
+	return time.Duration(c.Worker.ShutdownGraceSeconds) * time.Second
+}
+
+// LeaseDuration returns how long a claimed job stays leased to this worker without a heartbeat.
+func (c Config) LeaseDuration() time.Duration {
+	return time.Duration(c.Queue.LeaseSeconds) * time.Second
+}
+
+// StatsInterval returns how often the resource usage of a running build is sampled.
+func (c Config) StatsInterval() time.Duration {
+	return time.Duration(c.Builder.StatsIntervalSeconds) * time.Second
+}
+
+// HeartbeatInterval returns how often the lease of an in-flight job is renewed.
+func (c Config) HeartbeatInterval() time.Duration {
+	return time.Duration(c.Queue.HeartbeatSeconds) * time.Second
+}
+
+// RetryBackoff returns how long to wait before retrying a job whose given attempt failed.
+// The delay doubles with each attempt, capped at RetryMaxSeconds.
+func (c Config) RetryBackoff(attempt int) time.Duration {
+	backoff := time.Duration(c.Queue.RetryBaseSeconds) * time.Second
+	maxBackoff := time.Duration(c.Queue.RetryMaxSeconds) * time.Second
+	for i := 1; i < attempt && backoff < maxBackoff; i++ {
+		backoff *= 2
+	}
+	return min(backoff, maxBackoff)
 }
 
 func LoadConfig(path string) (Config, error) {
@@ -32,5 +145,64 @@ func LoadConfig(path string) (Config, error) {
 	if err := json.Unmarshal(data, &cfg); err != nil {
 		return Config{}, err
 	}
+
+	if cfg.Worker.ShutdownGraceSeconds <= 0 {
+		cfg.Worker.ShutdownGraceSeconds = 60
+	}
+	if cfg.Builder.SecretsDir == "" {
+		cfg.Builder.SecretsDir = "/dev/shm/mycrocloud-build-secrets"
+	}
+	if len(cfg.Builder.AllowedCloneHosts) == 0 {
+		cfg.Builder.AllowedCloneHosts = []string{"github.com"}
+	}
+	if cfg.Builder.StatsIntervalSeconds <= 0 {
+		cfg.Builder.StatsIntervalSeconds = 5
+	}
+	if cfg.Runtime.Driver == "" {
+		cfg.Runtime.Driver = "docker"
+	}
+	if cfg.Runtime.Docker.HealthCheckSeconds <= 0 {
+		cfg.Runtime.Docker.HealthCheckSeconds = 15
+	}
+	if cfg.Runtime.Kubernetes.Namespace == "" {
+		cfg.Runtime.Kubernetes.Namespace = "default"
+	}
+	if cfg.Signing.Require && len(cfg.Signing.Keys) == 0 {
+		return Config{}, errors.New("signing.require is set but no signing.keys are configured")
+	}
+	if cfg.Signing.ClockSkewSeconds <= 0 {
+		cfg.Signing.ClockSkewSeconds = 60
+	}
+	if cfg.GC.IntervalSeconds <= 0 {
+		cfg.GC.IntervalSeconds = 300
+	}
+	if cfg.GC.ContainerRetentionHours <= 0 {
+		cfg.GC.ContainerRetentionHours = 24
+	}
+	if cfg.GC.OutputRetentionHours <= 0 {
+		cfg.GC.OutputRetentionHours = 24
+	}
+	if cfg.GC.MinFreeDiskMB <= 0 {
+		cfg.GC.MinFreeDiskMB = 5120
+	}
+	if cfg.Queue.Driver == "" {
+		cfg.Queue.Driver = "postgres"
+	}
+	if cfg.Queue.LeaseSeconds <= 0 {
+		cfg.Queue.LeaseSeconds = 120
+	}
+	if cfg.Queue.HeartbeatSeconds <= 0 || cfg.Queue.HeartbeatSeconds >= cfg.Queue.LeaseSeconds {
+		// Renew well before the lease runs out so one missed heartbeat doesn't lose the job
+		cfg.Queue.HeartbeatSeconds = max(cfg.Queue.LeaseSeconds/3, 1)
+	}
+	if cfg.Queue.MaxAttempts <= 0 {
+		cfg.Queue.MaxAttempts = 5
+	}
+	if cfg.Queue.RetryBaseSeconds <= 0 {
+		cfg.Queue.RetryBaseSeconds = 10
+	}
+	if cfg.Queue.RetryMaxSeconds <= 0 {
+		cfg.Queue.RetryMaxSeconds = 600
+	}
 	return cfg, nil
 }
@@ -0,0 +1,403 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"mycrocloud/worker/logcollector"
+	"sync"
+	"time"
+
+	"github.com/docker/docker/client"
+)
+
+// errNoCapacity is returned by DockerPool.Create when no healthy host has room for the build.
+var errNoCapacity = errors.New("no docker host has capacity for the build")
+
+// dockerEndpoint is a Docker daemon in the pool.
+type dockerEndpoint interface {
+	BuildRuntime
+	Ping(ctx context.Context) error
+	Capacity(ctx context.Context) (memoryBytes int64, milliCPUs int64, err error)
+}
+
+// dockerHost is a daemon in the pool with the resources reserved by the builds placed on it.
+type dockerHost struct {
+	name     string
+	endpoint dockerEndpoint
+	memory   int64 // capacity in bytes; read from the daemon if not configured
+	cpu      int64 // capacity in millicores; read from the daemon if not configured
+	up       bool
+
+	reservedMemory int64
+	reservedCPU    int64
+}
+
+func (h *dockerHost) freeMemory() int64 { return h.memory - h.reservedMemory }
+func (h *dockerHost) freeCPU() int64    { return h.cpu - h.reservedCPU }
+
+// placement is a container placed on a host and the resources reserved for it.
+type placement struct {
+	host   *dockerHost
+	memory int64
+	cpu    int64
+}
+
+// DockerPool runs build containers on a pool of Docker daemons. Each build is placed on the
+// healthy host with the most free memory that also has the CPU its limits need. Hosts are
+// pinged periodically; one whose daemon doesn't answer is marked down until it does again.
+// Only builds placed or adopted by this worker count towards a host's usage.
+type DockerPool struct {
+	mu     sync.Mutex
+	hosts  []*dockerHost
+	placed map[string]placement   // containers placed or adopted by this worker, until released
+	listed map[string]*dockerHost // containers found by the last List
+
+	stop chan struct{}
+	done chan struct{}
+}
+
+// NewDockerPool connects to the hosts in runtime.docker.hosts, or the daemon from the
+// DOCKER_* environment variables if none are configured.
+func NewDockerPool(cfg Config) (*DockerPool, error) {
+	configs := cfg.Runtime.Docker.Hosts
+	if len(configs) == 0 {
+		configs = []DockerHostConfig{{Name: "local"}}
+	}
+	var hosts []*dockerHost
+	for _, hc := range configs {
+		rt, err := NewDockerRuntime(hc)
+		if err != nil {
+			return nil, fmt.Errorf("docker host %s: %w", hc.Name, err)
+		}
+		hosts = append(hosts, &dockerHost{
+			name:     hc.Name,
+			endpoint: rt,
+			memory:   hc.MemoryMB * MB,
+			cpu:      int64(hc.CPUs * 1000),
+		})
+	}
+	return newDockerPool(hosts, time.Duration(cfg.Runtime.Docker.HealthCheckSeconds)*time.Second), nil
+}
+
+func newDockerPool(hosts []*dockerHost, healthInterval time.Duration) *DockerPool {
+	p := &DockerPool{
+		hosts:  hosts,
+		placed: make(map[string]placement),
+		stop:   make(chan struct{}),
+		done:   make(chan struct{}),
+	}
+	p.checkHealth()
+	go p.runHealthChecks(healthInterval)
+	return p
+}
+
+func (p *DockerPool) runHealthChecks(interval time.Duration) {
+	defer close(p.done)
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-p.stop:
+			return
+		case <-ticker.C:
+			p.checkHealth()
+		}
+	}
+}
+
+// checkHealth pings every host, marking it up or down, and reads the capacity of hosts
+// that don't have one configured.
+func (p *DockerPool) checkHealth() {
+	for _, h := range p.hosts {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		err := h.endpoint.Ping(ctx)
+		var memory, cpu int64
+		if err == nil && (h.memory == 0 || h.cpu == 0) {
+			memory, cpu, err = h.endpoint.Capacity(ctx)
+		}
+		cancel()
+
+		p.mu.Lock()
+		if err == nil {
+			if h.memory == 0 {
+				h.memory = memory
+			}
+			if h.cpu == 0 {
+				h.cpu = cpu
+			}
+		}
+		p.setUp(h, err)
+		p.mu.Unlock()
+	}
+}
+
+// setUp marks the host up if err is nil and down otherwise. p.mu must be held.
+func (p *DockerPool) setUp(h *dockerHost, err error) {
+	up := err == nil
+	if up && !h.up {
+		log.Printf("Docker host %s is up (memory=%s, cpu=%d%%)", h.name, formatBytes(h.memory), h.cpu/10)
+	} else if !up && h.up {
+		log.Printf("Docker host %s is down: %v", h.name, err)
+	} else if !up && h.memory == 0 {
+		log.Printf("Docker host %s is unreachable: %v", h.name, err)
+	}
+	h.up = up
+}
+
+// place reserves resources for a build on the best host that hasn't been tried yet.
+func (p *DockerPool) place(memory, cpu int64, tried map[*dockerHost]bool) *dockerHost {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	var best *dockerHost
+	for _, h := range p.hosts {
+		if !h.up || tried[h] || h.freeMemory() < memory || h.freeCPU() < cpu {
+			continue
+		}
+		if best == nil || h.freeMemory() > best.freeMemory() ||
+			(h.freeMemory() == best.freeMemory() && h.freeCPU() > best.freeCPU()) {
+			best = h
+		}
+	}
+	if best != nil {
+		best.reservedMemory += memory
+		best.reservedCPU += cpu
+	}
+	return best
+}
+
+func (p *DockerPool) unreserve(h *dockerHost, memory, cpu int64) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	h.reservedMemory -= memory
+	h.reservedCPU -= cpu
+}
+
+// Create places the container on a host with room for its limits. If the chosen daemon
+// can't be reached it is marked down and the next best host is tried.
+func (p *DockerPool) Create(ctx context.Context, spec ContainerSpec) (string, error) {
+	memory, cpu := spec.Limits.MemoryBytes, spec.Limits.MilliCPUs()
+	tried := map[*dockerHost]bool{}
+	for {
+		h := p.place(memory, cpu, tried)
+		if h == nil {
+			return "", fmt.Errorf("%w (memory=%s, cpu=%d%%)", errNoCapacity, formatBytes(memory), cpu/10)
+		}
+		tried[h] = true
+
+		id, err := h.endpoint.Create(ctx, spec)
+		if err != nil {
+			p.unreserve(h, memory, cpu)
+			if client.IsErrConnectionFailed(err) {
+				p.mu.Lock()
+				p.setUp(h, err)
+				p.mu.Unlock()
+				continue
+			}
+			return "", fmt.Errorf("docker host %s: %w", h.name, err)
+		}
+
+		log.Printf("Placed container %s on docker host %s", id, h.name)
+		p.mu.Lock()
+		p.placed[id] = placement{host: h, memory: memory, cpu: cpu}
+		p.mu.Unlock()
+		return id, nil
+	}
+}
+
+// TotalCapacity returns the memory and CPU of the hosts that are up.
+func (p *DockerPool) TotalCapacity() (memoryBytes int64, milliCPUs int64) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for _, h := range p.hosts {
+		if h.up {
+			memoryBytes += h.memory
+			milliCPUs += h.cpu
+		}
+	}
+	return memoryBytes, milliCPUs
+}
+
+// LargestFree returns the free memory and CPU of the host that is up with the most free
+// memory, the one the next build would be placed on.
+func (p *DockerPool) LargestFree() (memoryBytes int64, milliCPUs int64) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	var best *dockerHost
+	for _, h := range p.hosts {
+		if !h.up {
+			continue
+		}
+		if best == nil || h.freeMemory() > best.freeMemory() ||
+			(h.freeMemory() == best.freeMemory() && h.freeCPU() > best.freeCPU()) {
+			best = h
+		}
+	}
+	if best == nil {
+		return 0, 0
+	}
+	return best.freeMemory(), best.freeCPU()
+}
+
+// endpoint returns the daemon the container was placed on or found on by List.
+func (p *DockerPool) endpoint(id string) (dockerEndpoint, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if pl, ok := p.placed[id]; ok {
+		return pl.host.endpoint, nil
+	}
+	if h, ok := p.listed[id]; ok {
+		return h.endpoint, nil
+	}
+	return nil, fmt.Errorf("container %s was not placed by this worker", id)
+}
+
+func (p *DockerPool) Start(ctx context.Context, id string) error {
+	e, err := p.endpoint(id)
+	if err != nil {
+		return err
+	}
+	return e.Start(ctx, id)
+}
+
+func (p *DockerPool) Wait(ctx context.Context, id string) (ExitStatus, error) {
+	e, err := p.endpoint(id)
+	if err != nil {
+		return ExitStatus{}, err
+	}
+	return e.Wait(ctx, id)
+}
+
+func (p *DockerPool) StreamLogs(ctx context.Context, id string, collector *logcollector.Collector) {
+	e, err := p.endpoint(id)
+	if err != nil {
+		log.Printf("Failed to attach to container logs: %v", err)
+		return
+	}
+	e.StreamLogs(ctx, id, collector)
+}
+
+func (p *DockerPool) Stats(ctx context.Context, id string) (Sample, error) {
+	e, err := p.endpoint(id)
+	if err != nil {
+		return Sample{}, err
+	}
+	return e.Stats(ctx, id)
+}
+
+func (p *DockerPool) Stop(ctx context.Context, id string) error {
+	e, err := p.endpoint(id)
+	if err != nil {
+		return err
+	}
+	return e.Stop(ctx, id)
+}
+
+// List returns the build containers on the hosts that are up, and remembers which host
+// each is on. Containers that weren't placed or adopted by this worker don't count towards
+// their host's usage. A host that fails to list is marked down and skipped, so one
+// unreachable daemon doesn't hide the builds on the others.
+func (p *DockerPool) List(ctx context.Context) ([]Container, error) {
+	var all []Container
+	listed := make(map[string]*dockerHost)
+	for _, h := range p.upHosts() {
+		containers, err := h.endpoint.List(ctx)
+		if err != nil {
+			p.mu.Lock()
+			p.setUp(h, fmt.Errorf("listing containers: %w", err))
+			p.mu.Unlock()
+			continue
+		}
+		for _, c := range containers {
+			listed[c.ID] = h
+		}
+		all = append(all, containers...)
+	}
+	p.mu.Lock()
+	p.listed = listed
+	p.mu.Unlock()
+	return all, nil
+}
+
+// Adopt places a container found by the last List on the host it is running on, reserving
+// its limits there until it is released, as if this worker had created it.
+func (p *DockerPool) Adopt(c Container) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if _, ok := p.placed[c.ID]; ok {
+		return nil
+	}
+	h, ok := p.listed[c.ID]
+	if !ok {
+		return fmt.Errorf("container %s is not on any docker host that is up", c.ID)
+	}
+	memory, cpu := c.Limits.MemoryBytes, c.Limits.MilliCPUs()
+	p.placed[c.ID] = placement{host: h, memory: memory, cpu: cpu}
+	h.reservedMemory += memory
+	h.reservedCPU += cpu
+	return nil
+}
+
+// PruneContainers removes old build containers on every host that is up.
+func (p *DockerPool) PruneContainers(ctx context.Context, olderThan time.Duration) (int, error) {
+	removed := 0
+	var errs []error
+	for _, h := range p.upHosts() {
+		n, err := h.endpoint.PruneContainers(ctx, olderThan)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("docker host %s: %w", h.name, err))
+		}
+		removed += n
+	}
+	return removed, errors.Join(errs...)
+}
+
+// PruneImages removes unused builder images on every host that is up.
+func (p *DockerPool) PruneImages(ctx context.Context) (uint64, error) {
+	var reclaimed uint64
+	var errs []error
+	for _, h := range p.upHosts() {
+		n, err := h.endpoint.PruneImages(ctx)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("docker host %s: %w", h.name, err))
+		}
+		reclaimed += n
+	}
+	return reclaimed, errors.Join(errs...)
+}
+
+func (p *DockerPool) upHosts() []*dockerHost {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	var up []*dockerHost
+	for _, h := range p.hosts {
+		if h.up {
+			up = append(up, h)
+		}
+	}
+	return up
+}
+
+// Release frees the resources reserved on the container's host.
+func (p *DockerPool) Release(id string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	pl, ok := p.placed[id]
+	if !ok {
+		return
+	}
+	delete(p.placed, id)
+	pl.host.reservedMemory -= pl.memory
+	pl.host.reservedCPU -= pl.cpu
+}
+
+func (p *DockerPool) Close() error {
+	close(p.stop)
+	<-p.done
+	var errs []error
+	for _, h := range p.hosts {
+		errs = append(errs, h.endpoint.Close())
+	}
+	return errors.Join(errs...)
+}
@@ -0,0 +1,209 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/docker/docker/client"
+)
+
+// fakeEndpoint is a Docker daemon in a test pool.
+type fakeEndpoint struct {
+	*fakeRuntime
+	name string
+
+	mu      sync.Mutex
+	pingErr error
+}
+
+func (e *fakeEndpoint) Ping(ctx context.Context) error {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return e.pingErr
+}
+
+func (e *fakeEndpoint) Capacity(ctx context.Context) (int64, int64, error) {
+	return 8 * GB, 8000, nil
+}
+
+func (e *fakeEndpoint) Create(ctx context.Context, spec ContainerSpec) (string, error) {
+	if _, err := e.fakeRuntime.Create(ctx, spec); err != nil {
+		return "", err
+	}
+	return e.name + "-" + spec.Labels["build_id"], nil
+}
+
+func (e *fakeEndpoint) setPingErr(err error) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.pingErr = err
+}
+
+func newTestPool(t *testing.T, hosts ...*dockerHost) *DockerPool {
+	t.Helper()
+	p := newDockerPool(hosts, time.Hour)
+	t.Cleanup(func() { p.Close() })
+	return p
+}
+
+func testHost(name string, memory int64, cpu int64) (*dockerHost, *fakeEndpoint) {
+	e := &fakeEndpoint{fakeRuntime: newFakeRuntime(fakeRun{}), name: name}
+	return &dockerHost{name: name, endpoint: e, memory: memory, cpu: cpu}, e
+}
+
+func buildSpec(id string, memory int64, cpuPercent int64) ContainerSpec {
+	return ContainerSpec{
+		Labels: map[string]string{"build_id": id},
+		Limits: JobLimits{MemoryBytes: memory, CPUQuota: cpuPercent * 1000, CPUPeriod: 100000},
+	}
+}
+
+func TestDockerPoolPlacesOnMostFreeMemory(t *testing.T) {
+	small, _ := testHost("small", 2*GB, 4000)
+	large, _ := testHost("large", 4*GB, 4000)
+	p := newTestPool(t, small, large)
+	ctx := context.Background()
+
+	// large has the most free memory until two builds are placed on it
+	var ids []string
+	for _, build := range []string{"b1", "b2", "b3"} {
+		id, err := p.Create(ctx, buildSpec(build, 1*GB, 100))
+		if err != nil {
+			t.Fatal(err)
+		}
+		ids = append(ids, id)
+	}
+	want := []string{"large-b1", "large-b2", "small-b3"}
+	for i := range want {
+		if ids[i] != want[i] {
+			t.Errorf("placements = %v, want %v", ids, want)
+			break
+		}
+	}
+
+	// Releasing a build frees its memory on the host
+	p.Release("large-b1")
+	p.Release("large-b2")
+	if id, _ := p.Create(ctx, buildSpec("b4", 1*GB, 100)); id != "large-b4" {
+		t.Errorf("after release placed on %s, want large", id)
+	}
+}
+
+func TestDockerPoolChecksCPU(t *testing.T) {
+	busy, _ := testHost("busy", 8*GB, 1000)
+	idle, _ := testHost("idle", 4*GB, 4000)
+	p := newTestPool(t, busy, idle)
+
+	id, err := p.Create(context.Background(), buildSpec("b1", 1*GB, 200))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if id != "idle-b1" {
+		t.Errorf("placed on %s, want the host with enough CPU", id)
+	}
+}
+
+func TestDockerPoolNoCapacity(t *testing.T) {
+	h, _ := testHost("h1", 2*GB, 2000)
+	p := newTestPool(t, h)
+	ctx := context.Background()
+
+	if _, err := p.Create(ctx, buildSpec("b1", 2*GB, 100)); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := p.Create(ctx, buildSpec("b2", 1*GB, 100)); !errors.Is(err, errNoCapacity) {
+		t.Errorf("Create on a full pool = %v, want errNoCapacity", err)
+	}
+}
+
+func TestDockerPoolSkipsDownHosts(t *testing.T) {
+	h1, e1 := testHost("h1", 8*GB, 4000)
+	h2, _ := testHost("h2", 2*GB, 4000)
+	e1.setPingErr(errors.New("connection refused"))
+	p := newTestPool(t, h1, h2)
+	ctx := context.Background()
+
+	if id, _ := p.Create(ctx, buildSpec("b1", 1*GB, 100)); id != "h2-b1" {
+		t.Errorf("placed on %s, want h2 while h1 is down", id)
+	}
+
+	// h1 is used again once it answers pings
+	e1.setPingErr(nil)
+	p.checkHealth()
+	if id, _ := p.Create(ctx, buildSpec("b2", 1*GB, 100)); id != "h1-b2" {
+		t.Errorf("placed on %s, want h1 after it recovered", id)
+	}
+}
+
+func TestDockerPoolFailsOverWhenDaemonUnreachable(t *testing.T) {
+	h1, e1 := testHost("h1", 8*GB, 4000)
+	h2, _ := testHost("h2", 2*GB, 4000)
+	p := newTestPool(t, h1, h2)
+	e1.run.CreateErr = client.ErrorConnectionFailed("tcp://h1:2376")
+
+	id, err := p.Create(context.Background(), buildSpec("b1", 1*GB, 100))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if id != "h2-b1" {
+		t.Errorf("placed on %s, want h2", id)
+	}
+	if h1.up {
+		t.Errorf("unreachable host is still marked up")
+	}
+	if h1.reservedMemory != 0 {
+		t.Errorf("reservation on the unreachable host was not released")
+	}
+}
+
+func TestDockerPoolListSkipsFailingHost(t *testing.T) {
+	h1, e1 := testHost("h1", 8*GB, 4000)
+	h2, e2 := testHost("h2", 8*GB, 4000)
+	p := newTestPool(t, h1, h2)
+	e1.run.ListErr = client.ErrorConnectionFailed("tcp://h1:2376")
+	e2.run.Containers = []Container{{ID: "h2-b1", Labels: map[string]string{"build_id": "b1"}, Running: true}}
+
+	containers, err := p.List(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(containers) != 1 || containers[0].ID != "h2-b1" {
+		t.Errorf("List = %+v, want the container on h2", containers)
+	}
+	if h1.up {
+		t.Errorf("host that failed to list is still marked up")
+	}
+	if err := p.Adopt(containers[0]); err != nil {
+		t.Errorf("Adopt of a container on the host that answered: %v", err)
+	}
+}
+
+func TestDockerPoolReadsCapacityFromDaemon(t *testing.T) {
+	h, _ := testHost("h1", 0, 0)
+	newTestPool(t, h)
+
+	if h.memory != 8*GB || h.cpu != 8000 {
+		t.Errorf("capacity = %d bytes, %dm CPU, want the daemon's", h.memory, h.cpu)
+	}
+}
+
+func TestDockerPoolRoutesToPlacedHost(t *testing.T) {
+	h1, e1 := testHost("h1", 8*GB, 4000)
+	h2, e2 := testHost("h2", 2*GB, 4000)
+	p := newTestPool(t, h1, h2)
+	ctx := context.Background()
+	id, _ := p.Create(ctx, buildSpec("b1", 1*GB, 100))
+
+	if err := p.Stop(ctx, id); err != nil {
+		t.Fatal(err)
+	}
+	if !e1.wasStopped() || e2.wasStopped() {
+		t.Errorf("Stop was not sent to the host the container was placed on")
+	}
+	if err := p.Stop(ctx, "unknown"); err == nil {
+		t.Errorf("Stop of an unknown container succeeded")
+	}
+}
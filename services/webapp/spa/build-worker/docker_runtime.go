@@ -0,0 +1,307 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"io"
+	"log"
+	"mycrocloud/worker/logcollector"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/docker/cli/cli/connhelper"
+	"github.com/docker/docker/api/types/container"
+	"github.com/docker/docker/api/types/filters"
+	"github.com/docker/docker/api/types/mount"
+	"github.com/docker/docker/client"
+)
+
+// DockerRuntime runs build containers on a Docker daemon.
+type DockerRuntime struct {
+	cli *client.Client
+
+	// Set once the daemon rejected a size storage-opt; its storage driver can't cap the
+	// writable layer, so the disk limit is only enforced by watching usage.
+	noStorageOpt atomic.Bool
+}
+
+// NewDockerRuntime connects to the Docker daemon at host: a unix socket, tcp (with TLS if
+// certificates are given) or ssh. If host.Host is empty, the DOCKER_* environment variables are used.
+func NewDockerRuntime(host DockerHostConfig) (*DockerRuntime, error) {
+	opts := []client.Opt{client.FromEnv, client.WithAPIVersionNegotiation()}
+	if host.Host != "" {
+		helper, err := connhelper.GetConnectionHelper(host.Host)
+		if err != nil {
+			return nil, err
+		}
+		if helper != nil {
+			// ssh://user@host runs "docker system dial-stdio" on the remote host
+			opts = append(opts, client.WithHost(helper.Host), client.WithDialContext(helper.Dialer))
+		} else {
+			opts = append(opts, client.WithHost(host.Host))
+		}
+		if host.TLS.CACert != "" {
+			opts = append(opts, client.WithTLSClientConfig(host.TLS.CACert, host.TLS.Cert, host.TLS.Key))
+		}
+	}
+	cli, err := client.NewClientWithOpts(opts...)
+	if err != nil {
+		return nil, err
+	}
+	return &DockerRuntime{cli: cli}, nil
+}
+
+// Ping checks that the daemon is reachable.
+func (r *DockerRuntime) Ping(ctx context.Context) error {
+	_, err := r.cli.Ping(ctx)
+	return err
+}
+
+// Capacity returns the daemon's total memory in bytes and CPUs in millicores.
+func (r *DockerRuntime) Capacity(ctx context.Context) (memoryBytes int64, milliCPUs int64, err error) {
+	info, err := r.cli.Info(ctx)
+	if err != nil {
+		return 0, 0, err
+	}
+	return info.MemTotal, int64(info.NCPU) * 1000, nil
+}
+
+func (r *DockerRuntime) Create(ctx context.Context, spec ContainerSpec) (string, error) {
+	// Get secure host config with resource limits
+	hostConfig := GetSecureHostConfig(spec.Limits)
+	hostConfig.AutoRemove = spec.AutoRemove
+	for _, m := range spec.Mounts {
+		hostConfig.Mounts = append(hostConfig.Mounts, mount.Mount{
+			Type:     mount.TypeBind,
+			Source:   m.Source,
+			Target:   m.Target,
+			ReadOnly: m.ReadOnly,
+		})
+	}
+
+	config := &container.Config{
+		Image:  spec.Image,
+		Tty:    false,
+		Env:    spec.Env,
+		Labels: spec.Labels,
+	}
+	if spec.Limits.DiskBytes > 0 && !r.noStorageOpt.Load() {
+		hostConfig.StorageOpt = map[string]string{"size": strconv.FormatInt(spec.Limits.DiskBytes, 10)}
+	}
+	resp, err := r.cli.ContainerCreate(ctx, config, hostConfig, nil, nil, "")
+	if err != nil && hostConfig.StorageOpt != nil && storageOptUnsupported(err) {
+		log.Printf("Docker daemon can't limit the size of build containers, watching their disk usage instead: %v", err)
+		r.noStorageOpt.Store(true)
+		hostConfig.StorageOpt = nil
+		resp, err = r.cli.ContainerCreate(ctx, config, hostConfig, nil, nil, "")
+	}
+	if err != nil {
+		return "", err
+	}
+	return resp.ID, nil
+}
+
+// storageOptUnsupported reports whether the daemon rejected a container because its storage
+// driver can't limit the container's size. Only some can, e.g. overlay2 on xfs mounted with pquota.
+func storageOptUnsupported(err error) bool {
+	msg := strings.ToLower(err.Error())
+	return strings.Contains(msg, "storage-opt") || strings.Contains(msg, "storage opt")
+}
+
+func (r *DockerRuntime) Start(ctx context.Context, id string) error {
+	return r.cli.ContainerStart(ctx, id, container.StartOptions{})
+}
+
+func (r *DockerRuntime) Wait(ctx context.Context, id string) (ExitStatus, error) {
+	statusCh, errCh := r.cli.ContainerWait(ctx, id, container.WaitConditionNotRunning)
+	select {
+	case err := <-errCh:
+		return ExitStatus{}, err
+	case status := <-statusCh:
+		exit := ExitStatus{ExitCode: int(status.StatusCode), Signal: signalOf(int(status.StatusCode))}
+		// Auto-removed containers may already be gone, in which case OOM kills aren't detected
+		if inspect, err := r.cli.ContainerInspect(context.WithoutCancel(ctx), id); err == nil && inspect.State != nil {
+			exit.OOMKilled = inspect.State.OOMKilled
+		}
+		return exit, nil
+	}
+}
+
+// Stats reads the container's usage the way "docker stats" does.
+func (r *DockerRuntime) Stats(ctx context.Context, id string) (Sample, error) {
+	resp, err := r.cli.ContainerStatsOneShot(ctx, id)
+	if err != nil {
+		return Sample{}, err
+	}
+	defer resp.Body.Close()
+	var stats container.StatsResponse
+	if err := json.NewDecoder(resp.Body).Decode(&stats); err != nil {
+		return Sample{}, err
+	}
+
+	sample := Sample{
+		MemoryBytes: stats.MemoryStats.Usage,
+		CPUSeconds:  float64(stats.CPUStats.CPUUsage.TotalUsage) / float64(time.Second),
+	}
+	// Page cache the kernel can reclaim doesn't count against the memory limit
+	// (inactive_file on cgroup v2, total_inactive_file on v1)
+	for _, key := range []string{"inactive_file", "total_inactive_file"} {
+		if cache, ok := stats.MemoryStats.Stats[key]; ok && cache < sample.MemoryBytes {
+			sample.MemoryBytes -= cache
+			break
+		}
+	}
+	for _, n := range stats.Networks {
+		sample.NetworkRxBytes += n.RxBytes
+		sample.NetworkTxBytes += n.TxBytes
+	}
+	// The size of the writable layer is only computed on request
+	if inspect, _, err := r.cli.ContainerInspectWithRaw(ctx, id, true); err == nil && inspect.SizeRw != nil {
+		sample.DiskBytes = uint64(max(*inspect.SizeRw, 0))
+	}
+	return sample, nil
+}
+
+// StreamLogs reads the Docker multiplexed log stream and feeds each line to the collector.
+func (r *DockerRuntime) StreamLogs(ctx context.Context, id string, collector *logcollector.Collector) {
+	reader, err := r.cli.ContainerLogs(ctx, id, container.LogsOptions{
+		ShowStdout: true,
+		ShowStderr: true,
+		Follow:     true,
+		Timestamps: false,
+	})
+	if err != nil {
+		log.Printf("Failed to attach to container logs: %v", err)
+		return
+	}
+	defer reader.Close()
+
+	// Docker multiplexed stream: 8-byte header per frame
+	// byte 0: stream type (1=stdout, 2=stderr)
+	// bytes 4-7: frame size (big-endian uint32)
+	hdr := make([]byte, 8)
+	for {
+		if _, err := io.ReadFull(reader, hdr); err != nil {
+			break
+		}
+		streamType := hdr[0]
+		size := binary.BigEndian.Uint32(hdr[4:8])
+		if size == 0 {
+			continue
+		}
+		payload := make([]byte, size)
+		if _, err := io.ReadFull(reader, payload); err != nil {
+			break
+		}
+
+		source := "stdout"
+		if streamType == 2 {
+			source = "stderr"
+		}
+
+		// Split payload into lines (a single frame may contain multiple lines)
+		scanner := bufio.NewScanner(strings.NewReader(string(payload)))
+		for scanner.Scan() {
+			line := scanner.Text()
+			if line != "" {
+				collector.Append(line, source, "app.builder", id)
+			}
+		}
+	}
+}
+
+func (r *DockerRuntime) Stop(ctx context.Context, id string) error {
+	return r.cli.ContainerStop(ctx, id, container.StopOptions{})
+}
+
+func (r *DockerRuntime) List(ctx context.Context) ([]Container, error) {
+	summaries, err := r.cli.ContainerList(ctx, container.ListOptions{
+		All:     true,
+		Filters: filters.NewArgs(filters.Arg("label", "build_id")),
+	})
+	if err != nil {
+		return nil, err
+	}
+	var containers []Container
+	for _, s := range summaries {
+		inspect, err := r.cli.ContainerInspect(ctx, s.ID)
+		if err != nil {
+			// Auto-removed since it was listed
+			continue
+		}
+		c := Container{ID: s.ID, Labels: s.Labels}
+		if inspect.State != nil {
+			c.Running = inspect.State.Running
+			if startedAt, err := time.Parse(time.RFC3339Nano, inspect.State.StartedAt); err == nil && startedAt.Year() > 1 {
+				c.StartedAt = startedAt
+			}
+		}
+		for _, m := range inspect.Mounts {
+			c.Mounts = append(c.Mounts, Mount{Source: m.Source, Target: m.Destination, ReadOnly: !m.RW})
+		}
+		if hc := inspect.HostConfig; hc != nil {
+			c.Limits = JobLimits{MemoryBytes: hc.Memory, CPUQuota: hc.CPUQuota, CPUPeriod: hc.CPUPeriod}
+		}
+		containers = append(containers, c)
+	}
+	return containers, nil
+}
+
+func (r *DockerRuntime) PruneContainers(ctx context.Context, olderThan time.Duration) (int, error) {
+	summaries, err := r.cli.ContainerList(ctx, container.ListOptions{
+		All: true,
+		Filters: filters.NewArgs(
+			filters.Arg("label", "build_id"),
+			filters.Arg("status", "exited"),
+			filters.Arg("status", "dead"),
+			filters.Arg("status", "created"),
+		),
+	})
+	if err != nil {
+		return 0, err
+	}
+	cutoff := time.Now().Add(-olderThan)
+	removed := 0
+	for _, s := range summaries {
+		finishedAt := time.Unix(s.Created, 0)
+		if s.State != container.StateCreated {
+			inspect, err := r.cli.ContainerInspect(ctx, s.ID)
+			if err != nil || inspect.State == nil {
+				continue
+			}
+			if finishedAt, err = time.Parse(time.RFC3339Nano, inspect.State.FinishedAt); err != nil {
+				continue
+			}
+		}
+		if finishedAt.After(cutoff) {
+			continue
+		}
+		if err := r.cli.ContainerRemove(ctx, s.ID, container.RemoveOptions{RemoveVolumes: true}); err != nil {
+			log.Printf("Failed to remove container %s: %v", s.ID, err)
+			continue
+		}
+		removed++
+	}
+	return removed, nil
+}
+
+func (r *DockerRuntime) PruneImages(ctx context.Context) (uint64, error) {
+	report, err := r.cli.ImagesPrune(ctx, filters.NewArgs(
+		filters.Arg("dangling", "false"),
+		filters.Arg("label", builderImageLabel),
+	))
+	if err != nil {
+		return 0, err
+	}
+	return report.SpaceReclaimed, nil
+}
+
+func (r *DockerRuntime) Release(id string) {}
+
+func (r *DockerRuntime) Close() error {
+	return r.cli.Close()
+}
@@ -1,34 +1,68 @@
 package main
 
+import "strconv"
+
 // PlanLimits contains resource limits based on account plan
 type PlanLimits struct {
 	MemoryMB       int `json:"memory_mb"`        // Container memory limit in MB
 	CPUPercent     int `json:"cpu_percent"`      // CPU limit as percentage (100 = 1 core)
 	BuildTimeoutS  int `json:"build_timeout_s"`  // Build timeout in seconds
 	ArtifactSizeMB int `json:"artifact_size_mb"` // Max artifact size in MB
+	DiskMB         int `json:"disk_mb"`          // Disk the build may write (container layer and output) in MB
+
+	Tier                 string `json:"tier,omitempty"`          // Plan the limits come from, recorded with the build's usage
+	MaxConcurrentBuilds  int    `json:"max_concurrent_builds"`   // Builds of the tenant running at once across all workers
+	BuildMinutesPerMonth int    `json:"build_minutes_per_month"` // Build minutes the tenant may use per calendar month (UTC), 0 for unlimited
 }
 
 type BuildMessage struct {
-	BuildId            string            `json:"build_id"`
-	RepoFullName       string            `json:"repo_full_name"`
-	CloneUrl           string            `json:"clone_url"`
-	Directory          string            `json:"directory"`
-	OutDir             string            `json:"out_dir"`
-	InstallCommand     string            `json:"install_command"`
-	BuildCommand       string            `json:"build_command"`
-	NodeVersion        string            `json:"node_version"`
-	BuilderImage       string            `json:"builder_image"`
-	EnvVars            map[string]string `json:"env_vars"`
+	Version             int               `json:"version,omitempty"` // Schema version, see currentMessageVersion
+	BuildId             string            `json:"build_id"`
+	AppId               int               `json:"app_id,omitempty"`
+	TenantId            string            `json:"tenant_id,omitempty"`
+	RepoFullName        string            `json:"repo_full_name"`
+	CloneUrl            string            `json:"clone_url"`
+	Branch              string            `json:"branch"`
+	Directory           string            `json:"directory"`
+	OutDir              string            `json:"out_dir"`
+	InstallCommand      string            `json:"install_command"`
+	BuildCommand        string            `json:"build_command"`
+	NodeVersion         string            `json:"node_version"`
+	BuilderImage        string            `json:"builder_image"`
+	EnvVars             map[string]string `json:"env_vars"`
+	SecretEnvVars       *EncryptedSecrets `json:"secret_env_vars,omitempty"` // Delivered to the container as a file, never as env
 	ArtifactsUploadPath string            `json:"artifacts_upload_path"`
 	LogsUploadPath      string            `json:"logs_upload_path"`
-	Limits             *PlanLimits       `json:"limits,omitempty"`
+	Limits              *PlanLimits       `json:"limits,omitempty"`
+	RequiredLabels      map[string]string `json:"required_labels,omitempty"` // Worker labels needed to run this job
+}
+
+// AppID returns the app the build belongs to, falling back to the artifacts upload path
+// for messages queued before app_id was added.
+func (m BuildMessage) AppID() string {
+	if m.AppId > 0 {
+		return strconv.Itoa(m.AppId)
+	}
+	return extractAppIdFromPath(m.ArtifactsUploadPath)
 }
+
+// TenantID returns the account the build is billed to, falling back to the app like the queue does.
+func (m BuildMessage) TenantID() string {
+	if m.TenantId != "" {
+		return m.TenantId
+	}
+	return m.AppID()
+}
+
 type BuildStatus int
 
 const (
 	Started BuildStatus = iota
 	Done
 	Failed
+	Cancelled
+	Superseded
+	Rejected // the payload failed signature verification
 )
 
 type BuildStatusChangedEventMessage struct {
@@ -36,4 +70,9 @@ type BuildStatusChangedEventMessage struct {
 	Status      BuildStatus `json:"status"`
 	ContainerId string      `json:"container_id,omitempty"`
 	ArtifactId  string      `json:"artifact_id,omitempty"`
+	// Why a Failed build failed: one of the Failure* codes, and a message for the user
+	FailureCode   string `json:"failure_code,omitempty"`
+	FailureReason string `json:"failure_reason,omitempty"`
+	// What the build used, set once its container has exited
+	Usage *Usage `json:"usage,omitempty"`
 }
@@ -0,0 +1,65 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+)
+
+// Failure codes sent with Failed status events, so a failed build can be told apart from
+// another without reading its logs. The message sent alongside is for people.
+const (
+	FailureInvalidPayload    = "invalid_payload"      // the build message didn't validate
+	FailureCloneFailed       = "clone_failed"         // git clone failed
+	FailureInstallFailed     = "install_failed"       // the install command failed
+	FailureBuildFailed       = "build_failed"         // the build command failed
+	FailureOutputMissing     = "output_missing"       // the build didn't create out_dir
+	FailureExitCode          = "exit_code"            // the build exited non-zero outside of a known step
+	FailureOutOfMemory       = "out_of_memory"        // the build exceeded its memory limit
+	FailureDiskLimitExceeded = "disk_limit_exceeded"  // the build wrote more than its disk limit
+	FailureKilled            = "killed"               // the build was killed by a signal
+	FailureTimeout           = "timeout"              // the build ran past its time limit
+	FailureArtifactTooLarge  = "artifact_too_large"   // the artifact exceeds the plan's size limit
+	FailureQuotaExceeded     = "quota_exceeded"       // the tenant used up its monthly build minutes
+	FailureUploadFailed      = "upload_failed"        // the artifact couldn't be uploaded to the API
+	FailureInfrastructure    = "infrastructure_error" // the runtime failed, not the build
+	FailureInternal          = "internal_error"       // the worker itself failed
+)
+
+// failedStepFile is where build.sh leaves the step that failed, in the job output dir.
+const failedStepFile = ".failed-step"
+
+// diskFullPercent of its disk limit used means a failed build most likely ran out of space:
+// where the runtime caps the writable layer, writes past the limit fail rather than the
+// build being stopped.
+const diskFullPercent = 95
+
+// exitFailure explains why a build container that exited unsuccessfully failed.
+func exitFailure(exit ExitStatus, usage Usage, jobOut string, buildMsg BuildMessage, jobLimits JobLimits) (code, message string) {
+	if exit.OOMKilled {
+		return FailureOutOfMemory, fmt.Sprintf("the build ran out of memory (limit %s)", formatBytes(jobLimits.MemoryBytes))
+	}
+	if jobLimits.DiskBytes > 0 && usage.PeakDiskBytes*100 >= uint64(jobLimits.DiskBytes)*diskFullPercent {
+		return FailureDiskLimitExceeded, fmt.Sprintf("disk limit exceeded: the build ran out of disk space (limit %s)", formatBytes(jobLimits.DiskBytes))
+	}
+	if exit.Signal != 0 {
+		return FailureKilled, fmt.Sprintf("the build was killed by signal %d (%s)", exit.Signal, syscall.Signal(exit.Signal))
+	}
+
+	step, _ := os.ReadFile(filepath.Join(jobOut, failedStepFile))
+	switch strings.TrimSpace(string(step)) {
+	case "clone":
+		return FailureCloneFailed, fmt.Sprintf("cloning %s failed (exit code %d)", buildMsg.RepoFullName, exit.ExitCode)
+	case "install":
+		return FailureInstallFailed, fmt.Sprintf("the install command failed (exit code %d)", exit.ExitCode)
+	case "build":
+		return FailureBuildFailed, fmt.Sprintf("the build command failed (exit code %d)", exit.ExitCode)
+	case "secrets":
+		return FailureInfrastructure, "the build could not read its secret env vars"
+	case "output":
+		return FailureOutputMissing, fmt.Sprintf("the build did not create the output directory '%s'", buildMsg.OutDir)
+	}
+	return FailureExitCode, fmt.Sprintf("the build exited with code %d", exit.ExitCode)
+}
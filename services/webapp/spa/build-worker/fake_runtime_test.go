@@ -0,0 +1,158 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"mycrocloud/worker/logcollector"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// fakeRun scripts what the build container of a fakeRuntime does.
+type fakeRun struct {
+	ExitCode  int
+	OOMKilled bool
+	Logs      []string          // lines written to stdout
+	Output    map[string]string // files written to /output, by name
+	Hang      bool              // run until stopped
+	OnStart   func()            // called once the container has started
+	Usage     *Sample           // returned by Stats; unsupported if nil
+
+	CreateErr error
+	StartErr  error
+
+	Containers []Container // returned by List
+	ListErr    error
+}
+
+// fakeRuntime is a BuildRuntime that runs a scripted container instead of a real one.
+type fakeRuntime struct {
+	run fakeRun
+
+	mu      sync.Mutex
+	specs   []ContainerSpec
+	stopped []string
+	stop    chan struct{}
+
+	prunedContainers int // PruneContainers calls
+	prunedImages     int // PruneImages calls
+}
+
+func newFakeRuntime(run fakeRun) *fakeRuntime {
+	return &fakeRuntime{run: run, stop: make(chan struct{})}
+}
+
+func (r *fakeRuntime) Create(ctx context.Context, spec ContainerSpec) (string, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.specs = append(r.specs, spec)
+	if r.run.CreateErr != nil {
+		return "", r.run.CreateErr
+	}
+	return "container-1", nil
+}
+
+func (r *fakeRuntime) Start(ctx context.Context, id string) error {
+	if r.run.StartErr != nil {
+		return r.run.StartErr
+	}
+	if r.run.OnStart != nil {
+		r.run.OnStart()
+	}
+	return nil
+}
+
+func (r *fakeRuntime) Wait(ctx context.Context, id string) (ExitStatus, error) {
+	if r.run.Hang {
+		select {
+		case <-ctx.Done():
+			return ExitStatus{}, ctx.Err()
+		case <-r.stop:
+			return ExitStatus{ExitCode: 137}, nil
+		}
+	}
+
+	spec := r.spec()
+	for _, m := range spec.Mounts {
+		if m.Target != "/output" {
+			continue
+		}
+		for name, content := range r.run.Output {
+			if err := os.WriteFile(filepath.Join(m.Source, name), []byte(content), 0644); err != nil {
+				return ExitStatus{}, err
+			}
+		}
+	}
+	return ExitStatus{ExitCode: r.run.ExitCode, OOMKilled: r.run.OOMKilled, Signal: signalOf(r.run.ExitCode)}, nil
+}
+
+func (r *fakeRuntime) StreamLogs(ctx context.Context, id string, collector *logcollector.Collector) {
+	for _, line := range r.run.Logs {
+		collector.Append(line, "stdout", "app.builder", id)
+	}
+}
+
+func (r *fakeRuntime) Stats(ctx context.Context, id string) (Sample, error) {
+	if r.run.Usage == nil {
+		return Sample{}, errStatsUnsupported
+	}
+	return *r.run.Usage, nil
+}
+
+func (r *fakeRuntime) Stop(ctx context.Context, id string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if len(r.stopped) == 0 {
+		close(r.stop)
+	}
+	r.stopped = append(r.stopped, id)
+	return nil
+}
+
+func (r *fakeRuntime) List(ctx context.Context) ([]Container, error) {
+	return r.run.Containers, r.run.ListErr
+}
+
+func (r *fakeRuntime) PruneContainers(ctx context.Context, olderThan time.Duration) (int, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.prunedContainers++
+	return 0, nil
+}
+
+func (r *fakeRuntime) PruneImages(ctx context.Context) (uint64, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.prunedImages++
+	return 0, nil
+}
+
+func (r *fakeRuntime) Release(id string) {}
+
+func (r *fakeRuntime) Close() error { return nil }
+
+// spec returns the spec of the created container.
+func (r *fakeRuntime) spec() ContainerSpec {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if len(r.specs) == 0 {
+		return ContainerSpec{}
+	}
+	return r.specs[len(r.specs)-1]
+}
+
+func (r *fakeRuntime) created() bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return len(r.specs) > 0
+}
+
+func (r *fakeRuntime) wasStopped() bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return len(r.stopped) > 0
+}
+
+var errFakeDaemon = errors.New("docker daemon unavailable")
@@ -0,0 +1,234 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// janitor cleans up after builds in the background: exited build containers and the
+// output directories of finished builds once their retention is up, and builder images and
+// the oldest outputs when build_output_dir runs low on disk space. Workers on the same host share build_output_dir;
+// a lock file in it makes sure only one of them cleans up at a time, and each build holds a
+// lock on its output dir (see lockOutput) so no janitor removes it while the build runs.
+type janitor struct {
+	rt       BuildRuntime
+	cfg      Config
+	inFlight func() []string // build ids of this worker's jobs, which may not have a container yet
+
+	// freeSpace returns the bytes available on the filesystem of path; tests replace it
+	freeSpace func(path string) (uint64, error)
+	now       func() time.Time
+}
+
+func newJanitor(rt BuildRuntime, cfg Config, inFlight func() []string) *janitor {
+	return &janitor{rt: rt, cfg: cfg, inFlight: inFlight, freeSpace: diskFree, now: time.Now}
+}
+
+// run collects garbage every gc.interval_seconds until ctx is done.
+func (j *janitor) run(ctx context.Context) {
+	ticker := time.NewTicker(time.Duration(j.cfg.GC.IntervalSeconds) * time.Second)
+	defer ticker.Stop()
+	for {
+		j.collect(ctx)
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// collect runs one round of garbage collection, unless another worker on the host is.
+func (j *janitor) collect(ctx context.Context) {
+	unlock, ok := tryLock(filepath.Join(j.cfg.BuildOutputDir, ".gc.lock"))
+	if !ok {
+		return
+	}
+	defer unlock()
+
+	retention := time.Duration(j.cfg.GC.ContainerRetentionHours) * time.Hour
+	if n, err := j.rt.PruneContainers(ctx, retention); err != nil {
+		log.Printf("GC: failed to prune build containers: %v", err)
+	} else if n > 0 {
+		log.Printf("GC: removed %d exited build containers", n)
+	}
+
+	outputs, err := j.finishedOutputs(ctx)
+	if err != nil {
+		log.Printf("GC: %v", err)
+		return
+	}
+	cutoff := j.now().Add(-time.Duration(j.cfg.GC.OutputRetentionHours) * time.Hour)
+	var kept []output
+	for _, o := range outputs {
+		if !o.modTime.Before(cutoff) || !j.removeOutput(o.path) {
+			kept = append(kept, o)
+		}
+	}
+
+	minFree := uint64(j.cfg.GC.MinFreeDiskMB) * MB
+	free, err := j.freeSpace(j.cfg.BuildOutputDir)
+	if err != nil {
+		log.Printf("GC: failed to read free disk space: %v", err)
+		return
+	}
+	if free >= minFree {
+		return
+	}
+	log.Printf("GC: %s free in %s, below %s; removing builder images and the oldest outputs",
+		formatBytes(int64(free)), j.cfg.BuildOutputDir, formatBytes(int64(minFree)))
+	if reclaimed, err := j.rt.PruneImages(ctx); err != nil {
+		log.Printf("GC: failed to prune builder images: %v", err)
+	} else if reclaimed > 0 {
+		log.Printf("GC: removed unused builder images (%s)", formatBytes(int64(reclaimed)))
+	}
+	for _, o := range kept {
+		if free, err = j.freeSpace(j.cfg.BuildOutputDir); err != nil || free >= minFree {
+			break
+		}
+		j.removeOutput(o.path)
+	}
+}
+
+// output is a job output directory, or a stray artifact, in build_output_dir.
+type output struct {
+	path    string
+	modTime time.Time
+}
+
+// finishedOutputs returns the entries of build_output_dir that no running build uses,
+// oldest first.
+func (j *janitor) finishedOutputs(ctx context.Context) ([]output, error) {
+	active := make(map[string]bool)
+	for _, id := range j.inFlight() {
+		active[id] = true
+	}
+	containers, err := j.rt.List(ctx)
+	if err != nil {
+		return nil, err
+	}
+	for _, c := range containers {
+		if c.Running || c.StartedAt.IsZero() {
+			active[c.Labels["build_id"]] = true
+		}
+	}
+
+	entries, err := os.ReadDir(j.cfg.BuildOutputDir)
+	if err != nil {
+		return nil, err
+	}
+	var outputs []output
+	for _, e := range entries {
+		// Dot files are the worker's own (worker ids, the lock file)
+		if strings.HasPrefix(e.Name(), ".") || active[e.Name()] {
+			continue
+		}
+		info, err := e.Info()
+		if err != nil {
+			continue
+		}
+		outputs = append(outputs, output{path: filepath.Join(j.cfg.BuildOutputDir, e.Name()), modTime: info.ModTime()})
+	}
+	sort.Slice(outputs, func(a, b int) bool { return outputs[a].modTime.Before(outputs[b].modTime) })
+	return outputs, nil
+}
+
+// removeOutput removes an output dir, unless a build on any worker of the host holds its
+// lock. Returns whether it was removed.
+func (j *janitor) removeOutput(path string) bool {
+	lockPath := outputLockPath(filepath.Dir(path), filepath.Base(path))
+	unlock, ok := tryLock(lockPath)
+	if !ok {
+		return false
+	}
+	defer unlock()
+	if err := os.RemoveAll(path); err != nil {
+		log.Printf("GC: failed to remove %s: %v", path, err)
+		return false
+	}
+	_ = os.Remove(lockPath)
+	log.Printf("GC: removed %s", path)
+	return true
+}
+
+// outputLockPath returns the lock file of a build's output dir. Dot files are skipped by the janitor.
+func outputLockPath(outputDir, buildID string) string {
+	return filepath.Join(outputDir, "."+buildID+".lock")
+}
+
+// lockOutput locks the build's output dir for as long as the build runs, waiting if a janitor
+// is removing it. unlock also removes the lock file.
+func lockOutput(outputDir, buildID string) (unlock func(), err error) {
+	if err := os.MkdirAll(outputDir, 0755); err != nil {
+		return nil, err
+	}
+	path := outputLockPath(outputDir, buildID)
+	f, err := lockFile(path, syscall.LOCK_EX)
+	if err != nil {
+		return nil, fmt.Errorf("lock output dir: %w", err)
+	}
+	return func() {
+		_ = os.Remove(path)
+		_ = syscall.Flock(int(f.Fd()), syscall.LOCK_UN)
+		f.Close()
+	}, nil
+}
+
+// tryLock takes an exclusive lock on the file at path without waiting.
+// ok is false if another process holds it.
+func tryLock(path string) (unlock func(), ok bool) {
+	f, err := lockFile(path, syscall.LOCK_EX|syscall.LOCK_NB)
+	if err != nil {
+		if !errors.Is(err, syscall.EWOULDBLOCK) {
+			log.Printf("GC: failed to lock %s: %v", path, err)
+		}
+		return nil, false
+	}
+	return func() {
+		_ = syscall.Flock(int(f.Fd()), syscall.LOCK_UN)
+		f.Close()
+	}, true
+}
+
+// lockFile opens the file at path, creating it if needed, and flocks it with how. Lock files
+// are removed while locked, so if the file was replaced by the time the lock is taken, the
+// new one is locked instead.
+func lockFile(path string, how int) (*os.File, error) {
+	for {
+		f, err := os.OpenFile(path, os.O_CREATE|os.O_RDWR, 0644)
+		if err != nil {
+			return nil, err
+		}
+		if err := syscall.Flock(int(f.Fd()), how); err != nil {
+			f.Close()
+			return nil, err
+		}
+		locked, err := f.Stat()
+		if err != nil {
+			f.Close()
+			return nil, err
+		}
+		if current, err := os.Stat(path); err == nil && os.SameFile(locked, current) {
+			return f, nil
+		}
+		_ = syscall.Flock(int(f.Fd()), syscall.LOCK_UN)
+		f.Close()
+	}
+}
+
+// diskFree returns the bytes available to unprivileged users on the filesystem of path.
+func diskFree(path string) (uint64, error) {
+	var st syscall.Statfs_t
+	if err := syscall.Statfs(path, &st); err != nil {
+		return 0, err
+	}
+	return st.Bavail * uint64(st.Bsize), nil
+}
@@ -0,0 +1,160 @@
+package main
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func newTestJanitor(t *testing.T, rt BuildRuntime, inFlight ...string) *janitor {
+	t.Helper()
+	var cfg Config
+	cfg.BuildOutputDir = t.TempDir()
+	cfg.GC.ContainerRetentionHours = 24
+	cfg.GC.OutputRetentionHours = 24
+	cfg.GC.MinFreeDiskMB = 1024
+	j := newJanitor(rt, cfg, func() []string { return inFlight })
+	j.freeSpace = func(string) (uint64, error) { return 10 * GB, nil }
+	return j
+}
+
+// addOutput creates a job output dir last modified age ago.
+func addOutput(t *testing.T, j *janitor, name string, age time.Duration) string {
+	t.Helper()
+	dir := filepath.Join(j.cfg.BuildOutputDir, name)
+	if err := os.MkdirAll(dir, 0777); err != nil {
+		t.Fatal(err)
+	}
+	modTime := time.Now().Add(-age)
+	if err := os.Chtimes(dir, modTime, modTime); err != nil {
+		t.Fatal(err)
+	}
+	return dir
+}
+
+func exists(path string) bool {
+	_, err := os.Stat(path)
+	return err == nil
+}
+
+func TestJanitorRemovesFinishedOutputs(t *testing.T) {
+	rt := newFakeRuntime(fakeRun{Containers: []Container{
+		buildContainer("c1", "running", "worker-1", time.Now().Add(-48*time.Hour)),
+	}})
+	j := newTestJanitor(t, rt, "claimed")
+	old := addOutput(t, j, "old", 48*time.Hour)
+	recent := addOutput(t, j, "recent", time.Hour)
+	running := addOutput(t, j, "running", 48*time.Hour)
+	claimed := addOutput(t, j, "claimed", 48*time.Hour)
+	os.WriteFile(filepath.Join(j.cfg.BuildOutputDir, ".worker-id-host"), []byte("host-1"), 0644)
+
+	j.collect(context.Background())
+
+	if exists(old) {
+		t.Errorf("output of a finished build past retention was kept")
+	}
+	for _, dir := range []string{recent, running, claimed} {
+		if !exists(dir) {
+			t.Errorf("%s was removed", filepath.Base(dir))
+		}
+	}
+	if !exists(filepath.Join(j.cfg.BuildOutputDir, ".worker-id-host")) {
+		t.Errorf("worker id file was removed")
+	}
+	if rt.prunedContainers != 1 || rt.prunedImages != 0 {
+		t.Errorf("pruned containers %d times and images %d times, want containers only", rt.prunedContainers, rt.prunedImages)
+	}
+}
+
+func TestJanitorFreesDiskSpace(t *testing.T) {
+	rt := newFakeRuntime(fakeRun{})
+	j := newTestJanitor(t, rt)
+	expired := addOutput(t, j, "expired", 48*time.Hour)
+	oldest := addOutput(t, j, "oldest", 5*time.Hour)
+	running := addOutput(t, j, "running", 4*time.Hour)
+	older := addOutput(t, j, "older", 3*time.Hour)
+	newer := addOutput(t, j, "newer", 2*time.Hour)
+	newest := addOutput(t, j, "newest", time.Hour)
+	// A build on another worker of the host is still using its dir
+	unlock, err := lockOutput(j.cfg.BuildOutputDir, "running")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer unlock()
+
+	// Every output removed within retention frees 512 MB, starting from 256 MB free
+	j.freeSpace = func(string) (uint64, error) {
+		free := uint64(256 * MB)
+		for _, dir := range []string{oldest, running, older, newer, newest} {
+			if !exists(dir) {
+				free += 512 * MB
+			}
+		}
+		return free, nil
+	}
+
+	j.collect(context.Background())
+
+	if rt.prunedImages != 1 {
+		t.Errorf("builder images were not pruned")
+	}
+	for _, dir := range []string{expired, oldest, older} {
+		if exists(dir) {
+			t.Errorf("%s was kept, want the oldest unlocked outputs removed", filepath.Base(dir))
+		}
+	}
+	for _, dir := range []string{running, newer, newest} {
+		if !exists(dir) {
+			t.Errorf("%s was removed, want it kept once there was enough free space", filepath.Base(dir))
+		}
+	}
+}
+
+func TestJanitorKeepsLockedOutputs(t *testing.T) {
+	rt := newFakeRuntime(fakeRun{})
+	j := newTestJanitor(t, rt)
+	// Retried on another worker of the host, reusing the dir of its first attempt
+	retried := addOutput(t, j, "retried", 48*time.Hour)
+	unlock, err := lockOutput(j.cfg.BuildOutputDir, "retried")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	j.collect(context.Background())
+	if !exists(retried) {
+		t.Fatalf("output of a running build was removed")
+	}
+
+	unlock()
+	if exists(outputLockPath(j.cfg.BuildOutputDir, "retried")) {
+		t.Errorf("lock file was left behind")
+	}
+	j.collect(context.Background())
+	if exists(retried) {
+		t.Errorf("output was kept once the build was over")
+	}
+}
+
+func TestJanitorRunsOncePerHost(t *testing.T) {
+	rt := newFakeRuntime(fakeRun{})
+	j := newTestJanitor(t, rt)
+	old := addOutput(t, j, "old", 48*time.Hour)
+
+	// Another worker on the host holds the lock
+	unlock, ok := tryLock(filepath.Join(j.cfg.BuildOutputDir, ".gc.lock"))
+	if !ok {
+		t.Fatal("failed to take the lock")
+	}
+	j.collect(context.Background())
+	if !exists(old) || rt.prunedContainers != 0 {
+		t.Errorf("collected while another worker held the lock")
+	}
+
+	unlock()
+	j.collect(context.Background())
+	if exists(old) {
+		t.Errorf("did not collect once the lock was released")
+	}
+}
@@ -0,0 +1,279 @@
+package jobqueue
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// eventsWaitSeconds is how long one long-poll for wakeups waits on the API.
+const eventsWaitSeconds = 25
+
+// HTTP is a Queue served by the API's build-jobs endpoints, for workers without database access.
+// Wakeups are delivered by long-polling the API.
+type HTTP struct {
+	baseURL string
+	token   func() (string, error)
+	client  *http.Client
+	events  chan Event
+	stop    context.CancelFunc
+}
+
+// NewHTTP creates a Queue on the API at baseURL (e.g. https://api.example.com/build-jobs),
+// authenticating with the bearer tokens returned by token, and starts polling for wakeups.
+func NewHTTP(baseURL string, token func() (string, error)) *HTTP {
+	ctx, stop := context.WithCancel(context.Background())
+	q := &HTTP{
+		baseURL: strings.TrimSuffix(baseURL, "/"),
+		token:   token,
+		client:  &http.Client{Timeout: (eventsWaitSeconds + 15) * time.Second},
+		events:  make(chan Event, 32),
+		stop:    stop,
+	}
+	go q.poll(ctx)
+	return q
+}
+
+type httpJob struct {
+	ID              string          `json:"id"`
+	Payload         json.RawMessage `json:"payload"`
+	Attempt         int             `json:"attempt"`
+	CancelRequested bool            `json:"cancel_requested"`
+	Superseded      bool            `json:"superseded"`
+}
+
+func (j httpJob) job() Job {
+	return Job{ID: j.ID, Payload: string(j.Payload), Attempt: j.Attempt, CancelRequested: j.CancelRequested, Superseded: j.Superseded}
+}
+
+type httpEvent struct {
+	Type  string `json:"type"`
+	JobID string `json:"job_id"`
+}
+
+// do sends a request to the API and decodes a JSON response into out, if given.
+// Returns the response status code. A 409 (the job is not leased to the worker) is an error.
+func (q *HTTP) do(ctx context.Context, method string, path string, body any, out any) (int, error) {
+	var reqBody io.Reader
+	if body != nil {
+		data, err := json.Marshal(body)
+		if err != nil {
+			return 0, err
+		}
+		reqBody = bytes.NewReader(data)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, method, q.baseURL+path, reqBody)
+	if err != nil {
+		return 0, err
+	}
+	token, err := q.token()
+	if err != nil {
+		return 0, fmt.Errorf("get access token: %w", err)
+	}
+	req.Header.Set("Authorization", "Bearer "+token)
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "spa-build-worker")
+
+	resp, err := q.client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusNoContent {
+		return resp.StatusCode, nil
+	}
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		respBody, _ := io.ReadAll(resp.Body)
+		return resp.StatusCode, fmt.Errorf("%s %s failed: %d %s", method, path, resp.StatusCode, string(respBody))
+	}
+	if out != nil {
+		if err := json.NewDecoder(resp.Body).Decode(out); err != nil {
+			return resp.StatusCode, fmt.Errorf("decode %s response: %w", path, err)
+		}
+	}
+	return resp.StatusCode, nil
+}
+
+// poll long-polls the API for wakeups until stopped. After an error it waits briefly and
+// reports a possible job, since wakeups may have been missed meanwhile.
+func (q *HTTP) poll(ctx context.Context) {
+	for ctx.Err() == nil {
+		var events []httpEvent
+		_, err := q.do(ctx, http.MethodGet, fmt.Sprintf("/events?timeoutSeconds=%d", eventsWaitSeconds), nil, &events)
+		if err != nil {
+			if ctx.Err() != nil {
+				return
+			}
+			log.Printf("Failed to poll for build jobs: %v", err)
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(5 * time.Second):
+			}
+			events = []httpEvent{{Type: "available"}}
+		}
+
+		for _, e := range events {
+			ev := Event{Type: JobAvailable}
+			switch e.Type {
+			case "cancelled":
+				ev = Event{Type: JobCancelled, JobID: e.JobID}
+			case "superseded":
+				ev = Event{Type: JobSuperseded, JobID: e.JobID}
+			}
+			select {
+			case q.events <- ev:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}
+}
+
+// Claim leases the next runnable job to the worker.
+func (q *HTTP) Claim(ctx context.Context, w Worker) (*Job, error) {
+	var claimed httpJob
+	status, err := q.do(ctx, http.MethodPost, "/claim", map[string]any{
+		"worker_id":     w.ID,
+		"labels":        w.Labels,
+		"lease_seconds": int(w.Lease.Seconds()),
+		"budget":        w.Budget,
+	}, &claimed)
+	if err != nil || status == http.StatusNoContent {
+		return nil, err
+	}
+	job := claimed.job()
+	return &job, nil
+}
+
+// Resume renews the lease on a job that is still claimed by the worker.
+func (q *HTTP) Resume(ctx context.Context, w Worker, jobID string) (*Job, error) {
+	var resumed httpJob
+	status, err := q.do(ctx, http.MethodPost, "/"+jobID+"/resume", map[string]any{
+		"worker_id":     w.ID,
+		"lease_seconds": int(w.Lease.Seconds()),
+	}, &resumed)
+	if err != nil || status == http.StatusNoContent {
+		return nil, err
+	}
+	job := resumed.job()
+	return &job, nil
+}
+
+// Ack records the terminal outcome of a job claimed by the worker.
+func (q *HTTP) Ack(ctx context.Context, w Worker, job *Job, result Result) error {
+	body := map[string]any{
+		"worker_id":        w.ID,
+		"status":           result.Status,
+		"exit_code":        result.ExitCode,
+		"failure_reason":   result.FailureReason,
+		"billable_seconds": result.BillableSeconds,
+	}
+	if result.ArtifactId != "" {
+		body["artifact_id"] = result.ArtifactId
+	}
+	_, err := q.do(ctx, http.MethodPost, "/"+job.ID+"/ack", body, nil)
+	return err
+}
+
+// UsedSeconds asks the API for the billable seconds the tenant's jobs recorded since the given time.
+func (q *HTTP) UsedSeconds(ctx context.Context, tenant string, since time.Time) (int64, error) {
+	var out struct {
+		UsedSeconds int64 `json:"used_seconds"`
+	}
+	path := "/usage?tenant=" + url.QueryEscape(tenant) + "&since=" + url.QueryEscape(since.UTC().Format(time.RFC3339))
+	if _, err := q.do(ctx, http.MethodGet, path, nil, &out); err != nil {
+		return 0, err
+	}
+	return out.UsedSeconds, nil
+}
+
+// Nack hands a job claimed by the worker back to the queue, runnable again after delay.
+func (q *HTTP) Nack(ctx context.Context, w Worker, job *Job, delay time.Duration, reason string) error {
+	_, err := q.do(ctx, http.MethodPost, "/"+job.ID+"/nack", map[string]any{
+		"worker_id":     w.ID,
+		"delay_seconds": delay.Seconds(),
+		"reason":        reason,
+	}, nil)
+	return err
+}
+
+// Requeue hands a job claimed by the worker back to the queue without counting the attempt.
+func (q *HTTP) Requeue(ctx context.Context, w Worker, job *Job, reason string) error {
+	_, err := q.do(ctx, http.MethodPost, "/"+job.ID+"/requeue", map[string]any{
+		"worker_id": w.ID,
+		"reason":    reason,
+	}, nil)
+	return err
+}
+
+// ExtendLease extends the lease on a job claimed by the worker.
+func (q *HTTP) ExtendLease(ctx context.Context, w Worker, job *Job) (LeaseState, error) {
+	var state struct {
+		Held            bool `json:"held"`
+		CancelRequested bool `json:"cancel_requested"`
+		Superseded      bool `json:"superseded"`
+	}
+	_, err := q.do(ctx, http.MethodPost, "/"+job.ID+"/lease", map[string]any{
+		"worker_id":     w.ID,
+		"lease_seconds": int(w.Lease.Seconds()),
+	}, &state)
+	if err != nil {
+		return LeaseState{}, err
+	}
+	return LeaseState(state), nil
+}
+
+// NextDue returns when the earliest delayed pending job becomes runnable.
+func (q *HTTP) NextDue(ctx context.Context) (time.Time, bool, error) {
+	var resp struct {
+		Due *time.Time `json:"due"`
+	}
+	if _, err := q.do(ctx, http.MethodGet, "/next-due", nil, &resp); err != nil {
+		return time.Time{}, false, err
+	}
+	if resp.Due == nil {
+		return time.Time{}, false, nil
+	}
+	return *resp.Due, true, nil
+}
+
+// SupersedeOlder marks pending builds of the same app and branch as superseded by the newest queued one.
+func (q *HTTP) SupersedeOlder(ctx context.Context, job *Job) ([]Job, error) {
+	var superseded []httpJob
+	if _, err := q.do(ctx, http.MethodPost, "/"+job.ID+"/supersede-older", nil, &superseded); err != nil {
+		return nil, err
+	}
+	jobs := make([]Job, 0, len(superseded))
+	for _, j := range superseded {
+		jobs = append(jobs, j.job())
+	}
+	return jobs, nil
+}
+
+// SupersedeRunning requests cancellation of older running builds of the same app and branch.
+func (q *HTTP) SupersedeRunning(ctx context.Context, job *Job) ([]string, error) {
+	var ids []string
+	_, err := q.do(ctx, http.MethodPost, "/"+job.ID+"/supersede-running", nil, &ids)
+	return ids, err
+}
+
+// Subscribe returns the channel wakeups are delivered on.
+func (q *HTTP) Subscribe() <-chan Event {
+	return q.events
+}
+
+// Close stops polling for wakeups.
+func (q *HTTP) Close() error {
+	q.stop()
+	return nil
+}
@@ -0,0 +1,151 @@
+// Package jobqueue is the queue build jobs are claimed from. The Postgres implementation
+// backs the build_queue table; the in-memory one is for tests and local development.
+package jobqueue
+
+import (
+	"context"
+	"time"
+)
+
+// Terminal job statuses recorded with Ack
+const (
+	Succeeded  = "succeeded"
+	Failed     = "failed"
+	Cancelled  = "cancelled"
+	Superseded = "superseded" // replaced by a newer build of the same app and branch
+	Dead       = "dead"       // infrastructure failure that ran out of retries
+	Rejected   = "rejected"   // payload failed signature verification
+)
+
+// Job is a build job leased to a worker.
+type Job struct {
+	ID      string
+	Payload string
+	Attempt int // 1 for the first claim, incremented on every retry or reclaim
+
+	// Cancellation was requested before the job was claimed, while its previous worker held
+	// it: that worker died or handed it back. The job is only reported cancelled, not built.
+	CancelRequested bool
+	Superseded      bool // cancellation was requested because a newer build superseded the job
+}
+
+// Result is the terminal outcome of a build job.
+type Result struct {
+	Status        string // Succeeded, Failed, Cancelled, Superseded, Dead or Rejected
+	ExitCode      *int   // nil if the build container never exited
+	FailureReason string
+	ArtifactId    string
+
+	// BillableSeconds is how long the build container ran, recorded in the build_usage
+	// ledger with the job's plan tier and outcome.
+	BillableSeconds int
+}
+
+// Worker identifies the worker a job is leased to and what it can run.
+type Worker struct {
+	ID     string
+	Labels map[string]string // jobs are only claimed if the worker has all of their required_labels
+	Lease  time.Duration     // how long a claim is valid without ExtendLease
+	Budget *Budget           // jobs are only claimed if their limits fit; nil claims any job
+}
+
+// Budget is the memory and CPU a worker has free for another job. A job's limits are
+// resolved the way the worker applies them: the plan's limit capped at the maximum, or
+// the default if the plan doesn't set one.
+type Budget struct {
+	MemoryMB   int `json:"memory_mb"`
+	CPUPercent int `json:"cpu_percent"` // 100 = 1 core
+
+	DefaultMemoryMB   int `json:"default_memory_mb"`
+	MaxMemoryMB       int `json:"max_memory_mb"`
+	DefaultCPUPercent int `json:"default_cpu_percent"`
+	MaxCPUPercent     int `json:"max_cpu_percent"`
+}
+
+// Fits reports whether a job whose plan sets the given limits (0 if unset) fits in the budget.
+func (b *Budget) Fits(memoryMB, cpuPercent int) bool {
+	return resolveLimit(memoryMB, b.DefaultMemoryMB, b.MaxMemoryMB) <= b.MemoryMB &&
+		resolveLimit(cpuPercent, b.DefaultCPUPercent, b.MaxCPUPercent) <= b.CPUPercent
+}
+
+func resolveLimit(plan, def, maximum int) int {
+	if plan <= 0 {
+		return def
+	}
+	return min(plan, maximum)
+}
+
+// LeaseState is the state of a job's lease after ExtendLease.
+type LeaseState struct {
+	Held            bool // false if the job is no longer leased to this worker
+	CancelRequested bool
+	Superseded      bool // cancellation was requested because a newer build superseded the job
+}
+
+// EventType is the kind of wakeup delivered by Subscribe.
+type EventType int
+
+const (
+	JobAvailable  EventType = iota // a job may be ready to claim
+	JobCancelled                   // cancellation of a running job was requested
+	JobSuperseded                  // a running job was superseded by a newer build
+)
+
+// Event is a wakeup delivered by Subscribe. JobID is set for JobCancelled and JobSuperseded.
+type Event struct {
+	Type  EventType
+	JobID string
+}
+
+// Queue is the build job queue. Jobs are leased to one worker at a time; a job whose lease
+// expires without ExtendLease (the worker died) can be claimed again by another worker.
+type Queue interface {
+	// Claim leases the next runnable job to the worker, or returns nil if there is none.
+	// A job whose lease expired is claimed again with its attempt incremented, even past the
+	// worker's max attempts, so the worker dead-letters it and reports its final status.
+	// Higher priority jobs go first; within a priority, the tenant with the fewest running
+	// builds goes first, and tenants at the max_concurrent_builds of their plan are skipped.
+	Claim(ctx context.Context, w Worker) (*Job, error)
+
+	// Resume renews the lease on a job that is still claimed by the worker, for a worker that
+	// restarted while the job's build was running. Returns nil if the job is no longer its.
+	Resume(ctx context.Context, w Worker, jobID string) (*Job, error)
+
+	// Ack records the terminal outcome of a job so it is never claimed again, and what it
+	// used in the build_usage ledger.
+	Ack(ctx context.Context, w Worker, job *Job, result Result) error
+
+	// UsedSeconds returns the billable build seconds the tenant's jobs recorded since the
+	// given time.
+	UsedSeconds(ctx context.Context, tenant string, since time.Time) (int64, error)
+
+	// Nack hands a job back to the queue, runnable again after delay. A job whose
+	// cancellation was requested is runnable straight away, to be claimed and reported cancelled.
+	Nack(ctx context.Context, w Worker, job *Job, delay time.Duration, reason string) error
+
+	// Requeue hands a job interrupted by its worker shutting down back to the queue, runnable
+	// straight away. The interrupted attempt doesn't count towards the job's max attempts.
+	Requeue(ctx context.Context, w Worker, job *Job, reason string) error
+
+	// ExtendLease renews the lease on a job and reports whether its cancellation was requested.
+	ExtendLease(ctx context.Context, w Worker, job *Job) (LeaseState, error)
+
+	// NextDue returns when the earliest delayed job (scheduled to run later or backing off
+	// after a failure) becomes runnable. ok is false if there are none.
+	NextDue(ctx context.Context) (due time.Time, ok bool, err error)
+
+	// SupersedeOlder marks queued jobs of the same app and branch as superseded by the newest
+	// queued one. The claimed job itself is superseded too if a newer build is already queued.
+	// Returns the jobs that were superseded.
+	SupersedeOlder(ctx context.Context, job *Job) ([]Job, error)
+
+	// SupersedeRunning requests cancellation of older running jobs of the same app and branch.
+	// Returns the ids of the jobs whose cancellation was requested.
+	SupersedeRunning(ctx context.Context, job *Job) ([]string, error)
+
+	// Subscribe returns the channel wakeups are delivered on. Events can be missed,
+	// so consumers should still poll Claim and ExtendLease periodically.
+	Subscribe() <-chan Event
+
+	Close() error
+}
@@ -0,0 +1,410 @@
+package jobqueue
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Memory is an in-process Queue with the same scheduling rules as Postgres, for tests and
+// running the worker locally without a database. Jobs are added with Enqueue.
+type Memory struct {
+	mu     sync.Mutex
+	jobs   []*memoryJob // in enqueue order
+	seq    int
+	events chan Event
+
+	// now is the clock used for run_after, backoff and leases; tests replace it
+	now func() time.Time
+}
+
+// memoryJob mirrors a build_queue row.
+type memoryJob struct {
+	Job
+	routing         payloadRouting
+	seq             int // stands in for created_at
+	priority        int
+	status          string // pending, claimed or a terminal status
+	runAfter        time.Time
+	claimedBy       string
+	leaseExpiresAt  time.Time
+	cancelRequested bool
+	supersededBy    string
+	result          Result
+	finishedAt      time.Time
+	lastError       string
+}
+
+// payloadRouting is the part of a build payload the queue schedules on.
+type payloadRouting struct {
+	AppId               int               `json:"app_id"`
+	TenantId            string            `json:"tenant_id"`
+	Branch              string            `json:"branch"`
+	ArtifactsUploadPath string            `json:"artifacts_upload_path"`
+	RequiredLabels      map[string]string `json:"required_labels"`
+	Limits              *struct {
+		MemoryMB            int `json:"memory_mb"`
+		CPUPercent          int `json:"cpu_percent"`
+		MaxConcurrentBuilds int `json:"max_concurrent_builds"`
+	} `json:"limits"`
+}
+
+// app returns the app a build belongs to, falling back to the artifacts upload path
+// (/apps/{appId}/...) for payloads queued before app_id was added.
+func (p payloadRouting) app() string {
+	if p.AppId != 0 {
+		return strconv.Itoa(p.AppId)
+	}
+	parts := strings.Split(p.ArtifactsUploadPath, "/")
+	if len(parts) > 2 {
+		return parts[2]
+	}
+	return ""
+}
+
+// tenant returns the account a build is scheduled for, falling back to the app.
+func (p payloadRouting) tenant() string {
+	if p.TenantId != "" {
+		return p.TenantId
+	}
+	return p.app()
+}
+
+// fits reports whether the job's resource limits fit in the worker's budget.
+func (p payloadRouting) fits(b *Budget) bool {
+	if b == nil {
+		return true
+	}
+	if p.Limits == nil {
+		return b.Fits(0, 0)
+	}
+	return b.Fits(p.Limits.MemoryMB, p.Limits.CPUPercent)
+}
+
+func (p payloadRouting) maxConcurrentBuilds() int {
+	if p.Limits == nil {
+		return 0
+	}
+	return p.Limits.MaxConcurrentBuilds
+}
+
+// NewMemory creates an empty in-memory queue.
+func NewMemory() *Memory {
+	return &Memory{events: make(chan Event, 32), now: time.Now}
+}
+
+// Enqueue adds a job, runnable once runAfter has passed (immediately if zero).
+func (m *Memory) Enqueue(id string, payload string, priority int, runAfter time.Time) error {
+	var routing payloadRouting
+	if err := json.Unmarshal([]byte(payload), &routing); err != nil {
+		return fmt.Errorf("invalid payload for job %s: %w", id, err)
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.find(id) != nil {
+		return fmt.Errorf("job %s already queued", id)
+	}
+	m.seq++
+	m.jobs = append(m.jobs, &memoryJob{
+		Job:      Job{ID: id, Payload: payload},
+		routing:  routing,
+		seq:      m.seq,
+		priority: priority,
+		status:   "pending",
+		runAfter: runAfter,
+	})
+	m.notify(Event{Type: JobAvailable})
+	return nil
+}
+
+// Cancel requests cancellation of a job, like the API's cancel endpoint: pending jobs are
+// cancelled straight away, the worker running a claimed job is notified.
+func (m *Memory) Cancel(id string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	j := m.find(id)
+	if j == nil {
+		return fmt.Errorf("job %s not found", id)
+	}
+	switch j.status {
+	case "pending":
+		j.cancelRequested = true
+		j.status = Cancelled
+	case "claimed":
+		j.cancelRequested = true
+		m.notify(Event{Type: JobCancelled, JobID: id})
+	}
+	return nil
+}
+
+// Status returns the status of a job: pending, claimed or the terminal status it was acked with.
+func (m *Memory) Status(id string) (string, bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	j := m.find(id)
+	if j == nil {
+		return "", false
+	}
+	return j.status, true
+}
+
+func (m *Memory) find(id string) *memoryJob {
+	for _, j := range m.jobs {
+		if j.ID == id {
+			return j
+		}
+	}
+	return nil
+}
+
+// notify delivers an event without blocking; consumers poll as a fallback for dropped events.
+func (m *Memory) notify(ev Event) {
+	select {
+	case m.events <- ev:
+	default:
+	}
+}
+
+// leasedTo returns the job if it is claimed by the worker.
+func (m *Memory) leasedTo(w Worker, job *Job) *memoryJob {
+	j := m.find(job.ID)
+	if j == nil || j.status != "claimed" || j.claimedBy != w.ID {
+		return nil
+	}
+	return j
+}
+
+// Claim leases the next runnable job to the worker.
+func (m *Memory) Claim(ctx context.Context, w Worker) (*Job, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	now := m.now()
+
+	running := make(map[string]int)
+	for _, j := range m.jobs {
+		if j.status == "claimed" && !j.leaseExpiresAt.Before(now) {
+			running[j.routing.tenant()]++
+		}
+	}
+
+	var candidates []*memoryJob
+	for _, j := range m.jobs {
+		due := j.status == "pending" && !j.runAfter.After(now)
+		expired := j.status == "claimed" && j.leaseExpiresAt.Before(now)
+		if !due && !expired || !hasLabels(w.Labels, j.routing.RequiredLabels) || !j.routing.fits(w.Budget) {
+			continue
+		}
+		if limit := j.routing.maxConcurrentBuilds(); limit > 0 && running[j.routing.tenant()] >= limit {
+			continue
+		}
+		candidates = append(candidates, j)
+	}
+	if len(candidates) == 0 {
+		return nil, nil
+	}
+
+	sort.SliceStable(candidates, func(a, b int) bool {
+		ja, jb := candidates[a], candidates[b]
+		if ja.priority != jb.priority {
+			return ja.priority > jb.priority
+		}
+		if ra, rb := running[ja.routing.tenant()], running[jb.routing.tenant()]; ra != rb {
+			return ra < rb
+		}
+		return ja.seq < jb.seq
+	})
+
+	j := candidates[0]
+	j.status = "claimed"
+	j.claimedBy = w.ID
+	j.leaseExpiresAt = now.Add(w.Lease)
+	j.Attempt++
+	job := j.Job
+	job.CancelRequested = j.cancelRequested
+	job.Superseded = j.supersededBy != ""
+	return &job, nil
+}
+
+// Resume renews the lease on a job that is still claimed by the worker.
+func (m *Memory) Resume(ctx context.Context, w Worker, jobID string) (*Job, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	j := m.leasedTo(w, &Job{ID: jobID})
+	if j == nil {
+		return nil, nil
+	}
+	j.leaseExpiresAt = m.now().Add(w.Lease)
+	job := j.Job
+	return &job, nil
+}
+
+// hasLabels reports whether the worker has all of the required labels.
+func hasLabels(labels, required map[string]string) bool {
+	for k, v := range required {
+		if labels[k] != v {
+			return false
+		}
+	}
+	return true
+}
+
+// Ack records the terminal outcome of a job claimed by the worker.
+func (m *Memory) Ack(ctx context.Context, w Worker, job *Job, result Result) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if j := m.leasedTo(w, job); j != nil {
+		j.status = result.Status
+		j.result = result
+		j.finishedAt = m.now()
+		if result.Status == Dead {
+			j.lastError = result.FailureReason
+		}
+	}
+	return nil
+}
+
+// UsedSeconds returns the billable seconds of the tenant's jobs acked since the given time.
+func (m *Memory) UsedSeconds(ctx context.Context, tenant string, since time.Time) (int64, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	var used int64
+	for _, j := range m.jobs {
+		if !j.finishedAt.IsZero() && !j.finishedAt.Before(since) && j.routing.tenant() == tenant {
+			used += int64(j.result.BillableSeconds)
+		}
+	}
+	return used, nil
+}
+
+// Nack hands a job claimed by the worker back to the queue, runnable again after delay.
+func (m *Memory) Nack(ctx context.Context, w Worker, job *Job, delay time.Duration, reason string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if j := m.leasedTo(w, job); j != nil {
+		j.status = "pending"
+		j.claimedBy = ""
+		j.runAfter = m.now().Add(delay)
+		if j.cancelRequested {
+			j.runAfter = m.now()
+		}
+		j.lastError = reason
+		m.notify(Event{Type: JobAvailable})
+	}
+	return nil
+}
+
+// Requeue hands a job claimed by the worker back to the queue without counting the attempt.
+func (m *Memory) Requeue(ctx context.Context, w Worker, job *Job, reason string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if j := m.leasedTo(w, job); j != nil {
+		j.status = "pending"
+		j.claimedBy = ""
+		j.runAfter = m.now()
+		j.Attempt = max(j.Attempt-1, 0)
+		j.lastError = reason
+		m.notify(Event{Type: JobAvailable})
+	}
+	return nil
+}
+
+// ExtendLease extends the lease on a job claimed by the worker.
+func (m *Memory) ExtendLease(ctx context.Context, w Worker, job *Job) (LeaseState, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	j := m.leasedTo(w, job)
+	if j == nil {
+		return LeaseState{}, nil
+	}
+	j.leaseExpiresAt = m.now().Add(w.Lease)
+	return LeaseState{Held: true, CancelRequested: j.cancelRequested, Superseded: j.supersededBy != ""}, nil
+}
+
+// NextDue returns when the earliest delayed pending job becomes runnable.
+func (m *Memory) NextDue(ctx context.Context) (time.Time, bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	now := m.now()
+	var due time.Time
+	ok := false
+	for _, j := range m.jobs {
+		if j.status != "pending" || j.cancelRequested || !j.runAfter.After(now) {
+			continue
+		}
+		if !ok || j.runAfter.Before(due) {
+			due, ok = j.runAfter, true
+		}
+	}
+	return due, ok, nil
+}
+
+// sameBuild reports whether two jobs build the same app and branch.
+func sameBuild(a, b *memoryJob) bool {
+	return a.routing.app() == b.routing.app() && a.routing.Branch == b.routing.Branch
+}
+
+// SupersedeOlder marks pending builds of the same app and branch as superseded by the newest queued one.
+func (m *Memory) SupersedeOlder(ctx context.Context, job *Job) ([]Job, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	me := m.find(job.ID)
+	if me == nil {
+		return nil, nil
+	}
+
+	newest := me
+	for _, j := range m.jobs {
+		if j.status == "pending" && sameBuild(j, me) && j.seq > newest.seq {
+			newest = j
+		}
+	}
+
+	var superseded []Job
+	for _, j := range m.jobs {
+		if !sameBuild(j, me) || j.seq >= newest.seq || (j.status != "pending" && j != me) {
+			continue
+		}
+		j.status = Superseded
+		j.supersededBy = newest.ID
+		superseded = append(superseded, j.Job)
+	}
+	return superseded, nil
+}
+
+// SupersedeRunning requests cancellation of older running builds of the same app and branch.
+func (m *Memory) SupersedeRunning(ctx context.Context, job *Job) ([]string, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	me := m.find(job.ID)
+	if me == nil {
+		return nil, nil
+	}
+
+	var ids []string
+	for _, j := range m.jobs {
+		if j == me || j.status != "claimed" || j.cancelRequested || !sameBuild(j, me) || j.seq > me.seq {
+			continue
+		}
+		j.cancelRequested = true
+		j.supersededBy = me.ID
+		ids = append(ids, j.ID)
+		m.notify(Event{Type: JobSuperseded, JobID: j.ID})
+	}
+	return ids, nil
+}
+
+// Subscribe returns the channel wakeups are delivered on.
+func (m *Memory) Subscribe() <-chan Event {
+	return m.events
+}
+
+// Close is a no-op; the queue lives as long as the process.
+func (m *Memory) Close() error {
+	return nil
+}
@@ -0,0 +1,352 @@
+package jobqueue
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+)
+
+// fakeClock is a settable clock for the in-memory queue.
+type fakeClock struct{ t time.Time }
+
+func (c *fakeClock) now() time.Time          { return c.t }
+func (c *fakeClock) advance(d time.Duration) { c.t = c.t.Add(d) }
+
+func newTestQueue() (*Memory, *fakeClock) {
+	clock := &fakeClock{t: time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)}
+	q := NewMemory()
+	q.now = clock.now
+	return q, clock
+}
+
+func payload(app int, tenant, branch string, maxConcurrent int) string {
+	return fmt.Sprintf(`{"app_id":%d,"tenant_id":%q,"branch":%q,"limits":{"max_concurrent_builds":%d}}`,
+		app, tenant, branch, maxConcurrent)
+}
+
+func mustEnqueue(t *testing.T, q *Memory, id, payload string, priority int, runAfter time.Time) {
+	t.Helper()
+	if err := q.Enqueue(id, payload, priority, runAfter); err != nil {
+		t.Fatalf("Enqueue(%s): %v", id, err)
+	}
+}
+
+func mustClaim(t *testing.T, q *Memory, w Worker) *Job {
+	t.Helper()
+	job, err := q.Claim(context.Background(), w)
+	if err != nil {
+		t.Fatalf("Claim: %v", err)
+	}
+	return job
+}
+
+func claimID(t *testing.T, q *Memory, w Worker) string {
+	t.Helper()
+	if job := mustClaim(t, q, w); job != nil {
+		return job.ID
+	}
+	return ""
+}
+
+var worker = Worker{ID: "w1", Lease: time.Minute}
+
+func TestClaimOrder(t *testing.T) {
+	q, _ := newTestQueue()
+	mustEnqueue(t, q, "a1", payload(1, "alice", "main", 0), 0, time.Time{})
+	mustEnqueue(t, q, "a2", payload(1, "alice", "dev", 0), 0, time.Time{})
+	mustEnqueue(t, q, "b1", payload(2, "bob", "main", 0), 0, time.Time{})
+	mustEnqueue(t, q, "c1", payload(3, "carol", "main", 0), 10, time.Time{})
+
+	// Priority first, then the tenant with the fewest running builds, then oldest
+	for _, want := range []string{"c1", "a1", "b1", "a2", ""} {
+		if got := claimID(t, q, worker); got != want {
+			t.Fatalf("claimed %q, want %q", got, want)
+		}
+	}
+}
+
+func TestClaimTenantConcurrencyCap(t *testing.T) {
+	q, _ := newTestQueue()
+	mustEnqueue(t, q, "a1", payload(1, "alice", "main", 1), 0, time.Time{})
+	mustEnqueue(t, q, "a2", payload(1, "alice", "dev", 1), 0, time.Time{})
+
+	a1 := mustClaim(t, q, worker)
+	if got := claimID(t, q, worker); got != "" {
+		t.Fatalf("claimed %q while tenant is at its cap", got)
+	}
+	if err := q.Ack(context.Background(), worker, a1, Result{Status: Succeeded}); err != nil {
+		t.Fatal(err)
+	}
+	if got := claimID(t, q, worker); got != "a2" {
+		t.Fatalf("claimed %q after cap freed, want a2", got)
+	}
+}
+
+func TestClaimRequiredLabels(t *testing.T) {
+	q, _ := newTestQueue()
+	mustEnqueue(t, q, "gpu", `{"app_id":1,"required_labels":{"tier":"paid"}}`, 0, time.Time{})
+
+	if got := claimID(t, q, worker); got != "" {
+		t.Fatalf("unlabelled worker claimed %q", got)
+	}
+	paid := Worker{ID: "w2", Lease: time.Minute, Labels: map[string]string{"tier": "paid", "memory": "16g"}}
+	if got := claimID(t, q, paid); got != "gpu" {
+		t.Fatalf("labelled worker claimed %q, want gpu", got)
+	}
+}
+
+func TestClaimBudget(t *testing.T) {
+	q, _ := newTestQueue()
+	mustEnqueue(t, q, "big", `{"app_id":1,"limits":{"memory_mb":4096,"cpu_percent":200}}`, 10, time.Time{})
+	mustEnqueue(t, q, "capped", `{"app_id":2,"limits":{"memory_mb":16384}}`, 5, time.Time{})
+	mustEnqueue(t, q, "default", `{"app_id":3}`, 0, time.Time{})
+
+	budget := &Budget{
+		MemoryMB: 2048, CPUPercent: 400,
+		DefaultMemoryMB: 1024, MaxMemoryMB: 4096,
+		DefaultCPUPercent: 100, MaxCPUPercent: 400,
+	}
+	small := Worker{ID: "small", Lease: time.Minute, Budget: budget}
+	if id := claimID(t, q, small); id != "default" {
+		t.Fatalf("claimed %q, want the only job that fits in 2 GB", id)
+	}
+
+	// Plan limits are capped at the maximum before they are compared with the budget
+	budget.MemoryMB = 4096
+	if id := claimID(t, q, small); id != "big" {
+		t.Fatalf("claimed %q, want big", id)
+	}
+	if id := claimID(t, q, small); id != "capped" {
+		t.Fatalf("claimed %q, want capped at 4 GB", id)
+	}
+}
+
+func TestRunAfterAndNextDue(t *testing.T) {
+	q, clock := newTestQueue()
+	mustEnqueue(t, q, "later", payload(1, "alice", "main", 0), 0, clock.now().Add(time.Hour))
+
+	if got := claimID(t, q, worker); got != "" {
+		t.Fatalf("claimed %q before run_after", got)
+	}
+	due, ok, _ := q.NextDue(context.Background())
+	if !ok || !due.Equal(clock.now().Add(time.Hour)) {
+		t.Fatalf("NextDue = %v, %v", due, ok)
+	}
+	clock.advance(time.Hour)
+	if got := claimID(t, q, worker); got != "later" {
+		t.Fatalf("claimed %q once due, want later", got)
+	}
+}
+
+func TestExpiredLeaseIsReclaimed(t *testing.T) {
+	q, clock := newTestQueue()
+	mustEnqueue(t, q, "a1", payload(1, "alice", "main", 0), 0, time.Time{})
+
+	job := mustClaim(t, q, worker)
+	clock.advance(30 * time.Second)
+	if state, _ := q.ExtendLease(context.Background(), worker, job); !state.Held {
+		t.Fatal("lease lost while held")
+	}
+	clock.advance(45 * time.Second)
+	other := Worker{ID: "w2", Lease: time.Minute}
+	if got := claimID(t, q, other); got != "" {
+		t.Fatalf("reclaimed %q while the lease was renewed", got)
+	}
+
+	clock.advance(2 * time.Minute)
+	reclaimed := mustClaim(t, q, other)
+	if reclaimed == nil || reclaimed.Attempt != 2 {
+		t.Fatalf("reclaimed %+v, want attempt 2", reclaimed)
+	}
+	if state, _ := q.ExtendLease(context.Background(), worker, job); state.Held {
+		t.Fatal("original worker still holds the lease")
+	}
+}
+
+func TestResume(t *testing.T) {
+	q, clock := newTestQueue()
+	mustEnqueue(t, q, "a1", payload(1, "alice", "main", 0), 0, time.Time{})
+	mustEnqueue(t, q, "a2", payload(1, "alice", "dev", 0), 0, time.Time{})
+	mustClaim(t, q, worker)
+
+	// The worker restarted and is still within its lease
+	clock.advance(50 * time.Second)
+	job, err := q.Resume(context.Background(), worker, "a1")
+	if err != nil || job == nil || job.Attempt != 1 {
+		t.Fatalf("Resume = %+v, %v, want the claimed job", job, err)
+	}
+	clock.advance(50 * time.Second)
+	other := Worker{ID: "w2", Lease: time.Minute}
+	if got := claimID(t, q, other); got != "a2" {
+		t.Fatalf("claimed %q, want a2 while a1 is resumed", got)
+	}
+
+	if job, _ := q.Resume(context.Background(), worker, "a2"); job != nil {
+		t.Errorf("resumed a job claimed by another worker")
+	}
+}
+
+func TestUsedSeconds(t *testing.T) {
+	q, clock := newTestQueue()
+	mustEnqueue(t, q, "last-month", payload(1, "alice", "main", 0), 0, time.Time{})
+	mustEnqueue(t, q, "a1", payload(1, "alice", "main", 0), 0, time.Time{})
+	mustEnqueue(t, q, "a2", payload(2, "alice", "main", 0), 0, time.Time{})
+	mustEnqueue(t, q, "b1", payload(3, "bob", "main", 0), 0, time.Time{})
+	ack := func(billable int) {
+		t.Helper()
+		job := mustClaim(t, q, worker)
+		if err := q.Ack(context.Background(), worker, job, Result{Status: Succeeded, BillableSeconds: billable}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	ack(500)
+	clock.advance(time.Hour)
+	monthStart := clock.now()
+	ack(90)
+	ack(30)
+	ack(45)
+
+	used, err := q.UsedSeconds(context.Background(), "alice", monthStart)
+	if err != nil || used != 120 {
+		t.Errorf("UsedSeconds = %d, %v, want 120 for alice's jobs this month", used, err)
+	}
+}
+
+func TestNackRetriesAfterDelay(t *testing.T) {
+	q, clock := newTestQueue()
+	mustEnqueue(t, q, "a1", payload(1, "alice", "main", 0), 0, time.Time{})
+
+	job := mustClaim(t, q, worker)
+	if err := q.Nack(context.Background(), worker, job, 10*time.Second, "docker unavailable"); err != nil {
+		t.Fatal(err)
+	}
+	if got := claimID(t, q, worker); got != "" {
+		t.Fatalf("claimed %q during backoff", got)
+	}
+	clock.advance(10 * time.Second)
+	retried := mustClaim(t, q, worker)
+	if retried == nil || retried.Attempt != 2 {
+		t.Fatalf("retried %+v, want attempt 2", retried)
+	}
+}
+
+func TestRequeueDoesNotCountAttempt(t *testing.T) {
+	q, _ := newTestQueue()
+	mustEnqueue(t, q, "a1", payload(1, "alice", "main", 0), 0, time.Time{})
+
+	for range 3 {
+		job := mustClaim(t, q, worker)
+		if err := q.Requeue(context.Background(), worker, job, "worker shut down"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if job := mustClaim(t, q, worker); job == nil || job.Attempt != 1 {
+		t.Fatalf("claimed %+v after requeues, want attempt 1", job)
+	}
+}
+
+func TestCancel(t *testing.T) {
+	q, _ := newTestQueue()
+	mustEnqueue(t, q, "pending", payload(1, "alice", "main", 0), 0, time.Time{})
+	mustEnqueue(t, q, "running", payload(2, "bob", "main", 0), 10, time.Time{})
+	<-q.Subscribe()
+	<-q.Subscribe()
+
+	job := mustClaim(t, q, worker)
+	if err := q.Cancel("running"); err != nil {
+		t.Fatal(err)
+	}
+	if ev := <-q.Subscribe(); ev.Type != JobCancelled || ev.JobID != "running" {
+		t.Fatalf("event %+v, want cancellation of running", ev)
+	}
+	if state, _ := q.ExtendLease(context.Background(), worker, job); !state.CancelRequested || state.Superseded {
+		t.Fatalf("lease state %+v, want cancel requested", state)
+	}
+
+	if err := q.Cancel("pending"); err != nil {
+		t.Fatal(err)
+	}
+	if status, _ := q.Status("pending"); status != Cancelled {
+		t.Fatalf("pending job status %q, want cancelled", status)
+	}
+	if got := claimID(t, q, worker); got != "" {
+		t.Fatalf("claimed cancelled job %q", got)
+	}
+}
+
+func TestCancelledJobIsReclaimed(t *testing.T) {
+	q, clock := newTestQueue()
+	mustEnqueue(t, q, "crashed", payload(1, "alice", "main", 0), 0, time.Time{})
+	mustEnqueue(t, q, "requeued", payload(2, "bob", "main", 0), 0, time.Time{})
+	crashed := mustClaim(t, q, worker)
+	requeued := mustClaim(t, q, worker)
+	q.Cancel(crashed.ID)
+	q.Cancel(requeued.ID)
+
+	// A requeued job is claimable again straight away, despite the delay
+	if err := q.Nack(context.Background(), worker, requeued, time.Hour, "worker shut down"); err != nil {
+		t.Fatal(err)
+	}
+	other := Worker{ID: "w2", Lease: time.Minute}
+	if job := mustClaim(t, q, other); job == nil || job.ID != "requeued" || !job.CancelRequested {
+		t.Fatalf("claimed %+v, want requeued with its cancellation", job)
+	}
+
+	// The worker of the other died
+	clock.advance(2 * time.Minute)
+	job := mustClaim(t, q, other)
+	if job == nil || job.ID != "crashed" || !job.CancelRequested || job.Superseded {
+		t.Fatalf("claimed %+v, want crashed with its cancellation", job)
+	}
+	if err := q.Ack(context.Background(), other, job, Result{Status: Cancelled}); err != nil {
+		t.Fatal(err)
+	}
+	if status, _ := q.Status("crashed"); status != Cancelled {
+		t.Errorf("status %q, want cancelled", status)
+	}
+}
+
+func TestSupersedeOlder(t *testing.T) {
+	q, _ := newTestQueue()
+	mustEnqueue(t, q, "old", payload(1, "alice", "main", 0), 0, time.Time{})
+	mustEnqueue(t, q, "mid", payload(1, "alice", "main", 0), 0, time.Time{})
+	mustEnqueue(t, q, "new", payload(1, "alice", "main", 0), 0, time.Time{})
+	mustEnqueue(t, q, "other", payload(1, "alice", "dev", 0), 0, time.Time{})
+
+	job := mustClaim(t, q, worker)
+	superseded, err := q.SupersedeOlder(context.Background(), job)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(superseded) != 2 || superseded[0].ID != "old" || superseded[1].ID != "mid" {
+		t.Fatalf("superseded %+v, want old and mid", superseded)
+	}
+	for id, want := range map[string]string{"old": Superseded, "mid": Superseded, "new": "pending", "other": "pending"} {
+		if status, _ := q.Status(id); status != want {
+			t.Errorf("%s status %q, want %q", id, status, want)
+		}
+	}
+}
+
+func TestSupersedeRunning(t *testing.T) {
+	q, _ := newTestQueue()
+	mustEnqueue(t, q, "old", payload(1, "alice", "main", 0), 0, time.Time{})
+	mustEnqueue(t, q, "new", payload(1, "alice", "main", 0), 0, time.Time{})
+
+	old := mustClaim(t, q, worker)
+	other := Worker{ID: "w2", Lease: time.Minute}
+	newer := mustClaim(t, q, other)
+
+	ids, err := q.SupersedeRunning(context.Background(), newer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(ids) != 1 || ids[0] != "old" {
+		t.Fatalf("superseded %v, want [old]", ids)
+	}
+	if state, _ := q.ExtendLease(context.Background(), worker, old); !state.CancelRequested || !state.Superseded {
+		t.Fatalf("lease state %+v, want superseded", state)
+	}
+}
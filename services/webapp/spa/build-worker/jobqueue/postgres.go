@@ -0,0 +1,354 @@
+package jobqueue
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+// NOTIFY channels the Postgres queue listens on. Cancellation payloads are the job id.
+const (
+	channelAvailable  = "build_job_available"
+	channelCancelled  = "build_job_cancelled"
+	channelSuperseded = "build_job_superseded"
+)
+
+// tenantKeySQL is the tenant a build_queue row is scheduled for: the account, falling back
+// to the app for payloads queued before tenant_id was added.
+const tenantKeySQL = `COALESCE(%[1]s.payload->>'tenant_id', %[1]s.payload->>'app_id',
+	split_part(%[1]s.payload->>'artifacts_upload_path', '/', 3))`
+
+// buildKeySQL is the app and branch of a build_queue row, used to find builds that supersede
+// each other. Payloads queued before app_id was added fall back to the app id in the artifacts upload path.
+const buildKeySQL = `(COALESCE(%[1]s.payload->>'app_id', split_part(%[1]s.payload->>'artifacts_upload_path', '/', 3)),
+	COALESCE(%[1]s.payload->>'branch', ''))`
+
+// jobLimitSQL is a build_queue row's limit resolved like Budget.Fits: the plan's limit
+// (%[2]s in payload.limits) capped at the maximum %[3]s, or the default %[4]s if it has none.
+const jobLimitSQL = `CASE WHEN COALESCE((%[1]s.payload->'limits'->>'%[2]s')::int, 0) > 0
+	THEN LEAST((%[1]s.payload->'limits'->>'%[2]s')::int, %[3]s) ELSE %[4]s END`
+
+// claimLockKey serializes claims across the worker fleet so per-tenant concurrency
+// counts can't be raced by two workers claiming at the same time.
+const claimLockKey = "build_queue_claim"
+
+// Postgres is a Queue backed by the build_queue table, with wakeups delivered by LISTEN/NOTIFY.
+type Postgres struct {
+	db       *sql.DB
+	listener *pq.Listener
+	events   chan Event
+	done     chan struct{}
+}
+
+// NewPostgres creates a Queue on the build_queue table and starts listening for notifications.
+func NewPostgres(db *sql.DB, databaseURL string) (*Postgres, error) {
+	listener := pq.NewListener(databaseURL, 10*time.Second, time.Minute, func(ev pq.ListenerEventType, err error) {
+		if err != nil {
+			log.Printf("Listener event error: %v", err)
+		}
+	})
+	for _, channel := range []string{channelAvailable, channelCancelled, channelSuperseded} {
+		if err := listener.Listen(channel); err != nil {
+			listener.Close()
+			return nil, fmt.Errorf("LISTEN %s: %w", channel, err)
+		}
+	}
+
+	q := &Postgres{db: db, listener: listener, events: make(chan Event, 32), done: make(chan struct{})}
+	go q.forward()
+	return q, nil
+}
+
+// forward translates notifications into events until the listener is closed.
+func (q *Postgres) forward() {
+	defer close(q.events)
+	for n := range q.listener.Notify {
+		ev := Event{Type: JobAvailable} // also sent when the listener reconnected and may have missed notifications
+		if n != nil && n.Channel == channelCancelled {
+			ev = Event{Type: JobCancelled, JobID: n.Extra}
+		} else if n != nil && n.Channel == channelSuperseded {
+			ev = Event{Type: JobSuperseded, JobID: n.Extra}
+		}
+		select {
+		case q.events <- ev:
+		case <-q.done:
+			return
+		}
+	}
+}
+
+// Claim leases the next runnable build_queue row to the worker.
+// Pending jobs that are due (past run_after and any retry backoff) and claimed jobs whose
+// lease has expired (the owning worker stopped heartbeating) are both eligible. Expired jobs
+// whose cancellation was requested are claimed too, so their cancellation is reported.
+func (q *Postgres) Claim(ctx context.Context, w Worker) (*Job, error) {
+	labels, err := json.Marshal(w.Labels)
+	if err != nil {
+		return nil, err
+	}
+	if w.Labels == nil {
+		labels = []byte("{}")
+	}
+
+	// Budget parameters are NULL when the worker claims regardless of resources
+	var budget [6]any
+	if b := w.Budget; b != nil {
+		budget = [6]any{b.MemoryMB, b.MaxMemoryMB, b.DefaultMemoryMB, b.CPUPercent, b.MaxCPUPercent, b.DefaultCPUPercent}
+	}
+
+	tx, err := q.db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	// Held until commit, so the next claimer's snapshot includes this claim
+	if _, err := tx.ExecContext(ctx, "SELECT pg_advisory_xact_lock(hashtext($1))", claimLockKey); err != nil {
+		return nil, err
+	}
+
+	var job Job
+	var prevStatus, prevWorker string
+	err = tx.QueryRowContext(ctx, `
+		WITH running AS (
+			SELECT `+fmt.Sprintf(tenantKeySQL, "r")+` AS tenant, count(*) AS n
+			FROM build_queue r
+			WHERE r.status = 'claimed' AND r.lease_expires_at >= now()
+			GROUP BY 1
+		),
+		next AS (
+			SELECT c.id, c.status, c.claimed_by FROM build_queue c
+			LEFT JOIN running ON running.tenant = `+fmt.Sprintf(tenantKeySQL, "c")+`
+			WHERE ((c.status = 'pending' AND COALESCE(GREATEST(c.run_after, c.next_attempt_at), now()) <= now())
+				OR (c.status = 'claimed' AND c.lease_expires_at < now()))
+				AND COALESCE(c.payload->'required_labels', '{}'::jsonb) <@ $3::jsonb
+				AND (COALESCE((c.payload->'limits'->>'max_concurrent_builds')::int, 0) <= 0
+					OR COALESCE(running.n, 0) < (c.payload->'limits'->>'max_concurrent_builds')::int)
+				AND ($4::int IS NULL OR (`+fmt.Sprintf(jobLimitSQL, "c", "memory_mb", "$5::int", "$6::int")+` <= $4::int
+					AND `+fmt.Sprintf(jobLimitSQL, "c", "cpu_percent", "$8::int", "$9::int")+` <= $7::int))
+			ORDER BY c.priority DESC, COALESCE(running.n, 0), c.created_at
+			LIMIT 1
+			FOR UPDATE OF c SKIP LOCKED
+		)
+		UPDATE build_queue q
+		SET status = 'claimed', claimed_by = $1, claimed_at = now(),
+			heartbeat_at = now(), lease_expires_at = now() + make_interval(secs => $2),
+			reclaim_count = q.reclaim_count + CASE WHEN next.status = 'claimed' THEN 1 ELSE 0 END,
+			attempts = q.attempts + 1
+		FROM next
+		WHERE q.id = next.id
+		RETURNING q.id, q.payload::text, q.attempts, q.cancel_requested_at IS NOT NULL, q.superseded_by IS NOT NULL,
+			next.status, COALESCE(next.claimed_by, '')
+	`, append([]any{w.ID, w.Lease.Seconds(), string(labels)}, budget[:]...)...).Scan(
+		&job.ID, &job.Payload, &job.Attempt, &job.CancelRequested, &job.Superseded, &prevStatus, &prevWorker)
+
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+
+	if prevStatus == "claimed" {
+		log.Printf("Reclaimed job %s from worker %s (lease expired)", job.ID, prevWorker)
+	}
+	return &job, nil
+}
+
+// Ack records the terminal outcome onto a job claimed by the worker so its lease is never reclaimed.
+// Dead-lettered jobs also keep the failure as their last_error.
+func (q *Postgres) Ack(ctx context.Context, w Worker, job *Job, result Result) error {
+	// The usage row is only written if this worker still held the job, so it is recorded once
+	_, err := q.db.ExecContext(ctx, `
+		WITH acked AS (
+			UPDATE build_queue
+			SET status = $3, finished_at = now(), exit_code = $4,
+				failure_reason = NULLIF($5, ''), artifact_id = NULLIF($6, '')::uuid, lease_expires_at = NULL,
+				last_error = CASE WHEN $3 = 'dead' THEN NULLIF($5, '') ELSE last_error END
+			WHERE id = $1 AND claimed_by = $2 AND status = 'claimed'
+			RETURNING id, payload
+		)
+		INSERT INTO build_usage (build_id, tenant, app_id, tier, billable_seconds, outcome)
+		SELECT id, `+fmt.Sprintf(tenantKeySQL, "acked")+`,
+			COALESCE(payload->>'app_id', split_part(payload->>'artifacts_upload_path', '/', 3)),
+			payload->'limits'->>'tier', $7, $3
+		FROM acked
+		ON CONFLICT (build_id) DO NOTHING
+	`, job.ID, w.ID, result.Status, result.ExitCode, result.FailureReason, result.ArtifactId, result.BillableSeconds)
+	return err
+}
+
+// UsedSeconds sums the tenant's build_usage rows recorded since the given time.
+func (q *Postgres) UsedSeconds(ctx context.Context, tenant string, since time.Time) (int64, error) {
+	var used int64
+	err := q.db.QueryRowContext(ctx, `
+		SELECT COALESCE(sum(billable_seconds), 0) FROM build_usage WHERE tenant = $1 AND recorded_at >= $2
+	`, tenant, since).Scan(&used)
+	return used, err
+}
+
+// Nack hands a job claimed by the worker back to the queue, runnable again after delay.
+// A job whose cancellation was requested is runnable straight away.
+func (q *Postgres) Nack(ctx context.Context, w Worker, job *Job, delay time.Duration, reason string) error {
+	_, err := q.db.ExecContext(ctx, `
+		UPDATE build_queue
+		SET status = 'pending', claimed_by = NULL, claimed_at = NULL, heartbeat_at = NULL, lease_expires_at = NULL,
+			next_attempt_at = CASE WHEN cancel_requested_at IS NULL THEN now() + make_interval(secs => $3) ELSE now() END,
+			last_error = NULLIF($4, '')
+		WHERE id = $1 AND claimed_by = $2 AND status = 'claimed'
+	`, job.ID, w.ID, delay.Seconds(), reason)
+	return err
+}
+
+// Requeue hands a job claimed by the worker back to the queue without counting the attempt.
+func (q *Postgres) Requeue(ctx context.Context, w Worker, job *Job, reason string) error {
+	_, err := q.db.ExecContext(ctx, `
+		UPDATE build_queue
+		SET status = 'pending', claimed_by = NULL, claimed_at = NULL, heartbeat_at = NULL, lease_expires_at = NULL,
+			next_attempt_at = now(), attempts = GREATEST(attempts - 1, 0), last_error = NULLIF($3, '')
+		WHERE id = $1 AND claimed_by = $2 AND status = 'claimed'
+	`, job.ID, w.ID, reason)
+	return err
+}
+
+// ExtendLease extends the lease on a job claimed by the worker.
+func (q *Postgres) ExtendLease(ctx context.Context, w Worker, job *Job) (LeaseState, error) {
+	state := LeaseState{Held: true}
+	err := q.db.QueryRowContext(ctx, `
+		UPDATE build_queue SET heartbeat_at = now(), lease_expires_at = now() + make_interval(secs => $3)
+		WHERE id = $1 AND claimed_by = $2 AND status = 'claimed'
+		RETURNING cancel_requested_at IS NOT NULL, superseded_by IS NOT NULL
+	`, job.ID, w.ID, w.Lease.Seconds()).Scan(&state.CancelRequested, &state.Superseded)
+	if err == sql.ErrNoRows {
+		return LeaseState{}, nil
+	}
+	if err != nil {
+		return LeaseState{}, err
+	}
+	return state, nil
+}
+
+// Resume renews the lease on a job that is still claimed by the worker.
+func (q *Postgres) Resume(ctx context.Context, w Worker, jobID string) (*Job, error) {
+	var job Job
+	err := q.db.QueryRowContext(ctx, `
+		UPDATE build_queue SET heartbeat_at = now(), lease_expires_at = now() + make_interval(secs => $3)
+		WHERE id = $1 AND claimed_by = $2 AND status = 'claimed'
+		RETURNING id, payload::text, attempts
+	`, jobID, w.ID, w.Lease.Seconds()).Scan(&job.ID, &job.Payload, &job.Attempt)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &job, nil
+}
+
+// NextDue returns when the earliest delayed pending job becomes runnable.
+func (q *Postgres) NextDue(ctx context.Context) (time.Time, bool, error) {
+	var next sql.NullTime
+	err := q.db.QueryRowContext(ctx, `
+		SELECT min(GREATEST(run_after, next_attempt_at)) FROM build_queue
+		WHERE status = 'pending' AND cancel_requested_at IS NULL AND GREATEST(run_after, next_attempt_at) > now()
+	`).Scan(&next)
+	if err != nil {
+		return time.Time{}, false, err
+	}
+	return next.Time, next.Valid, nil
+}
+
+// SupersedeOlder marks pending builds of the same app and branch as superseded by the newest queued one.
+func (q *Postgres) SupersedeOlder(ctx context.Context, job *Job) ([]Job, error) {
+	rows, err := q.db.QueryContext(ctx, `
+		WITH me AS (
+			SELECT `+fmt.Sprintf(buildKeySQL, "m")+` AS build_key FROM build_queue m WHERE m.id = $1
+		),
+		newest AS (
+			SELECT n.id, n.created_at FROM build_queue n, me
+			WHERE `+fmt.Sprintf(buildKeySQL, "n")+` = me.build_key AND (n.status = 'pending' OR n.id = $1)
+			ORDER BY n.created_at DESC LIMIT 1
+		)
+		UPDATE build_queue q
+		SET status = 'superseded', superseded_by = newest.id, finished_at = now(), lease_expires_at = NULL
+		FROM newest, me
+		WHERE `+fmt.Sprintf(buildKeySQL, "q")+` = me.build_key AND q.created_at < newest.created_at
+			AND (q.status = 'pending' OR q.id = $1)
+		RETURNING q.id, q.payload::text, newest.id
+	`, job.ID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var superseded []Job
+	for rows.Next() {
+		var j Job
+		var newestID string
+		if err := rows.Scan(&j.ID, &j.Payload, &newestID); err != nil {
+			return superseded, err
+		}
+		log.Printf("Build %s superseded by %s", j.ID, newestID)
+		superseded = append(superseded, j)
+	}
+	return superseded, rows.Err()
+}
+
+// SupersedeRunning requests cancellation of older running builds of the same app and branch,
+// notifying the workers that run them.
+func (q *Postgres) SupersedeRunning(ctx context.Context, job *Job) ([]string, error) {
+	rows, err := q.db.QueryContext(ctx, `
+		WITH me AS (
+			SELECT `+fmt.Sprintf(buildKeySQL, "m")+` AS build_key, m.created_at FROM build_queue m WHERE m.id = $1
+		)
+		UPDATE build_queue q
+		SET cancel_requested_at = now(), superseded_by = $1
+		FROM me
+		WHERE `+fmt.Sprintf(buildKeySQL, "q")+` = me.build_key AND q.status = 'claimed' AND q.id <> $1
+			AND q.cancel_requested_at IS NULL AND q.created_at < me.created_at
+		RETURNING q.id
+	`, job.ID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var ids []string
+	for rows.Next() {
+		var id string
+		if err := rows.Scan(&id); err != nil {
+			return nil, err
+		}
+		ids = append(ids, id)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	for _, id := range ids {
+		// Workers that miss the notification pick the request up on their next ExtendLease
+		if _, err := q.db.ExecContext(ctx, "SELECT pg_notify($1, $2)", channelSuperseded, id); err != nil {
+			log.Printf("Failed to notify superseded build %s: %v", id, err)
+		}
+	}
+	return ids, nil
+}
+
+// Subscribe returns the channel notifications are delivered on.
+func (q *Postgres) Subscribe() <-chan Event {
+	return q.events
+}
+
+// Close stops listening for notifications. The database connection is left open.
+func (q *Postgres) Close() error {
+	close(q.done)
+	return q.listener.Close()
+}
@@ -0,0 +1,132 @@
+package jobqueue
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+)
+
+// migrationsDir holds the API's migrations, which create build_queue and the tables around it.
+const migrationsDir = "../../../../api/Api.Migrations/Migrations"
+
+// newTestPostgres returns a Postgres queue on a schema of its own, created by the API's build
+// queue migrations. It needs a database to run against: set TEST_DATABASE_URL.
+func newTestPostgres(t *testing.T) *Postgres {
+	t.Helper()
+	databaseURL := os.Getenv("TEST_DATABASE_URL")
+	if databaseURL == "" {
+		t.Skip("TEST_DATABASE_URL is not set")
+	}
+	admin, err := sql.Open("postgres", databaseURL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { admin.Close() })
+	schema := fmt.Sprintf("jobqueue_test_%d", time.Now().UnixNano())
+	if _, err := admin.Exec("CREATE SCHEMA " + schema); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { admin.Exec("DROP SCHEMA " + schema + " CASCADE") })
+
+	db, err := sql.Open("postgres", withSearchPath(t, databaseURL, schema))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+	for _, migration := range buildMigrations(t) {
+		if _, err := db.Exec(migration); err != nil {
+			t.Fatalf("migration: %v\n%s", err, migration)
+		}
+	}
+	return &Postgres{db: db}
+}
+
+// withSearchPath returns the connection string with schema as the search path.
+func withSearchPath(t *testing.T, databaseURL, schema string) string {
+	t.Helper()
+	if !strings.HasPrefix(databaseURL, "postgres://") && !strings.HasPrefix(databaseURL, "postgresql://") {
+		return databaseURL + " search_path=" + schema
+	}
+	u, err := url.Parse(databaseURL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	query := u.Query()
+	query.Set("search_path", schema)
+	u.RawQuery = query.Encode()
+	return u.String()
+}
+
+// buildMigrations returns the SQL of the API's AddBuild* migrations, oldest first.
+func buildMigrations(t *testing.T) []string {
+	t.Helper()
+	files, err := filepath.Glob(filepath.Join(migrationsDir, "*_AddBuild*.cs"))
+	if err != nil || len(files) == 0 {
+		t.Fatalf("no build queue migrations in %s: %v", migrationsDir, err)
+	}
+	sort.Strings(files)
+	var migrations []string
+	for _, file := range files {
+		source, err := os.ReadFile(file)
+		if err != nil {
+			t.Fatal(err)
+		}
+		// The Up method's migrationBuilder.Sql("""...""")
+		_, up, _ := strings.Cut(string(source), "void Up(")
+		_, body, ok := strings.Cut(up, `Sql("""`)
+		body, _, ok2 := strings.Cut(body, `"""`)
+		if !ok || !ok2 {
+			t.Fatalf("%s: no SQL in Up", file)
+		}
+		migrations = append(migrations, body)
+	}
+	return migrations
+}
+
+func TestPostgresAckRecordsUsage(t *testing.T) {
+	q := newTestPostgres(t)
+	ctx := context.Background()
+	const id = "6f1c2a9e-3b4d-4e5f-8a7b-1c2d3e4f5a6b"
+	if _, err := q.db.Exec(`INSERT INTO build_queue (id, payload) VALUES ($1, $2)`,
+		id, `{"tenant_id":"alice","app_id":"1","limits":{"tier":"pro"}}`); err != nil {
+		t.Fatal(err)
+	}
+
+	job, err := q.Claim(ctx, worker)
+	if err != nil || job == nil || job.ID != id {
+		t.Fatalf("Claim = %+v, %v", job, err)
+	}
+	exitCode := 0
+	result := Result{Status: Succeeded, ExitCode: &exitCode, BillableSeconds: 90}
+	if err := q.Ack(ctx, worker, job, result); err != nil {
+		t.Fatalf("Ack: %v", err)
+	}
+
+	// An Ack repeated after its response was lost, with the row claimed again, records nothing more
+	if _, err := q.db.Exec(`UPDATE build_queue SET status = 'claimed' WHERE id = $1`, id); err != nil {
+		t.Fatal(err)
+	}
+	if err := q.Ack(ctx, worker, job, result); err != nil {
+		t.Fatalf("repeated Ack: %v", err)
+	}
+
+	var status, tier string
+	if err := q.db.QueryRow(`SELECT q.status, u.tier FROM build_queue q JOIN build_usage u ON u.build_id = q.id WHERE q.id = $1`,
+		id).Scan(&status, &tier); err != nil {
+		t.Fatal(err)
+	}
+	if status != Succeeded || tier != "pro" {
+		t.Errorf("status = %s, tier = %s, want succeeded and pro", status, tier)
+	}
+	used, err := q.UsedSeconds(ctx, "alice", time.Now().Add(-time.Hour))
+	if err != nil || used != 90 {
+		t.Errorf("UsedSeconds = %d, %v, want 90", used, err)
+	}
+}
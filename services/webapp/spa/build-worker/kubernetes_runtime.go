@@ -0,0 +1,578 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"mycrocloud/worker/logcollector"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	batchv1 "k8s.io/api/batch/v1"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/rest"
+	"k8s.io/client-go/tools/clientcmd"
+)
+
+const (
+	builderContainer = "builder"
+	jobNameLabel     = "batch.kubernetes.io/job-name"
+	outputVolume     = "output"
+
+	// The builder image's builder user. The image names it rather than giving its UID, and
+	// the kubelet only runs an image as non-root if it can check a numeric UID.
+	builderUID = 1001
+
+	// How long the allocatable capacity of the build nodes is cached for
+	capacityTTL = 30 * time.Second
+)
+
+// KubernetesRuntime runs each build as a Kubernetes Job instead of a container on a local
+// Docker daemon. The job output directory must be on a ReadWriteMany volume mounted in the
+// worker at build_output_dir; build pods mount the same claim, so artifacts are read back
+// from it as with Docker. Other mounts (the secrets file) are copied into a Secret owned
+// by the Job, which Kubernetes keeps on tmpfs.
+//
+// Pods can't set a pids limit, so the kubelet's podPidsLimit on the build nodes stands in
+// for it. Usage is read from the kubelet's stats summary, which needs the nodes/proxy
+// permission.
+type KubernetesRuntime struct {
+	client       kubernetes.Interface
+	namespace    string
+	outputClaim  string // PersistentVolumeClaim mounted at outputDir
+	outputDir    string
+	nodeSelector map[string]string
+	pollInterval time.Duration
+	summary      func(ctx context.Context, node string) ([]byte, error) // the kubelet's stats summary of a node
+
+	mu         sync.Mutex
+	memory     int64 // allocatable on the build nodes, in bytes
+	cpu        int64 // allocatable on the build nodes, in millicores
+	capacityAt time.Time
+}
+
+// NewKubernetesClient connects with the kubeconfig at path, or the in-cluster service account if path is empty.
+func NewKubernetesClient(path string) (kubernetes.Interface, error) {
+	var restCfg *rest.Config
+	var err error
+	if path == "" {
+		restCfg, err = rest.InClusterConfig()
+	} else {
+		restCfg, err = clientcmd.BuildConfigFromFlags("", path)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return kubernetes.NewForConfig(restCfg)
+}
+
+// NewKubernetesRuntime creates a runtime that schedules builds with client. It fails if the
+// build nodes' pids limit isn't configured or is looser than the one builds get on Docker.
+func NewKubernetesRuntime(client kubernetes.Interface, cfg Config, limits Limits) (*KubernetesRuntime, error) {
+	k := cfg.Runtime.Kubernetes
+	if k.OutputClaim == "" {
+		return nil, errors.New("runtime.kubernetes.output_claim is required")
+	}
+	if pids := limits.DefaultJob.PidsLimit; pids > 0 && (k.PodPidsLimit <= 0 || k.PodPidsLimit > pids) {
+		return nil, fmt.Errorf("runtime.kubernetes.pod_pids_limit must be the kubelet's podPidsLimit on the build nodes, at most %d: "+
+			"build pods can't set their own", pids)
+	}
+	r := &KubernetesRuntime{
+		client:       client,
+		namespace:    k.Namespace,
+		outputClaim:  k.OutputClaim,
+		outputDir:    cfg.BuildOutputDir,
+		nodeSelector: k.NodeSelector,
+		pollInterval: 2 * time.Second,
+	}
+	r.summary = r.nodeSummary
+	return r, nil
+}
+
+// Create creates the build Job suspended, so nothing runs until Start.
+func (r *KubernetesRuntime) Create(ctx context.Context, spec ContainerSpec) (string, error) {
+	name := "build-" + spec.Labels["build_id"]
+	if spec.Labels["build_id"] == "" {
+		return "", errors.New("build_id label is required")
+	}
+
+	var mounts []corev1.VolumeMount
+	volumes := []corev1.Volume{{
+		Name: outputVolume,
+		VolumeSource: corev1.VolumeSource{
+			PersistentVolumeClaim: &corev1.PersistentVolumeClaimVolumeSource{ClaimName: r.outputClaim},
+		},
+	}}
+	secretData := map[string][]byte{}
+	var secretMounts []Mount
+	for _, m := range spec.Mounts {
+		subPath, err := filepath.Rel(r.outputDir, m.Source)
+		if err == nil && !strings.HasPrefix(subPath, "..") {
+			mounts = append(mounts, corev1.VolumeMount{
+				Name:      outputVolume,
+				MountPath: m.Target,
+				SubPath:   filepath.ToSlash(subPath),
+				ReadOnly:  m.ReadOnly,
+			})
+			continue
+		}
+		entries, err := os.ReadDir(m.Source)
+		if err != nil {
+			return "", fmt.Errorf("read mount %s: %w", m.Source, err)
+		}
+		for _, entry := range entries {
+			data, err := os.ReadFile(filepath.Join(m.Source, entry.Name()))
+			if err != nil {
+				return "", err
+			}
+			secretData[entry.Name()] = data
+		}
+		secretMounts = append(secretMounts, m)
+	}
+	for i, m := range secretMounts {
+		volume := fmt.Sprintf("files-%d", i)
+		volumes = append(volumes, corev1.Volume{
+			Name:         volume,
+			VolumeSource: corev1.VolumeSource{Secret: &corev1.SecretVolumeSource{SecretName: name, DefaultMode: ptr(int32(0444))}},
+		})
+		mounts = append(mounts, corev1.VolumeMount{Name: volume, MountPath: m.Target, ReadOnly: true})
+	}
+
+	var env []corev1.EnvVar
+	for _, kv := range spec.Env {
+		key, value, _ := strings.Cut(kv, "=")
+		env = append(env, corev1.EnvVar{Name: key, Value: value})
+	}
+
+	cpu := resource.NewMilliQuantity(spec.Limits.MilliCPUs(), resource.DecimalSI)
+	memory := resource.NewQuantity(spec.Limits.MemoryBytes, resource.BinarySI)
+	memoryRequest := resource.NewQuantity(spec.Limits.MemorySoftBytes, resource.BinarySI)
+	limits := corev1.ResourceList{corev1.ResourceCPU: *cpu, corev1.ResourceMemory: *memory}
+	if spec.Limits.DiskBytes > 0 {
+		// The kubelet evicts the pod if its writable layer and logs grow past this
+		limits[corev1.ResourceEphemeralStorage] = *resource.NewQuantity(spec.Limits.DiskBytes, resource.BinarySI)
+	}
+
+	job := &batchv1.Job{
+		ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: r.namespace, Labels: spec.Labels},
+		Spec: batchv1.JobSpec{
+			Suspend:               ptr(true),
+			BackoffLimit:          ptr(int32(0)),
+			ActiveDeadlineSeconds: ptr(int64(spec.Limits.BuildDuration)),
+			Template: corev1.PodTemplateSpec{
+				ObjectMeta: metav1.ObjectMeta{Labels: spec.Labels},
+				Spec: corev1.PodSpec{
+					RestartPolicy:                corev1.RestartPolicyNever,
+					AutomountServiceAccountToken: ptr(false),
+					EnableServiceLinks:           ptr(false),
+					NodeSelector:                 r.nodeSelector,
+					Volumes:                      volumes,
+					Containers: []corev1.Container{{
+						Name:         builderContainer,
+						Image:        spec.Image,
+						Env:          env,
+						VolumeMounts: mounts,
+						Resources: corev1.ResourceRequirements{
+							Limits:   limits,
+							Requests: corev1.ResourceList{corev1.ResourceCPU: *cpu, corev1.ResourceMemory: *memoryRequest},
+						},
+						SecurityContext: &corev1.SecurityContext{
+							RunAsNonRoot:             ptr(true),
+							RunAsUser:                ptr(int64(builderUID)),
+							RunAsGroup:               ptr(int64(builderUID)),
+							AllowPrivilegeEscalation: ptr(false),
+							Capabilities:             &corev1.Capabilities{Drop: []corev1.Capability{"ALL"}},
+						},
+					}},
+				},
+			},
+		},
+	}
+	if spec.AutoRemove {
+		// Left long enough for Wait to read the exit code
+		job.Spec.TTLSecondsAfterFinished = ptr(int32(300))
+	}
+
+	created, err := r.client.BatchV1().Jobs(r.namespace).Create(ctx, job, metav1.CreateOptions{})
+	if err != nil {
+		return "", err
+	}
+
+	if len(secretData) > 0 {
+		// Owned by the Job, so it is deleted with it
+		secret := &corev1.Secret{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:      name,
+				Namespace: r.namespace,
+				Labels:    spec.Labels,
+				OwnerReferences: []metav1.OwnerReference{{
+					APIVersion: "batch/v1",
+					Kind:       "Job",
+					Name:       created.Name,
+					UID:        created.UID,
+				}},
+			},
+			Data: secretData,
+		}
+		if _, err := r.client.CoreV1().Secrets(r.namespace).Create(ctx, secret, metav1.CreateOptions{}); err != nil {
+			r.delete(name)
+			return "", err
+		}
+	}
+	return name, nil
+}
+
+// Start unsuspends the Job so its pod is scheduled.
+func (r *KubernetesRuntime) Start(ctx context.Context, id string) error {
+	job, err := r.client.BatchV1().Jobs(r.namespace).Get(ctx, id, metav1.GetOptions{})
+	if err != nil {
+		return err
+	}
+	job.Spec.Suspend = ptr(false)
+	_, err = r.client.BatchV1().Jobs(r.namespace).Update(ctx, job, metav1.UpdateOptions{})
+	return err
+}
+
+// Wait polls the build pod until its container terminates.
+func (r *KubernetesRuntime) Wait(ctx context.Context, id string) (ExitStatus, error) {
+	ticker := time.NewTicker(r.pollInterval)
+	defer ticker.Stop()
+	for {
+		pod, err := r.pod(ctx, id)
+		if err != nil && ctx.Err() == nil {
+			return ExitStatus{}, err
+		}
+		if terminated := builderTerminated(pod); terminated != nil {
+			r.deleteSecrets(ctx, id)
+			exit := ExitStatus{
+				ExitCode:  int(terminated.ExitCode),
+				OOMKilled: terminated.Reason == "OOMKilled",
+				Signal:    int(terminated.Signal),
+			}
+			if exit.Signal == 0 {
+				exit.Signal = signalOf(exit.ExitCode)
+			}
+			exit.DiskLimitExceeded = evictedForDisk(pod)
+			return exit, nil
+		}
+		if pod != nil && pod.Status.Phase == corev1.PodFailed {
+			// An evicted pod's container can be killed without a terminated state being recorded
+			r.deleteSecrets(ctx, id)
+			return ExitStatus{ExitCode: 137, Signal: 9, DiskLimitExceeded: evictedForDisk(pod)}, nil
+		}
+
+		// A Job can fail without its container ever running, e.g. if the pod can't be scheduled in time
+		job, err := r.client.BatchV1().Jobs(r.namespace).Get(ctx, id, metav1.GetOptions{})
+		if err != nil && ctx.Err() == nil {
+			return ExitStatus{}, err
+		}
+		if job != nil && pod == nil {
+			for _, c := range job.Status.Conditions {
+				if c.Type == batchv1.JobFailed && c.Status == corev1.ConditionTrue {
+					return ExitStatus{}, fmt.Errorf("job failed: %s: %s", c.Reason, c.Message)
+				}
+			}
+		}
+
+		select {
+		case <-ctx.Done():
+			return ExitStatus{}, ctx.Err()
+		case <-ticker.C:
+		}
+	}
+}
+
+// deleteSecrets deletes the build's Secret once it has run, without waiting for the Job to be deleted.
+func (r *KubernetesRuntime) deleteSecrets(ctx context.Context, id string) {
+	err := r.client.CoreV1().Secrets(r.namespace).Delete(context.WithoutCancel(ctx), id, metav1.DeleteOptions{})
+	if err != nil && !apierrors.IsNotFound(err) {
+		log.Printf("Failed to delete secrets of %s: %v", id, err)
+	}
+}
+
+// evictedForDisk reports whether the kubelet evicted the pod for going over its ephemeral storage limit.
+func evictedForDisk(pod *corev1.Pod) bool {
+	return pod.Status.Reason == "Evicted" && strings.Contains(pod.Status.Message, "ephemeral")
+}
+
+// StreamLogs follows the build container's logs once its pod has started. Kubernetes
+// merges stdout and stderr, so every line is reported as stdout.
+func (r *KubernetesRuntime) StreamLogs(ctx context.Context, id string, collector *logcollector.Collector) {
+	ticker := time.NewTicker(r.pollInterval)
+	defer ticker.Stop()
+	var pod *corev1.Pod
+	for {
+		pod, _ = r.pod(ctx, id)
+		if pod != nil && (pod.Status.Phase != corev1.PodPending || builderTerminated(pod) != nil) {
+			break
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+
+	stream, err := r.client.CoreV1().Pods(r.namespace).GetLogs(pod.Name, &corev1.PodLogOptions{
+		Container: builderContainer,
+		Follow:    true,
+	}).Stream(ctx)
+	if err != nil {
+		collector.Append("Failed to attach to build logs: "+err.Error(), "stderr", "app.worker", "")
+		return
+	}
+	defer stream.Close()
+
+	scanner := bufio.NewScanner(stream)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		if line := scanner.Text(); line != "" {
+			collector.Append(line, "stdout", "app.builder", id)
+		}
+	}
+}
+
+// Stop deletes the Job, which kills its pod.
+func (r *KubernetesRuntime) Stop(ctx context.Context, id string) error {
+	policy := metav1.DeletePropagationBackground
+	err := r.client.BatchV1().Jobs(r.namespace).Delete(ctx, id, metav1.DeleteOptions{PropagationPolicy: &policy})
+	if apierrors.IsNotFound(err) {
+		return nil
+	}
+	return err
+}
+
+// List returns the build Jobs. A Job that is still suspended hasn't started.
+func (r *KubernetesRuntime) List(ctx context.Context) ([]Container, error) {
+	jobs, err := r.client.BatchV1().Jobs(r.namespace).List(ctx, metav1.ListOptions{LabelSelector: "build_id"})
+	if err != nil {
+		return nil, err
+	}
+	var containers []Container
+	for _, job := range jobs.Items {
+		c := Container{ID: job.Name, Labels: job.Labels}
+		if job.Status.StartTime != nil && (job.Spec.Suspend == nil || !*job.Spec.Suspend) {
+			c.StartedAt = job.Status.StartTime.Time
+			c.Running = !jobFinished(&job)
+		}
+		if pod := job.Spec.Template.Spec; len(pod.Containers) > 0 {
+			limits := pod.Containers[0].Resources.Limits
+			c.Limits = JobLimits{MemoryBytes: limits.Memory().Value(), CPUQuota: limits.Cpu().MilliValue() * 100, CPUPeriod: 100000}
+		}
+		containers = append(containers, c)
+	}
+	return containers, nil
+}
+
+// jobFinished reports whether the Job has completed or failed.
+func jobFinished(job *batchv1.Job) bool {
+	return !jobFinishedAt(job).IsZero()
+}
+
+// jobFinishedAt returns when the Job completed or failed, or zero if it hasn't.
+func jobFinishedAt(job *batchv1.Job) time.Time {
+	for _, c := range job.Status.Conditions {
+		if (c.Type == batchv1.JobComplete || c.Type == batchv1.JobFailed) && c.Status == corev1.ConditionTrue {
+			return c.LastTransitionTime.Time
+		}
+	}
+	return time.Time{}
+}
+
+// PruneContainers deletes finished build Jobs. Jobs of builds run with auto_remove are
+// deleted by Kubernetes once their TTL is up; the rest are kept until they are pruned.
+func (r *KubernetesRuntime) PruneContainers(ctx context.Context, olderThan time.Duration) (int, error) {
+	jobs, err := r.client.BatchV1().Jobs(r.namespace).List(ctx, metav1.ListOptions{LabelSelector: "build_id"})
+	if err != nil {
+		return 0, err
+	}
+	cutoff := time.Now().Add(-olderThan)
+	removed := 0
+	for _, job := range jobs.Items {
+		finishedAt := jobFinishedAt(&job)
+		if finishedAt.IsZero() || finishedAt.After(cutoff) {
+			continue
+		}
+		if err := r.Stop(ctx, job.Name); err != nil {
+			log.Printf("Failed to delete job %s: %v", job.Name, err)
+			continue
+		}
+		removed++
+	}
+	return removed, nil
+}
+
+// podSummary is the part of a pod's entry in the kubelet's stats summary that Stats reads.
+type podSummary struct {
+	PodRef struct {
+		Name      string `json:"name"`
+		Namespace string `json:"namespace"`
+	} `json:"podRef"`
+	Containers []struct {
+		Name string `json:"name"`
+		CPU  *struct {
+			UsageCoreNanoSeconds uint64 `json:"usageCoreNanoSeconds"`
+		} `json:"cpu"`
+		Memory *struct {
+			WorkingSetBytes uint64 `json:"workingSetBytes"`
+		} `json:"memory"`
+		Rootfs *struct {
+			UsedBytes uint64 `json:"usedBytes"`
+		} `json:"rootfs"`
+	} `json:"containers"`
+	Network *struct {
+		RxBytes uint64 `json:"rxBytes"`
+		TxBytes uint64 `json:"txBytes"`
+	} `json:"network"`
+}
+
+// Stats reads the build container's usage from the stats summary of the kubelet running
+// its pod. The kubelet refreshes it every 10 to 15 seconds, so short peaks can be missed.
+func (r *KubernetesRuntime) Stats(ctx context.Context, id string) (Sample, error) {
+	pod, err := r.pod(ctx, id)
+	if err != nil {
+		return Sample{}, err
+	}
+	if pod == nil || pod.Spec.NodeName == "" {
+		return Sample{}, fmt.Errorf("pod of %s is not scheduled yet", id)
+	}
+	data, err := r.summary(ctx, pod.Spec.NodeName)
+	if err != nil {
+		return Sample{}, fmt.Errorf("stats summary of node %s: %w", pod.Spec.NodeName, err)
+	}
+	var summary struct {
+		Pods []podSummary `json:"pods"`
+	}
+	if err := json.Unmarshal(data, &summary); err != nil {
+		return Sample{}, fmt.Errorf("stats summary of node %s: %w", pod.Spec.NodeName, err)
+	}
+	for _, p := range summary.Pods {
+		if p.PodRef.Name != pod.Name || p.PodRef.Namespace != pod.Namespace {
+			continue
+		}
+		var sample Sample
+		if p.Network != nil {
+			sample.NetworkRxBytes, sample.NetworkTxBytes = p.Network.RxBytes, p.Network.TxBytes
+		}
+		for _, c := range p.Containers {
+			if c.Name != builderContainer {
+				continue
+			}
+			if c.CPU != nil {
+				sample.CPUSeconds = float64(c.CPU.UsageCoreNanoSeconds) / 1e9
+			}
+			if c.Memory != nil {
+				sample.MemoryBytes = c.Memory.WorkingSetBytes
+			}
+			if c.Rootfs != nil {
+				sample.DiskBytes = c.Rootfs.UsedBytes
+			}
+			return sample, nil
+		}
+	}
+	return Sample{}, fmt.Errorf("no stats for pod %s yet", pod.Name)
+}
+
+// nodeSummary fetches the kubelet's stats summary of the node through the API server.
+func (r *KubernetesRuntime) nodeSummary(ctx context.Context, node string) ([]byte, error) {
+	return r.client.CoreV1().RESTClient().Get().
+		Resource("nodes").Name(node).SubResource("proxy").Suffix("stats/summary").
+		DoRaw(ctx)
+}
+
+// TotalCapacity returns the memory and CPU allocatable on the ready, schedulable nodes
+// matching the node selector. Other pods on those nodes aren't counted. It is cached for
+// capacityTTL; if the nodes can't be listed the last capacity is kept.
+func (r *KubernetesRuntime) TotalCapacity() (memoryBytes int64, milliCPUs int64) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if time.Since(r.capacityAt) < capacityTTL {
+		return r.memory, r.cpu
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	nodes, err := r.client.CoreV1().Nodes().List(ctx, metav1.ListOptions{
+		LabelSelector: labels.SelectorFromSet(r.nodeSelector).String(),
+	})
+	if err != nil {
+		log.Printf("Failed to list build nodes: %v", err)
+		return r.memory, r.cpu
+	}
+	for _, node := range nodes.Items {
+		if node.Spec.Unschedulable || !nodeReady(&node) {
+			continue
+		}
+		memoryBytes += node.Status.Allocatable.Memory().Value()
+		milliCPUs += node.Status.Allocatable.Cpu().MilliValue()
+	}
+	r.memory, r.cpu, r.capacityAt = memoryBytes, milliCPUs, time.Now()
+	return memoryBytes, milliCPUs
+}
+
+// nodeReady reports whether the node's Ready condition is true.
+func nodeReady(node *corev1.Node) bool {
+	for _, c := range node.Status.Conditions {
+		if c.Type == corev1.NodeReady {
+			return c.Status == corev1.ConditionTrue
+		}
+	}
+	return false
+}
+
+// PruneImages does nothing: the kubelet garbage collects images on its nodes.
+func (r *KubernetesRuntime) PruneImages(ctx context.Context) (uint64, error) {
+	return 0, nil
+}
+
+func (r *KubernetesRuntime) Release(id string) {}
+
+func (r *KubernetesRuntime) Close() error {
+	return nil
+}
+
+// pod returns the pod of the build Job, or nil if it hasn't been created yet.
+func (r *KubernetesRuntime) pod(ctx context.Context, id string) (*corev1.Pod, error) {
+	pods, err := r.client.CoreV1().Pods(r.namespace).List(ctx, metav1.ListOptions{LabelSelector: jobNameLabel + "=" + id})
+	if err != nil {
+		return nil, err
+	}
+	if len(pods.Items) == 0 {
+		return nil, nil
+	}
+	return &pods.Items[0], nil
+}
+
+func (r *KubernetesRuntime) delete(id string) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	_ = r.Stop(ctx, id)
+}
+
+// builderTerminated returns the terminated state of the builder container, or nil if it is still running.
+func builderTerminated(pod *corev1.Pod) *corev1.ContainerStateTerminated {
+	if pod == nil {
+		return nil
+	}
+	for _, status := range pod.Status.ContainerStatuses {
+		if status.Name == builderContainer {
+			return status.State.Terminated
+		}
+	}
+	return nil
+}
+
+func ptr[T any](v T) *T {
+	return &v
+}
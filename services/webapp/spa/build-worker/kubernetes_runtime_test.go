@@ -0,0 +1,374 @@
+package main
+
+import (
+	"context"
+	"mycrocloud/worker/logcollector"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+const testNamespace = "builds"
+
+func newTestKubernetesRuntime(t *testing.T) (*KubernetesRuntime, *fake.Clientset, Config) {
+	t.Helper()
+	var cfg Config
+	cfg.BuildOutputDir = t.TempDir()
+	cfg.Runtime.Kubernetes.Namespace = testNamespace
+	cfg.Runtime.Kubernetes.OutputClaim = "build-output"
+	cfg.Runtime.Kubernetes.NodeSelector = map[string]string{"pool": "builds"}
+	cfg.Runtime.Kubernetes.PodPidsLimit = 256
+
+	client := fake.NewClientset()
+	rt, err := NewKubernetesRuntime(client, cfg, DefaultLimits())
+	if err != nil {
+		t.Fatal(err)
+	}
+	rt.pollInterval = 10 * time.Millisecond
+	return rt, client, cfg
+}
+
+func testContainerSpec(cfg Config, mounts ...Mount) ContainerSpec {
+	jobLimits := DefaultLimits().DefaultJob
+	jobLimits.CPUQuota = 200000
+	return ContainerSpec{
+		Image:  "builder:latest",
+		Env:    []string{"OUT_DIR=dist", "ENV_VARS={\"A\":\"b=c\"}"},
+		Labels: map[string]string{"build_id": testBuildID},
+		Mounts: append([]Mount{{
+			Source: filepath.Join(cfg.BuildOutputDir, testBuildID),
+			Target: "/output",
+		}}, mounts...),
+		Limits:     jobLimits,
+		AutoRemove: true,
+	}
+}
+
+// addPod creates the pod the Job controller would create for the build Job.
+func addPod(t *testing.T, client *fake.Clientset, jobName string, phase corev1.PodPhase, terminated *corev1.ContainerStateTerminated) {
+	t.Helper()
+	pod := &corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      jobName + "-abcde",
+			Namespace: testNamespace,
+			Labels:    map[string]string{jobNameLabel: jobName},
+		},
+		Status: corev1.PodStatus{
+			Phase: phase,
+			ContainerStatuses: []corev1.ContainerStatus{{
+				Name:  builderContainer,
+				State: corev1.ContainerState{Terminated: terminated},
+			}},
+		},
+	}
+	if _, err := client.CoreV1().Pods(testNamespace).Create(context.Background(), pod, metav1.CreateOptions{}); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestKubernetesRuntimeCreatesJob(t *testing.T) {
+	rt, client, cfg := newTestKubernetesRuntime(t)
+	ctx := context.Background()
+
+	id, err := rt.Create(ctx, testContainerSpec(cfg))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	job, err := client.BatchV1().Jobs(testNamespace).Get(ctx, id, metav1.GetOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if job.Labels["build_id"] != testBuildID || job.Spec.Template.Labels["build_id"] != testBuildID {
+		t.Errorf("labels = %v, want build_id on the job and pod", job.Labels)
+	}
+	if job.Spec.Suspend == nil || !*job.Spec.Suspend {
+		t.Errorf("job is not created suspended")
+	}
+	if d := job.Spec.ActiveDeadlineSeconds; d == nil || *d != int64(DefaultLimits().DefaultJob.BuildDuration) {
+		t.Errorf("activeDeadlineSeconds = %v, want the build duration", d)
+	}
+	if job.Spec.BackoffLimit == nil || *job.Spec.BackoffLimit != 0 {
+		t.Errorf("backoffLimit = %v, want 0", job.Spec.BackoffLimit)
+	}
+
+	pod := job.Spec.Template.Spec
+	if pod.NodeSelector["pool"] != "builds" {
+		t.Errorf("nodeSelector = %v", pod.NodeSelector)
+	}
+	c := pod.Containers[0]
+	if got := c.Resources.Limits.Memory().Value(); got != DefaultLimits().DefaultJob.MemoryBytes {
+		t.Errorf("memory limit = %d, want %d", got, DefaultLimits().DefaultJob.MemoryBytes)
+	}
+	if got := c.Resources.Limits.Cpu().MilliValue(); got != 2000 {
+		t.Errorf("cpu limit = %dm, want 2000m", got)
+	}
+	if got := c.Resources.Requests.Memory().Value(); got != DefaultLimits().DefaultJob.MemorySoftBytes {
+		t.Errorf("memory request = %d, want the soft limit", got)
+	}
+	if got := c.Resources.Limits.StorageEphemeral().Value(); got != DefaultLimits().DefaultJob.DiskBytes {
+		t.Errorf("ephemeral storage limit = %d, want the disk limit", got)
+	}
+	var env []string
+	for _, e := range c.Env {
+		env = append(env, e.Name+"="+e.Value)
+	}
+	if strings.Join(env, " ") != `OUT_DIR=dist ENV_VARS={"A":"b=c"}` {
+		t.Errorf("env = %v", env)
+	}
+	if len(c.VolumeMounts) != 1 || c.VolumeMounts[0].MountPath != "/output" || c.VolumeMounts[0].SubPath != testBuildID {
+		t.Errorf("volume mounts = %+v, want /output on the build's subPath", c.VolumeMounts)
+	}
+	if claim := pod.Volumes[0].PersistentVolumeClaim; claim == nil || claim.ClaimName != "build-output" {
+		t.Errorf("volumes = %+v, want the output claim", pod.Volumes)
+	}
+	// RunAsNonRoot needs a numeric user; the image only names it
+	if sc := c.SecurityContext; sc == nil || sc.RunAsUser == nil || *sc.RunAsUser != 1001 || sc.RunAsGroup == nil || *sc.RunAsGroup != 1001 {
+		t.Errorf("security context = %+v, want the builder user's UID and GID 1001", sc)
+	}
+}
+
+func TestKubernetesRuntimeMountsFilesAsSecret(t *testing.T) {
+	rt, client, cfg := newTestKubernetesRuntime(t)
+	ctx := context.Background()
+	secretsDir := t.TempDir()
+	os.WriteFile(filepath.Join(secretsDir, "env.json"), []byte(`{"NPM_TOKEN":"hunter2"}`), 0444)
+
+	id, err := rt.Create(ctx, testContainerSpec(cfg, Mount{Source: secretsDir, Target: containerSecretsDir, ReadOnly: true}))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	secret, err := client.CoreV1().Secrets(testNamespace).Get(ctx, id, metav1.GetOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(secret.Data["env.json"]) != `{"NPM_TOKEN":"hunter2"}` {
+		t.Errorf("secret data = %v", secret.Data)
+	}
+	if len(secret.OwnerReferences) != 1 || secret.OwnerReferences[0].Name != id {
+		t.Errorf("secret is not owned by the job: %+v", secret.OwnerReferences)
+	}
+	job, _ := client.BatchV1().Jobs(testNamespace).Get(ctx, id, metav1.GetOptions{})
+	mounts := job.Spec.Template.Spec.Containers[0].VolumeMounts
+	if len(mounts) != 2 || mounts[1].MountPath != containerSecretsDir || !mounts[1].ReadOnly {
+		t.Errorf("volume mounts = %+v, want the secret at %s", mounts, containerSecretsDir)
+	}
+	for _, e := range job.Spec.Template.Spec.Containers[0].Env {
+		if strings.Contains(e.Value, "hunter2") {
+			t.Errorf("secret leaked into the pod env")
+		}
+	}
+
+	// The secret is deleted once the build has run
+	addPod(t, client, id, corev1.PodSucceeded, &corev1.ContainerStateTerminated{ExitCode: 0})
+	if _, err := rt.Wait(ctx, id); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := client.CoreV1().Secrets(testNamespace).Get(ctx, id, metav1.GetOptions{}); !apierrors.IsNotFound(err) {
+		t.Errorf("secret still exists after the build: %v", err)
+	}
+}
+
+func TestKubernetesRuntimeStartUnsuspends(t *testing.T) {
+	rt, client, cfg := newTestKubernetesRuntime(t)
+	ctx := context.Background()
+	id, _ := rt.Create(ctx, testContainerSpec(cfg))
+
+	if err := rt.Start(ctx, id); err != nil {
+		t.Fatal(err)
+	}
+
+	job, _ := client.BatchV1().Jobs(testNamespace).Get(ctx, id, metav1.GetOptions{})
+	if job.Spec.Suspend == nil || *job.Spec.Suspend {
+		t.Errorf("job is still suspended")
+	}
+}
+
+func TestKubernetesRuntimeWait(t *testing.T) {
+	tests := []struct {
+		name       string
+		terminated corev1.ContainerStateTerminated
+		want       ExitStatus
+	}{
+		{"success", corev1.ContainerStateTerminated{ExitCode: 0, Reason: "Completed"}, ExitStatus{}},
+		{"failure", corev1.ContainerStateTerminated{ExitCode: 2, Reason: "Error"}, ExitStatus{ExitCode: 2}},
+		{"out of memory", corev1.ContainerStateTerminated{ExitCode: 137, Reason: "OOMKilled"}, ExitStatus{ExitCode: 137, OOMKilled: true, Signal: 9}},
+		{"killed", corev1.ContainerStateTerminated{ExitCode: 143, Reason: "Error"}, ExitStatus{ExitCode: 143, Signal: 15}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rt, client, cfg := newTestKubernetesRuntime(t)
+			ctx := context.Background()
+			id, _ := rt.Create(ctx, testContainerSpec(cfg))
+			rt.Start(ctx, id)
+
+			// The pod shows up while Wait is polling
+			time.AfterFunc(30*time.Millisecond, func() {
+				addPod(t, client, id, corev1.PodFailed, &tt.terminated)
+			})
+			got, err := rt.Wait(ctx, id)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != tt.want {
+				t.Errorf("Wait = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestKubernetesRuntimeRequiresPodPidsLimit(t *testing.T) {
+	for _, pids := range []int64{0, 1024} {
+		var cfg Config
+		cfg.Runtime.Kubernetes.OutputClaim = "build-output"
+		cfg.Runtime.Kubernetes.PodPidsLimit = pids
+		if _, err := NewKubernetesRuntime(fake.NewClientset(), cfg, DefaultLimits()); err == nil {
+			t.Errorf("pod_pids_limit %d: NewKubernetesRuntime succeeded, want an error", pids)
+		}
+	}
+}
+
+func TestKubernetesRuntimeWaitEvicted(t *testing.T) {
+	rt, client, cfg := newTestKubernetesRuntime(t)
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	id, _ := rt.Create(ctx, testContainerSpec(cfg))
+	rt.Start(ctx, id)
+
+	// Evicted before the kubelet recorded how the container ended
+	addPod(t, client, id, corev1.PodFailed, nil)
+	pod, _ := rt.pod(ctx, id)
+	pod.Status.Reason = "Evicted"
+	pod.Status.Message = "Pod ephemeral local storage usage exceeds the total limit of containers 10Gi."
+	if _, err := client.CoreV1().Pods(testNamespace).UpdateStatus(ctx, pod, metav1.UpdateOptions{}); err != nil {
+		t.Fatal(err)
+	}
+
+	got, err := rt.Wait(ctx, id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := (ExitStatus{ExitCode: 137, Signal: 9, DiskLimitExceeded: true}); got != want {
+		t.Errorf("Wait = %+v, want %+v", got, want)
+	}
+}
+
+func TestKubernetesRuntimeStats(t *testing.T) {
+	rt, client, cfg := newTestKubernetesRuntime(t)
+	ctx := context.Background()
+	id, _ := rt.Create(ctx, testContainerSpec(cfg))
+	addPod(t, client, id, corev1.PodRunning, nil)
+	pod, _ := rt.pod(ctx, id)
+	pod.Spec.NodeName = "node-1"
+	if _, err := client.CoreV1().Pods(testNamespace).Update(ctx, pod, metav1.UpdateOptions{}); err != nil {
+		t.Fatal(err)
+	}
+
+	rt.summary = func(ctx context.Context, node string) ([]byte, error) {
+		if node != "node-1" {
+			t.Errorf("summary of node %s, want node-1", node)
+		}
+		return []byte(`{"pods": [
+			{"podRef": {"name": "other", "namespace": "` + testNamespace + `"}, "containers": [{"name": "builder"}]},
+			{"podRef": {"name": "` + pod.Name + `", "namespace": "` + testNamespace + `"},
+			 "network": {"rxBytes": 100, "txBytes": 200},
+			 "containers": [{"name": "builder",
+				"cpu": {"usageCoreNanoSeconds": 2500000000},
+				"memory": {"workingSetBytes": 1048576},
+				"rootfs": {"usedBytes": 4096}}]}
+		]}`), nil
+	}
+	got, err := rt.Stats(ctx, id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := Sample{MemoryBytes: 1048576, CPUSeconds: 2.5, NetworkRxBytes: 100, NetworkTxBytes: 200, DiskBytes: 4096}
+	if got != want {
+		t.Errorf("Stats = %+v, want %+v", got, want)
+	}
+}
+
+func TestKubernetesRuntimeTotalCapacity(t *testing.T) {
+	rt, client, _ := newTestKubernetesRuntime(t)
+	addNode := func(name string, labels map[string]string, ready corev1.ConditionStatus, unschedulable bool) {
+		node := &corev1.Node{
+			ObjectMeta: metav1.ObjectMeta{Name: name, Labels: labels},
+			Spec:       corev1.NodeSpec{Unschedulable: unschedulable},
+			Status: corev1.NodeStatus{
+				Allocatable: corev1.ResourceList{
+					corev1.ResourceMemory: resource.MustParse("4Gi"),
+					corev1.ResourceCPU:    resource.MustParse("2"),
+				},
+				Conditions: []corev1.NodeCondition{{Type: corev1.NodeReady, Status: ready}},
+			},
+		}
+		if _, err := client.CoreV1().Nodes().Create(context.Background(), node, metav1.CreateOptions{}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	builds := map[string]string{"pool": "builds"}
+	addNode("build-1", builds, corev1.ConditionTrue, false)
+	addNode("build-2", builds, corev1.ConditionTrue, false)
+	addNode("not-ready", builds, corev1.ConditionFalse, false)
+	addNode("cordoned", builds, corev1.ConditionTrue, true)
+	addNode("other-pool", map[string]string{"pool": "web"}, corev1.ConditionTrue, false)
+
+	memory, cpu := rt.TotalCapacity()
+	if memory != 8*GB || cpu != 4000 {
+		t.Errorf("TotalCapacity = %s, %d millicores, want 8GiB, 4000 millicores", formatBytes(memory), cpu)
+	}
+}
+
+func TestKubernetesRuntimeWaitTimesOut(t *testing.T) {
+	rt, client, cfg := newTestKubernetesRuntime(t)
+	id, _ := rt.Create(context.Background(), testContainerSpec(cfg))
+	addPod(t, client, id, corev1.PodRunning, nil)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if _, err := rt.Wait(ctx, id); err != context.DeadlineExceeded {
+		t.Errorf("Wait = %v, want deadline exceeded", err)
+	}
+}
+
+func TestKubernetesRuntimeStreamsLogs(t *testing.T) {
+	rt, client, cfg := newTestKubernetesRuntime(t)
+	ctx := context.Background()
+	id, _ := rt.Create(ctx, testContainerSpec(cfg))
+	addPod(t, client, id, corev1.PodRunning, nil)
+	collector := logcollector.New(testBuildID, nil)
+
+	rt.StreamLogs(ctx, id, collector)
+
+	// The fake clientset serves "fake logs" for every pod
+	data, _ := collector.ToJSONL()
+	if !strings.Contains(string(data), "fake logs") {
+		t.Errorf("collected logs = %s, want the pod logs", data)
+	}
+}
+
+func TestKubernetesRuntimeStopDeletesJob(t *testing.T) {
+	rt, client, cfg := newTestKubernetesRuntime(t)
+	ctx := context.Background()
+	id, _ := rt.Create(ctx, testContainerSpec(cfg))
+
+	if err := rt.Stop(ctx, id); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := client.BatchV1().Jobs(testNamespace).Get(ctx, id, metav1.GetOptions{}); !apierrors.IsNotFound(err) {
+		t.Errorf("job still exists after Stop: %v", err)
+	}
+	// Stopping a job that is already gone is not an error
+	if err := rt.Stop(ctx, id); err != nil {
+		t.Errorf("second Stop = %v", err)
+	}
+}
@@ -17,6 +17,7 @@ type SystemLimits struct {
 	MaxCPUPercent    int
 	MaxBuildDuration int // seconds
 	MaxArtifactSize  int64
+	MaxDiskBytes     int64
 
 	// Fixed system limits
 	ContainerPidsLimit int64
@@ -33,6 +34,12 @@ type JobLimits struct {
 	BuildDuration    int   // seconds
 	MaxArtifactSize  int64
 	WarnArtifactSize int64
+	DiskBytes        int64 // writable layer plus output dir
+}
+
+// MilliCPUs returns the CPU limit in millicores (1000 = 1 CPU).
+func (j JobLimits) MilliCPUs() int64 {
+	return j.CPUQuota * 1000 / max(j.CPUPeriod, 1)
 }
 
 // Limits contains all configurable limits for the worker
@@ -52,6 +59,7 @@ func DefaultLimits() Limits {
 			MaxCPUPercent:    400,         // 4 CPUs max
 			MaxBuildDuration: 3600,        // 1 hour max
 			MaxArtifactSize:  1 * GB,      // 1GB max
+			MaxDiskBytes:     20 * GB,     // 20GB max
 			ContainerPidsLimit: 512,
 			MaxConcurrentJobs:  3,
 		},
@@ -65,6 +73,7 @@ func DefaultLimits() Limits {
 			BuildDuration:    600,        // 10 min
 			MaxArtifactSize:  100 * MB,
 			WarnArtifactSize: 50 * MB,
+			DiskBytes:        5 * GB,
 		},
 		MaxConcurrentJobs: 3,
 	}
@@ -95,6 +104,11 @@ func LoadLimitsFromEnv() Limits {
 			l.System.MaxArtifactSize = n
 		}
 	}
+	if v := os.Getenv("SYSTEM_MAX_DISK"); v != "" {
+		if n, err := strconv.ParseInt(v, 10, 64); err == nil && n > 0 {
+			l.System.MaxDiskBytes = n
+		}
+	}
 
 	// Default job limits (used when plan doesn't specify)
 	if v := os.Getenv("DEFAULT_MEMORY_LIMIT"); v != "" {
@@ -117,6 +131,11 @@ func LoadLimitsFromEnv() Limits {
 			l.DefaultJob.MaxArtifactSize = n
 		}
 	}
+	if v := os.Getenv("DEFAULT_DISK_LIMIT"); v != "" {
+		if n, err := strconv.ParseInt(v, 10, 64); err == nil && n > 0 {
+			l.DefaultJob.DiskBytes = n
+		}
+	}
 
 	if v := os.Getenv("MAX_CONCURRENT_JOBS"); v != "" {
 		if n, err := strconv.Atoi(v); err == nil && n > 0 {
@@ -170,5 +189,13 @@ func (l *Limits) GetJobLimits(planLimits *PlanLimits) JobLimits {
 		job.WarnArtifactSize = artifactBytes / 2 // 50% as warning
 	}
 
+	if planLimits.DiskMB > 0 {
+		diskBytes := int64(planLimits.DiskMB) * MB
+		if diskBytes > l.System.MaxDiskBytes {
+			diskBytes = l.System.MaxDiskBytes
+		}
+		job.DiskBytes = diskBytes
+	}
+
 	return job
 }
@@ -2,11 +2,10 @@ package logcollector
 
 import (
 	"crypto/rand"
-	"database/sql"
 	"encoding/json"
 	"fmt"
+	"io"
 	"log"
-	"strings"
 	"sync"
 	"time"
 )
@@ -20,28 +19,29 @@ type LogEntry struct {
 	UUID   string `json:"uuid"`
 }
 
-// Collector buffers log lines in memory and publishes each line via PostgreSQL NOTIFY for live SSE.
+// Publisher delivers log lines to live SSE viewers as they are appended (best-effort).
+type Publisher interface {
+	Publish(entry LogEntry)
+}
+
+// Collector buffers log lines in memory and publishes each line for live SSE.
 type Collector struct {
-	buildID string
-	db      *sql.DB
-	channel string
-	mu      sync.Mutex
-	entries []LogEntry
+	buildID   string
+	publisher Publisher
+	mu        sync.Mutex
+	entries   []LogEntry
 }
 
-// New creates a new Collector for the given build.
-func New(buildID string, db *sql.DB) *Collector {
-	// Channel name uses hex build ID (no hyphens) to be a valid PostgreSQL identifier
-	channel := "build_log_" + strings.ReplaceAll(buildID, "-", "")
+// New creates a new Collector for the given build. If publisher is nil, lines are only buffered.
+func New(buildID string, publisher Publisher) *Collector {
 	return &Collector{
-		buildID: buildID,
-		db:      db,
-		channel: channel,
-		entries: make([]LogEntry, 0, 1024),
+		buildID:   buildID,
+		publisher: publisher,
+		entries:   make([]LogEntry, 0, 1024),
 	}
 }
 
-// Append adds a log line, publishes it via PostgreSQL NOTIFY for live SSE, and buffers it.
+// Append adds a log line, publishes it for live SSE, and buffers it.
 func (c *Collector) Append(line string, source string, tag string, containerID string) {
 	entry := LogEntry{
 		Log:    line,
@@ -55,18 +55,17 @@ func (c *Collector) Append(line string, source string, tag string, containerID s
 	c.entries = append(c.entries, entry)
 	c.mu.Unlock()
 
-	// Publish to PostgreSQL NOTIFY for live SSE (best-effort)
-	data, err := json.Marshal(entry)
-	if err != nil {
-		return
+	if c.publisher != nil {
+		c.publisher.Publish(entry)
 	}
+}
 
-	// Escape single quotes in payload for SQL
-	payload := strings.ReplaceAll(string(data), "'", "''")
-
-	_, err = c.db.Exec(fmt.Sprintf("NOTIFY \"%s\", '%s'", c.channel, payload))
-	if err != nil {
-		log.Printf("Failed to publish log via NOTIFY: %v", err)
+// Close flushes lines the publisher has not delivered yet.
+func (c *Collector) Close() {
+	if closer, ok := c.publisher.(io.Closer); ok {
+		if err := closer.Close(); err != nil {
+			log.Printf("Failed to flush live logs: %v", err)
+		}
 	}
 }
 
@@ -0,0 +1,131 @@
+package logcollector
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+)
+
+const (
+	httpFlushInterval = 500 * time.Millisecond
+	httpMaxBatch      = 100
+)
+
+// HTTPPublisher posts lines to the API, which relays them to live SSE viewers. It is used by
+// workers without database access. Lines are sent in batches; if the API falls behind,
+// lines are dropped from the live view (they are still in the uploaded logs).
+type HTTPPublisher struct {
+	url     string
+	token   func() (string, error)
+	client  *http.Client
+	mu      sync.Mutex
+	closed  bool
+	entries chan LogEntry
+	done    chan struct{}
+}
+
+// NewHTTPPublisher creates a Publisher that posts batches of lines to url.
+func NewHTTPPublisher(url string, token func() (string, error)) *HTTPPublisher {
+	p := &HTTPPublisher{
+		url:     url,
+		token:   token,
+		client:  &http.Client{Timeout: 10 * time.Second},
+		entries: make(chan LogEntry, 1024),
+		done:    make(chan struct{}),
+	}
+	go p.run()
+	return p
+}
+
+// Publish queues the entry for the next batch. Entries published after Close are dropped.
+func (p *HTTPPublisher) Publish(entry LogEntry) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.closed {
+		return
+	}
+	select {
+	case p.entries <- entry:
+	default:
+	}
+}
+
+// Close sends the remaining lines and stops the publisher.
+func (p *HTTPPublisher) Close() error {
+	p.mu.Lock()
+	if !p.closed {
+		p.closed = true
+		close(p.entries)
+	}
+	p.mu.Unlock()
+	<-p.done
+	return nil
+}
+
+func (p *HTTPPublisher) run() {
+	defer close(p.done)
+
+	ticker := time.NewTicker(httpFlushInterval)
+	defer ticker.Stop()
+
+	batch := make([]LogEntry, 0, httpMaxBatch)
+	flush := func() {
+		if len(batch) == 0 {
+			return
+		}
+		if err := p.send(batch); err != nil {
+			log.Printf("Failed to publish logs via API: %v", err)
+		}
+		batch = batch[:0]
+	}
+
+	for {
+		select {
+		case entry, ok := <-p.entries:
+			if !ok {
+				flush()
+				return
+			}
+			batch = append(batch, entry)
+			if len(batch) >= httpMaxBatch {
+				flush()
+			}
+		case <-ticker.C:
+			flush()
+		}
+	}
+}
+
+func (p *HTTPPublisher) send(batch []LogEntry) error {
+	data, err := json.Marshal(batch)
+	if err != nil {
+		return err
+	}
+	token, err := p.token()
+	if err != nil {
+		return fmt.Errorf("get access token: %w", err)
+	}
+
+	req, err := http.NewRequest(http.MethodPost, p.url, bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "Bearer "+token)
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "spa-build-worker")
+
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return fmt.Errorf("status %d", resp.StatusCode)
+	}
+	return nil
+}
@@ -0,0 +1,37 @@
+package logcollector
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log"
+	"strings"
+)
+
+// PostgresPublisher publishes each line via PostgreSQL NOTIFY on the build's log channel.
+type PostgresPublisher struct {
+	db      *sql.DB
+	channel string
+}
+
+// NewPostgresPublisher creates a Publisher for the given build.
+func NewPostgresPublisher(db *sql.DB, buildID string) *PostgresPublisher {
+	// Channel name uses hex build ID (no hyphens) to be a valid PostgreSQL identifier
+	return &PostgresPublisher{db: db, channel: "build_log_" + strings.ReplaceAll(buildID, "-", "")}
+}
+
+// Publish sends the entry via PostgreSQL NOTIFY.
+func (p *PostgresPublisher) Publish(entry LogEntry) {
+	data, err := json.Marshal(entry)
+	if err != nil {
+		return
+	}
+
+	// Escape single quotes in payload for SQL
+	payload := strings.ReplaceAll(string(data), "'", "''")
+
+	_, err = p.db.Exec(fmt.Sprintf("NOTIFY \"%s\", '%s'", p.channel, payload))
+	if err != nil {
+		log.Printf("Failed to publish log via NOTIFY: %v", err)
+	}
+}
@@ -1,16 +1,15 @@
 package main
 
 import (
-	"bufio"
 	"context"
 	"database/sql"
-	"encoding/binary"
 	"encoding/json"
+	"errors"
 	"flag"
 	"fmt"
-	"io"
 	"log"
-	"mycrocloud/worker/api_client"
+	"math"
+	"mycrocloud/worker/jobqueue"
 	"mycrocloud/worker/logcollector"
 	"mycrocloud/worker/uploader"
 	"os"
@@ -18,66 +17,16 @@ import (
 	"path/filepath"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"syscall"
 	"time"
 
-	"github.com/docker/docker/api/types/container"
-	"github.com/docker/docker/api/types/mount"
-	"github.com/docker/docker/client"
-	"github.com/lib/pq"
+	_ "github.com/lib/pq"
 )
 
 // Global limits loaded from environment
 var limits Limits
 
-// streamContainerLogs reads the Docker multiplexed log stream and feeds each line to the collector.
-func streamContainerLogs(ctx context.Context, cli *client.Client, containerID string, collector *logcollector.Collector) {
-	reader, err := cli.ContainerLogs(ctx, containerID, container.LogsOptions{
-		ShowStdout: true,
-		ShowStderr: true,
-		Follow:     true,
-		Timestamps: false,
-	})
-	if err != nil {
-		log.Printf("Failed to attach to container logs: %v", err)
-		return
-	}
-	defer reader.Close()
-
-	// Docker multiplexed stream: 8-byte header per frame
-	// byte 0: stream type (1=stdout, 2=stderr)
-	// bytes 4-7: frame size (big-endian uint32)
-	hdr := make([]byte, 8)
-	for {
-		if _, err := io.ReadFull(reader, hdr); err != nil {
-			break
-		}
-		streamType := hdr[0]
-		size := binary.BigEndian.Uint32(hdr[4:8])
-		if size == 0 {
-			continue
-		}
-		payload := make([]byte, size)
-		if _, err := io.ReadFull(reader, payload); err != nil {
-			break
-		}
-
-		source := "stdout"
-		if streamType == 2 {
-			source = "stderr"
-		}
-
-		// Split payload into lines (a single frame may contain multiple lines)
-		scanner := bufio.NewScanner(strings.NewReader(string(payload)))
-		for scanner.Scan() {
-			line := scanner.Text()
-			if line != "" {
-				collector.Append(line, source, "app.builder", containerID)
-			}
-		}
-	}
-}
-
 // uploadBuildLogs uploads the collected build logs to the API.
 func uploadBuildLogs(buildMsg BuildMessage, collector *logcollector.Collector, cfg Config) {
 	if buildMsg.LogsUploadPath == "" || collector.Count() == 0 {
@@ -90,12 +39,7 @@ func uploadBuildLogs(buildMsg BuildMessage, collector *logcollector.Collector, c
 		return
 	}
 
-	token, err := api_client.GetAccessToken(api_client.Config{
-		Domain:       cfg.Auth0.Domain,
-		ClientID:     cfg.Auth0.ClientID,
-		ClientSecret: cfg.Auth0.ClientSecret,
-		Audience:     cfg.Auth0.Audience,
-	})
+	token, err := tokenSource(cfg).Token()
 	if err != nil {
 		log.Printf("Failed to get token for log upload: %v", err)
 		return
@@ -109,51 +53,101 @@ func uploadBuildLogs(buildMsg BuildMessage, collector *logcollector.Collector, c
 	}
 }
 
-// claimJob attempts to claim a pending job from the build_queue table.
-// Returns the job payload JSON or empty string if no jobs available.
-func claimJob(ctx context.Context, db *sql.DB, workerID string) (string, error) {
-	var payload string
-	err := db.QueryRowContext(ctx, `
-		UPDATE build_queue SET status = 'claimed', claimed_by = $1, claimed_at = now()
-		WHERE id = (SELECT id FROM build_queue WHERE status = 'pending' ORDER BY created_at LIMIT 1 FOR UPDATE SKIP LOCKED)
-		RETURNING payload::text
-	`, workerID).Scan(&payload)
+// ProcessJob processes a build job and returns its outcome, plus an error if it fails.
+// Infrastructure failures before the container starts return JobRetrying while the job
+// has attempts left, and jobqueue.Dead once they are exhausted.
+func ProcessJob(ctx context.Context, job jobqueue.Job, queue jobqueue.Queue, rt BuildRuntime, logs func(buildID string) logcollector.Publisher, cfg Config) (jobqueue.Result, error) {
+	return processJob(ctx, job, queue, rt, nil, logs, cfg)
+}
 
-	if err == sql.ErrNoRows {
-		return "", nil
-	}
-	if err != nil {
-		return "", err
-	}
-	return payload, nil
+// ResumeJob takes over a build whose container was started before the worker restarted:
+// it waits for the container, then reports the outcome as ProcessJob would.
+func ResumeJob(ctx context.Context, job jobqueue.Job, queue jobqueue.Queue, rt BuildRuntime, c Container, logs func(buildID string) logcollector.Publisher, cfg Config) (jobqueue.Result, error) {
+	return processJob(ctx, job, queue, rt, &c, logs, cfg)
 }
 
-// ProcessJob processes a build job and returns an error if it fails
-func ProcessJob(ctx context.Context, jsonString string, db *sql.DB, cfg Config) (retErr error) {
+// processJob runs the job in a new build container, or in resumed if it is not nil.
+func processJob(ctx context.Context, job jobqueue.Job, queue jobqueue.Queue, rt BuildRuntime, resumed *Container, logs func(buildID string) logcollector.Publisher, cfg Config) (result jobqueue.Result, retErr error) {
 	var buildMsg BuildMessage
-	if err := json.Unmarshal([]byte(jsonString), &buildMsg); err != nil {
-		return err
-	}
 
 	// Ensure a final status is always published, even on panic.
-	// Early-return errors (before the container starts) don't publish a status —
-	// those builds are cleaned up by the orphan cleanup service in the API.
+	// Jobs that will be retried don't publish a status, the next attempt does.
 	finalStatusPublished := false
+	// Set once the build container has exited, and reported with the final status
+	var usage *Usage
 	defer func() {
 		if r := recover(); r != nil {
 			log.Printf("Panic in ProcessJob for build %s: %v", buildMsg.BuildId, r)
 			retErr = fmt.Errorf("panic: %v", r)
 		}
-		if !finalStatusPublished && buildMsg.BuildId != "" {
+		requeued := result.Status == JobRetrying || result.Status == JobRequeued
+		if !finalStatusPublished && !requeued && buildMsg.BuildId != "" {
+			status := BuildStatusChangedEventMessage{
+				BuildId:     buildMsg.BuildId,
+				Status:      Failed,
+				FailureCode: FailureInternal,
+			}
+			if retErr != nil {
+				status.FailureReason = retErr.Error()
+			}
+			publishBuildStatus(buildMsg, status, cfg)
+		}
+		if result.Status == "" {
+			result = jobqueue.Result{Status: jobqueue.Failed}
+			if retErr != nil {
+				result.FailureReason = retErr.Error()
+			}
+		}
+		if usage != nil {
+			result.BillableSeconds = int(math.Round(usage.DurationSeconds))
+		}
+	}()
+
+	// Only run what the API signed; nothing from the payload is trusted until it is verified.
+	// A resumed build was verified when it started, so the payload may have expired since.
+	verifiedAt := time.Now()
+	if resumed != nil {
+		verifiedAt = resumed.StartedAt
+	}
+	payload, err := verifyPayload(job, cfg, verifiedAt)
+	if err != nil {
+		log.Printf("Rejected job %s: %v", job.ID, err)
+		reportRejected(job, cfg)
+		return jobqueue.Result{Status: jobqueue.Rejected, FailureReason: err.Error()}, err
+	}
+
+	buildMsg, err = parseBuildMessage(payload, cfg)
+	if err != nil {
+		if buildMsg.BuildId == "" {
+			buildMsg.BuildId = job.ID
+		}
+		finalStatusPublished = true
+		reportInvalid(buildMsg, err, logs, cfg)
+		return jobqueue.Result{Status: jobqueue.Failed, FailureReason: err.Error()}, err
+	}
+
+	if cfg.Queue.SupersedePending && resumed == nil {
+		superseded, err := supersedeOlderJobs(ctx, queue, &job, cfg)
+		if err != nil {
+			log.Printf("Failed to supersede older builds: %v", err)
+		} else if superseded {
+			finalStatusPublished = true
 			publishBuildStatus(buildMsg, BuildStatusChangedEventMessage{
 				BuildId: buildMsg.BuildId,
-				Status:  Failed,
+				Status:  Superseded,
 			}, cfg)
+			return jobqueue.Result{Status: jobqueue.Superseded}, nil
 		}
-	}()
+	}
+	if cfg.Queue.SupersedeRunning && resumed == nil {
+		if err := supersedeRunningJobs(ctx, queue, &job); err != nil {
+			log.Printf("Failed to supersede running builds: %v", err)
+		}
+	}
 
-	// Create log collector for this build (uses PostgreSQL NOTIFY)
-	collector := logcollector.New(buildMsg.BuildId, db)
+	// Create log collector for this build (live lines go out via PostgreSQL NOTIFY or the API)
+	collector := logcollector.New(buildMsg.BuildId, logs(buildMsg.BuildId))
+	defer collector.Close()
 
 	// Get job-specific limits from plan (capped by system max)
 	jobLimits := limits.GetJobLimits(buildMsg.Limits)
@@ -163,14 +157,83 @@ func ProcessJob(ctx context.Context, jsonString string, db *sql.DB, cfg Config)
 		jobLimits.BuildDuration,
 		formatBytes(jobLimits.MaxArtifactSize))
 
-	log.Printf("Processing... Id: %s, RepoFullName: %s", buildMsg.BuildId, buildMsg.RepoFullName)
+	log.Printf("Processing... Id: %s, RepoFullName: %s, attempt %d/%d",
+		buildMsg.BuildId, buildMsg.RepoFullName, job.Attempt, cfg.Queue.MaxAttempts)
 	collector.Append("Processing build "+buildMsg.BuildId, "stdout", "app.worker", "")
 
-	cli, err := client.NewClientWithOpts(client.FromEnv, client.WithAPIVersionNegotiation())
-	if err != nil {
-		return err
+	// cancelled reports a build the user cancelled or a newer build superseded,
+	// with whatever logs were collected.
+	cancelled := func() (jobqueue.Result, error) {
+		status, result := Cancelled, jobqueue.Result{Status: jobqueue.Cancelled, FailureReason: "cancelled by user"}
+		if isSuperseded(ctx) || job.Superseded {
+			status, result = Superseded, jobqueue.Result{Status: jobqueue.Superseded, FailureReason: "superseded by a newer build"}
+		}
+		log.Printf("Build %s %s", buildMsg.BuildId, result.FailureReason)
+		collector.Append("Build "+result.FailureReason, "stderr", "app.worker", "")
+		uploadBuildLogs(buildMsg, collector, cfg)
+		finalStatusPublished = true
+		publishBuildStatus(buildMsg, BuildStatusChangedEventMessage{
+			BuildId: buildMsg.BuildId,
+			Status:  status,
+			Usage:   usage,
+		}, cfg)
+		return result, nil
+	}
+
+	// fail reports a build that failed, with a reason code and a message for the user in
+	// both a final log line and the status event.
+	fail := func(code, message string, exitCode *int) jobqueue.Result {
+		log.Printf("Build %s failed (%s): %s", buildMsg.BuildId, code, message)
+		collector.Append(fmt.Sprintf("Build failed (%s): %s", code, message), "stderr", "app.worker", "")
+		uploadBuildLogs(buildMsg, collector, cfg)
+		finalStatusPublished = true
+		publishBuildStatus(buildMsg, BuildStatusChangedEventMessage{
+			BuildId:       buildMsg.BuildId,
+			Status:        Failed,
+			FailureCode:   code,
+			FailureReason: message,
+			Usage:         usage,
+		}, cfg)
+		return jobqueue.Result{Status: jobqueue.Failed, ExitCode: exitCode, FailureReason: message}
+	}
+
+	// infraFailure handles errors before the build container starts. These are not the
+	// user's fault, so the job is retried until it runs out of attempts.
+	infraFailure := func(err error) (jobqueue.Result, error) {
+		if isShutdown(ctx) {
+			return jobqueue.Result{Status: JobRequeued, FailureReason: "worker shut down"}, err
+		}
+		if isCancelled(ctx) {
+			return cancelled()
+		}
+		if errors.Is(err, errNoCapacity) {
+			// Claimed while the builds placed since took the room; another worker or host may have it
+			log.Printf("No capacity for build %s, handing it back: %v", buildMsg.BuildId, err)
+			return jobqueue.Result{Status: JobRequeued, FailureReason: err.Error()}, err
+		}
+		if job.Attempt < cfg.Queue.MaxAttempts {
+			collector.Append(fmt.Sprintf("Infrastructure error, retrying (attempt %d/%d): %v",
+				job.Attempt, cfg.Queue.MaxAttempts, err), "stderr", "app.worker", "")
+			return jobqueue.Result{Status: JobRetrying, FailureReason: err.Error()}, err
+		}
+		result := fail(FailureInfrastructure, fmt.Sprintf("infrastructure error after %d attempts: %v", job.Attempt, err), nil)
+		result.Status = jobqueue.Dead
+		return result, err
+	}
+
+	// Cancellation was requested while another worker held the job, which then died or
+	// handed it back; there is no build to stop, only the outcome to report
+	if job.CancelRequested {
+		return cancelled()
+	}
+
+	// Every reclaim after an expired lease counts as an attempt. A job past its attempts
+	// keeps taking its worker down, so it is dead-lettered instead of run again.
+	if job.Attempt > cfg.Queue.MaxAttempts {
+		result := fail(FailureInfrastructure, fmt.Sprintf("the build's worker stopped responding %d times", job.Attempt-1), nil)
+		result.Status = jobqueue.Dead
+		return result, nil
 	}
-	defer cli.Close()
 
 	// Create output directory
 	log.Printf("Creating container")
@@ -180,8 +243,15 @@ func ProcessJob(ctx context.Context, jsonString string, db *sql.DB, cfg Config)
 	baseOut := cfg.BuildOutputDir
 	jobOut := filepath.Join(baseOut, jobID)
 
+	// Held until the build is over, so no janitor on the host removes the dir meanwhile
+	unlockOut, err := lockOutput(baseOut, jobID)
+	if err != nil {
+		return infraFailure(err)
+	}
+	defer unlockOut()
+
 	if err := os.MkdirAll(jobOut, 0777); err != nil {
-		return err
+		return infraFailure(err)
 	}
 	// Ensure permissions are actually 0777 regardless of umask
 	_ = os.Chmod(jobOut, 0777)
@@ -190,9 +260,9 @@ func ProcessJob(ctx context.Context, jsonString string, db *sql.DB, cfg Config)
 	log.Printf("BUILD_OUTPUT_DIR: %s", baseOut)
 	log.Printf("Job output dir: %s", jobOut)
 
-	// Check if artifact file already exists
+	// Check if artifact file already exists. A resumed build may still be writing it.
 	zipPath := filepath.Join(jobOut, buildMsg.OutDir+".zip")
-	if fileInfo, err := os.Stat(zipPath); err == nil && fileInfo.Size() > 0 {
+	if fileInfo, err := os.Stat(zipPath); resumed == nil && err == nil && fileInfo.Size() > 0 {
 		log.Printf("Artifact already exists at %s (size: %d bytes), skipping build", zipPath, fileInfo.Size())
 
 		// Verify artifact size is within limits
@@ -200,12 +270,7 @@ func ProcessJob(ctx context.Context, jsonString string, db *sql.DB, cfg Config)
 		if err == nil && !sizeCheck.ExceedsHard {
 			// Upload existing artifact
 			if cfg.API.UploadArtifacts {
-				token, err := api_client.GetAccessToken(api_client.Config{
-					Domain:       cfg.Auth0.Domain,
-					ClientID:     cfg.Auth0.ClientID,
-					ClientSecret: cfg.Auth0.ClientSecret,
-					Audience:     cfg.Auth0.Audience,
-				})
+				token, err := tokenSource(cfg).Token()
 				if err != nil {
 					log.Printf("Failed to get access token for existing artifact: %v", err)
 					// Continue with rebuild
@@ -225,7 +290,7 @@ func ProcessJob(ctx context.Context, jsonString string, db *sql.DB, cfg Config)
 							Status:     Done,
 							ArtifactId: artifactId,
 						}, cfg)
-						return nil
+						return jobqueue.Result{Status: jobqueue.Succeeded, ArtifactId: artifactId}, nil
 					}
 				}
 			}
@@ -233,122 +298,148 @@ func ProcessJob(ctx context.Context, jsonString string, db *sql.DB, cfg Config)
 		log.Printf("Existing artifact invalid or upload failed, proceeding with rebuild")
 	}
 
-	mounts := []mount.Mount{
-		{
-			Type:   mount.TypeBind,
-			Source: jobOut,
-			Target: "/output",
-		},
-	}
-
-	// Get secure host config with resource limits
-	hostConfig := GetSecureHostConfig(jobLimits)
-	hostConfig.Mounts = mounts
-	hostConfig.AutoRemove = cfg.Builder.AutoRemove
-
-	// Prepare environment variables for the container
-	envVars := []string{
-		"REPO_URL=" + buildMsg.CloneUrl,
-		"WORK_DIR=" + buildMsg.Directory,
-		"OUT_DIR=" + buildMsg.OutDir,
-		"INSTALL_CMD=" + buildMsg.InstallCommand,
-		"BUILD_CMD=" + buildMsg.BuildCommand,
-	}
-
-	if buildMsg.NodeVersion != "" {
-		envVars = append(envVars, "NODE_VERSION="+buildMsg.NodeVersion)
-	}
-
-	if len(buildMsg.EnvVars) > 0 {
-		envVarsJSON, err := json.Marshal(buildMsg.EnvVars)
+	var containerID string
+	quotaLimited := false // the build's time limit is what is left of the monthly quota
+	started := time.Now()
+	if resumed != nil {
+		containerID = resumed.ID
+		started = resumed.StartedAt
+		log.Printf("Reattached to container %s of build %s", containerID, buildMsg.BuildId)
+		collector.Append("Worker restarted, reattached to the running build", "stdout", "app.worker", "")
+		for _, m := range resumed.Mounts {
+			if m.Target == containerSecretsDir && strings.HasPrefix(m.Source, cfg.Builder.SecretsDir+string(filepath.Separator)) {
+				defer os.RemoveAll(m.Source)
+			}
+		}
+		defer rt.Release(containerID)
+	} else {
+		// Builds can't start once the tenant's monthly build minutes are used up, and can
+		// only run for what is left of them
+		remaining, hasQuota, err := buildQuota(ctx, queue, buildMsg, time.Now())
 		if err != nil {
-			log.Printf("Failed to marshal env vars: %v", err)
-		} else {
-			envVars = append(envVars, "ENV_VARS="+string(envVarsJSON))
+			return infraFailure(err)
+		}
+		if hasQuota && remaining <= 0 {
+			return fail(FailureQuotaExceeded, quotaExceededMessage(buildMsg, time.Now()), nil), nil
+		}
+		if hasQuota && remaining < int64(jobLimits.BuildDuration) {
+			log.Printf("Build %s limited to the %ds left of its monthly quota", buildMsg.BuildId, remaining)
+			collector.Append(fmt.Sprintf("Only %d of this month's build minutes are left; the build will be stopped when they run out",
+				(remaining+59)/60), "stderr", "app.worker", "")
+			jobLimits.BuildDuration = int(remaining)
+			quotaLimited = true
 		}
-	}
 
-	resp, err := cli.ContainerCreate(ctx,
-		&container.Config{
-			Image:  buildMsg.BuilderImage,
-			Tty:    false,
-			Env:    envVars,
-			Labels: map[string]string{"build_id": buildMsg.BuildId},
-		},
-		hostConfig,
-		nil, nil, "")
-	if err != nil {
-		return err
-	}
+		id, removeSecrets, err := createBuildContainer(ctx, buildMsg, jobOut, jobLimits, rt, cfg)
+		if errors.Is(err, errInvalidPayload) {
+			return fail(FailureInvalidPayload, err.Error(), nil), err
+		}
+		if err != nil {
+			return infraFailure(err)
+		}
+		defer removeSecrets()
+		containerID = id
+		defer rt.Release(containerID)
+
+		// Start the container
+		log.Printf("Starting container")
+		started = time.Now()
+		if err := rt.Start(ctx, containerID); err != nil {
+			return infraFailure(err)
+		}
 
-	// Start the container
-	log.Printf("Starting container")
-	if err := cli.ContainerStart(ctx, resp.ID, container.StartOptions{}); err != nil {
-		return err
+		publishBuildStatus(buildMsg, BuildStatusChangedEventMessage{
+			BuildId:     buildMsg.BuildId,
+			Status:      Started,
+			ContainerId: containerID,
+		}, cfg)
 	}
 
-	publishBuildStatus(buildMsg, BuildStatusChangedEventMessage{
-		BuildId:     buildMsg.BuildId,
-		Status:      Started,
-		ContainerId: resp.ID,
-	}, cfg)
-
-	// Stream container logs in background
+	// Stream container logs in background. The stream outlives a cancelled job so the
+	// logs written while the container is being stopped are still collected.
+	logsCtx, stopLogs := context.WithCancel(context.WithoutCancel(ctx))
+	defer stopLogs()
 	logsDone := make(chan struct{})
 	go func() {
 		defer close(logsDone)
-		streamContainerLogs(ctx, cli, resp.ID, collector)
+		rt.StreamLogs(logsCtx, containerID, collector)
 	}()
 
+	// stopContainer stops the build container and waits for its log stream to drain.
+	stopContainer := func() {
+		stopCtx, stopCancel := context.WithTimeout(context.Background(), 10*time.Second)
+		_ = rt.Stop(stopCtx, containerID)
+		stopCancel()
+		select {
+		case <-logsDone:
+		case <-time.After(10 * time.Second):
+			stopLogs()
+			<-logsDone
+		}
+	}
+
 	// Wait for container with timeout
 	jobTimeout := time.Duration(jobLimits.BuildDuration) * time.Second
-	timeoutCtx, cancel := context.WithTimeout(ctx, jobTimeout)
+	deadline := time.Now().Add(jobTimeout)
+	if resumed != nil {
+		// The build has been running since before the restart
+		deadline = resumed.StartedAt.Add(jobTimeout)
+	}
+	timeoutCtx, cancel := context.WithDeadline(ctx, deadline)
 	defer cancel()
 
-	statusCh, errCh := cli.ContainerWait(timeoutCtx, resp.ID, container.WaitConditionNotRunning)
-
-	var containerFailed bool
-	select {
-	case err := <-errCh:
-		if err != nil {
-			// Try to stop container if timeout
-			if timeoutCtx.Err() == context.DeadlineExceeded {
-				log.Printf("Job timeout, stopping container %s", resp.ID)
-				collector.Append("Build timed out", "stderr", "app.worker", "")
-				stopCtx, stopCancel := context.WithTimeout(context.Background(), 10*time.Second)
-				_ = cli.ContainerStop(stopCtx, resp.ID, container.StopOptions{})
-				stopCancel()
-			}
-			// Wait for log streaming to finish
-			<-logsDone
-			uploadBuildLogs(buildMsg, collector, cfg)
-			finalStatusPublished = true
-			publishBuildStatus(buildMsg, BuildStatusChangedEventMessage{
-				BuildId: buildMsg.BuildId,
-				Status:  Failed,
-			}, cfg)
-			return err
+	meter := startMeter(rt, containerID, jobOut, jobLimits, collector, started, cfg.StatsInterval(), func() {
+		// Wait returns once the container is gone, and the build is failed for its disk usage
+		stopCtx, stopCancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer stopCancel()
+		if err := rt.Stop(stopCtx, containerID); err != nil {
+			log.Printf("Failed to stop container %s over its disk limit: %v", containerID, err)
+		}
+	})
+	exit, err := rt.Wait(timeoutCtx, containerID)
+	usage = meter.finish()
+	if err != nil {
+		if isShutdown(ctx) {
+			log.Printf("Worker shutting down, stopping container %s and requeueing build", containerID)
+			collector.Append("Worker shutting down, the build will be restarted", "stderr", "app.worker", "")
+			stopContainer()
+			return jobqueue.Result{Status: JobRequeued, FailureReason: "worker shut down"}, nil
+		}
+		if isCancelled(ctx) {
+			log.Printf("Build cancelled, stopping container %s", containerID)
+			stopContainer()
+			return cancelled()
 		}
 
-	case status := <-statusCh:
-		log.Printf("Container finished with status %d", status.StatusCode)
-		if status.StatusCode != 0 {
-			containerFailed = true
+		// Try to stop container if timeout
+		if timeoutCtx.Err() == context.DeadlineExceeded {
+			log.Printf("Job timeout, stopping container %s", containerID)
+			stopContainer()
+			if quotaLimited {
+				return fail(FailureQuotaExceeded, "the monthly build minutes quota ran out during the build", nil), err
+			}
+			return fail(FailureTimeout, fmt.Sprintf("the build ran past its time limit of %s", jobTimeout), nil), err
 		}
+		// Wait for log streaming to finish
+		stopLogs()
+		<-logsDone
+		return fail(FailureInfrastructure, "container wait failed: "+err.Error(), nil), err
 	}
+	log.Printf("Container finished with status %d, peak memory %s, %.1fs CPU in %.1fs",
+		exit.ExitCode, formatBytes(int64(usage.PeakMemoryBytes)), usage.CPUSeconds, usage.DurationSeconds)
+	exitCode := exit.ExitCode
 
 	// Wait for log streaming to finish
 	<-logsDone
 
-	if containerFailed {
-		collector.Append("Build failed (non-zero exit code)", "stderr", "app.worker", "")
-		uploadBuildLogs(buildMsg, collector, cfg)
-		finalStatusPublished = true
-		publishBuildStatus(buildMsg, BuildStatusChangedEventMessage{
-			BuildId: buildMsg.BuildId,
-			Status:  Failed,
-		}, cfg)
-		return nil // Job processed, but build failed
+	if exit.DiskLimitExceeded || meter.exceededDisk() {
+		return fail(FailureDiskLimitExceeded, fmt.Sprintf("disk limit exceeded: the build wrote more than its limit of %s",
+			formatBytes(jobLimits.DiskBytes)), &exitCode), nil
+	}
+	if exitCode != 0 || exit.OOMKilled {
+		// Job processed, but build failed
+		code, message := exitFailure(exit, *usage, jobOut, buildMsg, jobLimits)
+		return fail(code, message, &exitCode), nil
 	}
 
 	// Upload artifacts
@@ -363,50 +454,27 @@ func ProcessJob(ctx context.Context, jsonString string, db *sql.DB, cfg Config)
 		// Check artifact size
 		zipPath := filepath.Join(jobOut, buildMsg.OutDir+".zip")
 		sizeCheck, err := CheckArtifactSize(zipPath, jobLimits)
-		if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return fail(FailureOutputMissing, "the build did not produce an artifact", &exitCode), err
+		} else if err != nil {
 			log.Printf("Warning: artifact size check failed: %v", err)
 		} else if sizeCheck.ExceedsHard {
-			log.Printf("Artifact size exceeds hard limit: %s", sizeCheck.Message)
-			collector.Append("Artifact size exceeds limit: "+sizeCheck.Message, "stderr", "app.worker", "")
-			uploadBuildLogs(buildMsg, collector, cfg)
-			finalStatusPublished = true
-			publishBuildStatus(buildMsg, BuildStatusChangedEventMessage{
-				BuildId: buildMsg.BuildId,
-				Status:  Failed,
-			}, cfg)
-			return fmt.Errorf("artifact too large: %s", sizeCheck.Message)
+			return fail(FailureArtifactTooLarge, "artifact too large: "+sizeCheck.Message, &exitCode),
+				fmt.Errorf("artifact too large: %s", sizeCheck.Message)
 		} else if sizeCheck.ExceedsSoft {
 			log.Printf("Warning: %s", sizeCheck.Message)
 		}
 
-		token, err := api_client.GetAccessToken(api_client.Config{
-			Domain:       cfg.Auth0.Domain,
-			ClientID:     cfg.Auth0.ClientID,
-			ClientSecret: cfg.Auth0.ClientSecret,
-			Audience:     cfg.Auth0.Audience,
-		})
+		token, err := tokenSource(cfg).Token()
 		if err != nil {
-			collector.Append("Failed to get access token: "+err.Error(), "stderr", "app.worker", "")
-			uploadBuildLogs(buildMsg, collector, cfg)
-			finalStatusPublished = true
-		publishBuildStatus(buildMsg, BuildStatusChangedEventMessage{
-				BuildId: buildMsg.BuildId,
-				Status:  Failed,
-			}, cfg)
-			return err
+			return fail(FailureUploadFailed, "failed to get access token: "+err.Error(), &exitCode), err
 		}
 
 		collector.Append("Uploading artifact...", "stdout", "app.worker", "")
 		uploadURL := strings.TrimSuffix(cfg.API.BaseURL, "/") + buildMsg.ArtifactsUploadPath
 		artifactId, err := uploader.UploadArtifacts(uploadURL, jobOut, buildMsg.OutDir, token, "spa-build-worker")
 		if err != nil {
-			collector.Append("Artifact upload failed: "+err.Error(), "stderr", "app.worker", "")
-			uploadBuildLogs(buildMsg, collector, cfg)
-			publishBuildStatus(buildMsg, BuildStatusChangedEventMessage{
-				BuildId: buildMsg.BuildId,
-				Status:  Failed,
-			}, cfg)
-			return err
+			return fail(FailureUploadFailed, "artifact upload failed: "+err.Error(), &exitCode), err
 		}
 
 		// Cleanup job output directory after successful upload
@@ -419,23 +487,105 @@ func ProcessJob(ctx context.Context, jsonString string, db *sql.DB, cfg Config)
 		collector.Append("Build completed successfully", "stdout", "app.worker", "")
 		uploadBuildLogs(buildMsg, collector, cfg)
 
+		finalStatusPublished = true
 		publishBuildStatus(buildMsg, BuildStatusChangedEventMessage{
 			BuildId:    buildMsg.BuildId,
 			Status:     Done,
 			ArtifactId: artifactId,
+			Usage:      usage,
 		}, cfg)
+		result = jobqueue.Result{Status: jobqueue.Succeeded, ExitCode: &exitCode, ArtifactId: artifactId}
 	} else {
 		collector.Append("Build completed (upload disabled)", "stdout", "app.worker", "")
 		uploadBuildLogs(buildMsg, collector, cfg)
 
+		finalStatusPublished = true
 		publishBuildStatus(buildMsg, BuildStatusChangedEventMessage{
 			BuildId: buildMsg.BuildId,
 			Status:  Done,
+			Usage:   usage,
 		}, cfg)
+		result = jobqueue.Result{Status: jobqueue.Succeeded, ExitCode: &exitCode}
 	}
 
 	log.Printf("Finished processing. Id: %s", buildMsg.BuildId)
-	return nil
+	return result, nil
+}
+
+// createBuildContainer creates the build container with the job's environment, secrets and
+// output directory. removeSecrets deletes the secrets file once the build is over.
+// Invalid secret env vars are reported as errInvalidPayload.
+func createBuildContainer(ctx context.Context, buildMsg BuildMessage, jobOut string, jobLimits JobLimits, rt BuildRuntime, cfg Config) (containerID string, removeSecrets func(), err error) {
+	removeSecrets = func() {}
+	mounts := []Mount{
+		{
+			Source: jobOut,
+			Target: "/output",
+		},
+	}
+
+	// Prepare environment variables for the container
+	envVars := []string{
+		"REPO_URL=" + buildMsg.CloneUrl,
+		"WORK_DIR=" + buildMsg.Directory,
+		"OUT_DIR=" + buildMsg.OutDir,
+		"INSTALL_CMD=" + buildMsg.InstallCommand,
+		"BUILD_CMD=" + buildMsg.BuildCommand,
+	}
+
+	if buildMsg.NodeVersion != "" {
+		envVars = append(envVars, "NODE_VERSION="+buildMsg.NodeVersion)
+	}
+
+	if len(buildMsg.EnvVars) > 0 {
+		envVarsJSON, err := json.Marshal(buildMsg.EnvVars)
+		if err != nil {
+			log.Printf("Failed to marshal env vars: %v", err)
+		} else {
+			envVars = append(envVars, "ENV_VARS="+string(envVarsJSON))
+		}
+	}
+
+	// Secrets go through a file on a tmpfs so they don't show up in docker inspect.
+	// Another worker may have the key, so a failure to decrypt is retried.
+	secretEnvVars, err := decryptSecrets(buildMsg, cfg)
+	if err != nil {
+		return "", removeSecrets, err
+	}
+	if err := validateEnvVars(secretEnvVars); err != nil {
+		return "", removeSecrets, fmt.Errorf("%w: secret_env_vars: %v", errInvalidPayload, err)
+	}
+	if len(secretEnvVars) > 0 {
+		secretsDir, err := writeSecretsFile(secretEnvVars, cfg)
+		if err != nil {
+			return "", removeSecrets, err
+		}
+		removeSecrets = func() {
+			if err := os.RemoveAll(secretsDir); err != nil {
+				log.Printf("Warning: failed to remove secrets dir %s: %v", secretsDir, err)
+			}
+		}
+		mounts = append(mounts, Mount{
+			Source:   secretsDir,
+			Target:   containerSecretsDir,
+			ReadOnly: true,
+		})
+		envVars = append(envVars, "SECRETS_FILE="+containerSecretsFile)
+	}
+
+	containerID, err = rt.Create(ctx, ContainerSpec{
+		Image:      buildMsg.BuilderImage,
+		Env:        envVars,
+		Labels:     map[string]string{"build_id": buildMsg.BuildId, "worker_id": cfg.Worker.ID},
+		Mounts:     mounts,
+		Limits:     jobLimits,
+		AutoRemove: cfg.Builder.AutoRemove,
+	})
+	if err != nil {
+		removeSecrets()
+		return "", func() {}, err
+	}
+	return containerID, removeSecrets, nil
 }
 
 func main() {
@@ -459,6 +609,13 @@ func main() {
 		limits.DefaultJob.CPUQuota/1000,
 		limits.DefaultJob.BuildDuration,
 		formatBytes(limits.DefaultJob.MaxArtifactSize))
+	if len(cfg.Worker.Labels) > 0 {
+		log.Printf("Worker labels: %v", cfg.Worker.Labels)
+	}
+	if !cfg.Signing.Require {
+		log.Printf("WARNING: signing.require is off, unsigned build payloads are run unverified. " +
+			"Anyone who can write to the build queue can run builds on this worker.")
+	}
 	// Setup signal handling for graceful shutdown
 	ctx, cancel := context.WithCancel(context.Background())
 	defer cancel()
@@ -466,77 +623,163 @@ func main() {
 	sigChan := make(chan os.Signal, 1)
 	signal.Notify(sigChan, syscall.SIGINT, syscall.SIGTERM)
 
-	// Connect to PostgreSQL
-	db, err := sql.Open("postgres", cfg.DatabaseURL)
+	// SIGUSR1 puts the worker in drain mode: running builds finish, no new jobs are claimed
+	drainChan := make(chan os.Signal, 1)
+	signal.Notify(drainChan, syscall.SIGUSR1)
+	var draining atomic.Bool
+
+	// Connect to PostgreSQL. The http and memory queues can run without it.
+	var db *sql.DB
+	if cfg.DatabaseURL != "" {
+		db, err = sql.Open("postgres", cfg.DatabaseURL)
+		if err != nil {
+			log.Fatalf("Failed to connect to PostgreSQL: %v", err)
+		}
+		defer db.Close()
+
+		if err := db.Ping(); err != nil {
+			log.Fatalf("Failed to ping PostgreSQL: %v", err)
+		}
+		log.Printf("Connected to PostgreSQL")
+	}
+
+	tokens := tokenSource(cfg)
+	queue, err := openQueue(db, tokens, cfg)
 	if err != nil {
-		log.Fatalf("Failed to connect to PostgreSQL: %v", err)
+		log.Fatalf("Failed to open %s job queue: %v", cfg.Queue.Driver, err)
 	}
-	defer db.Close()
+	defer queue.Close()
 
-	if err := db.Ping(); err != nil {
-		log.Fatalf("Failed to ping PostgreSQL: %v", err)
+	rt, err := openRuntime(cfg, limits)
+	if err != nil {
+		log.Fatalf("Failed to open %s runtime: %v", cfg.Runtime.Driver, err)
 	}
-	log.Printf("Connected to PostgreSQL")
+	defer rt.Close()
 
-	// Setup LISTEN for job notifications
-	listener := pq.NewListener(cfg.DatabaseURL, 10*time.Second, time.Minute, func(ev pq.ListenerEventType, err error) {
-		if err != nil {
-			log.Printf("Listener event error: %v", err)
+	var wg sync.WaitGroup
+	running := newRunningJobs()
+	admit := newAdmission(cfg, limits, rt)
+	workerID, releaseWorkerID := newWorkerID(cfg)
+	defer releaseWorkerID()
+	cfg.Worker.ID = workerID // build containers are labelled with it
+	logs := logPublisher(db, tokens, cfg)
+	worker := queueWorker(workerID, cfg)
+	hostname, _ := os.Hostname()
+
+	// Register in build_workers so the API and operators can see the fleet
+	if db != nil {
+		if err := registerWorker(ctx, db, WorkerInfo{
+			ID:         workerID,
+			Hostname:   hostname,
+			Version:    version,
+			Labels:     cfg.Worker.Labels,
+			TotalSlots: admit.slots(),
+		}); err != nil {
+			log.Fatalf("Failed to register worker: %v", err)
 		}
-	})
-	if err := listener.Listen("build_job_available"); err != nil {
-		log.Fatalf("Failed to LISTEN: %v", err)
+		log.Printf("Registered worker %s (version %s, %d slots)", workerID, version, admit.slots())
+		go runWorkerHeartbeat(ctx, db, workerID, cfg, func() WorkerStatus {
+			status := WorkerStatus{Status: "online", UsedSlots: admit.runningJobs(), RunningJobs: running.ids()}
+			if draining.Load() {
+				status.Status = "draining"
+			}
+			return status
+		})
 	}
-	defer listener.Close()
 
-	var wg sync.WaitGroup
-	jobLimit := make(chan struct{}, limits.MaxConcurrentJobs)
-	workerID, _ := os.Hostname()
-	if workerID == "" {
-		workerID = fmt.Sprintf("worker-%d", os.Getpid())
+	// runJob runs a claimed job, or the container of a resumed one, and records its outcome
+	runJob := func(job *jobqueue.Job, resumed *Container) {
+		jobLimits := admit.jobLimitsOf(job)
+		admit.reserve(jobLimits)
+
+		wg.Add(1)
+		go func() {
+			defer func() {
+				admit.release(jobLimits)
+				wg.Done()
+			}()
+
+			jobCtx := running.start(ctx, job.ID)
+			defer running.finish(job.ID)
+
+			// Keep the lease alive while the build runs
+			heartbeatCtx, stopHeartbeat := context.WithCancel(ctx)
+			go heartbeatJob(heartbeatCtx, queue, worker, job, cfg, func(cause error) { running.cancel(job.ID, cause) })
+
+			var result jobqueue.Result
+			var err error
+			if resumed != nil {
+				result, err = ResumeJob(jobCtx, *job, queue, rt, *resumed, logs, cfg)
+			} else {
+				result, err = ProcessJob(jobCtx, *job, queue, rt, logs, cfg)
+			}
+			if err != nil {
+				log.Printf("Job failed: %v", err)
+			}
+			stopHeartbeat()
+
+			// If the worker is shutting down the lease is left to expire so another worker reclaims the job
+			if ctx.Err() != nil {
+				return
+			}
+			switch result.Status {
+			case JobRetrying:
+				backoff := cfg.RetryBackoff(job.Attempt)
+				log.Printf("Retrying job %s in %v (attempt %d/%d)", job.ID, backoff, job.Attempt, cfg.Queue.MaxAttempts)
+				err = queue.Nack(ctx, worker, job, backoff, result.FailureReason)
+			case JobRequeued:
+				log.Printf("Handing job %s back to the queue", job.ID)
+				err = queue.Requeue(ctx, worker, job, result.FailureReason)
+			default:
+				err = queue.Ack(ctx, worker, job, result)
+			}
+			if err != nil {
+				log.Printf("Failed to record outcome of job %s: %v", job.ID, err)
+			}
+		}()
 	}
 
 	// Try to claim any pending jobs on startup
 	claimAndProcess := func() {
 		for {
+			if draining.Load() {
+				return
+			}
 			select {
 			case <-ctx.Done():
 				return
 			default:
 			}
 
-			// Try to get a job slot
-			select {
-			case jobLimit <- struct{}{}:
-			default:
-				// All slots full, stop claiming
+			// Only claim a job that fits in the memory and CPU left on this worker
+			budget, ok := admit.budget()
+			if !ok {
 				return
 			}
+			claimer := worker
+			claimer.Budget = budget
 
-			payload, err := claimJob(ctx, db, workerID)
+			job, err := queue.Claim(ctx, claimer)
 			if err != nil {
 				log.Printf("Failed to claim job: %v", err)
-				<-jobLimit
 				return
 			}
-			if payload == "" {
-				// No more pending jobs
-				<-jobLimit
+			if job == nil {
+				// No more pending jobs that fit
 				return
 			}
+			runJob(job, nil)
+		}
+	}
 
-			wg.Add(1)
-			go func(p string) {
-				defer func() {
-					<-jobLimit
-					wg.Done()
-				}()
+	// Take back up the builds that were running when the worker last stopped
+	for _, r := range reconcile(ctx, rt, queue, worker) {
+		runJob(r.job, &r.container)
+	}
 
-				if err := ProcessJob(ctx, p, db, cfg); err != nil {
-					log.Printf("Job failed: %v", err)
-				}
-			}(payload)
-		}
+	// Clean up after finished builds in the background
+	if !cfg.GC.Disabled {
+		go newJanitor(rt, cfg, running.ids).run(ctx)
 	}
 
 	// Claim any jobs that were pending before we started
@@ -544,47 +787,94 @@ func main() {
 
 	log.Printf(" [*] Waiting for jobs. Press Ctrl+C to exit")
 
-	// Main loop: wait for NOTIFY or shutdown
+	// Main loop: wait for a queue wakeup, the next delayed job becoming due, or shutdown
+	const pollInterval = 30 * time.Second
+	events := queue.Subscribe()
 	done := make(chan struct{})
 	go func() {
 		defer close(done)
 		for {
+			wait := pollInterval
+			if due, ok, err := queue.NextDue(ctx); err != nil {
+				log.Printf("Failed to look up delayed jobs: %v", err)
+			} else if ok {
+				wait = min(wait, max(time.Until(due), 0))
+			}
+
 			select {
 			case <-ctx.Done():
 				return
-			case <-listener.Notify:
-				// Got a notification, try to claim jobs
-				claimAndProcess()
-			case <-time.After(30 * time.Second):
-				// Periodic poll as fallback (in case NOTIFY was missed)
+			case ev, ok := <-events:
+				if !ok {
+					return
+				}
+				switch ev.Type {
+				case jobqueue.JobCancelled:
+					if running.cancel(ev.JobID, errBuildCancelled) {
+						log.Printf("Cancelling build %s", ev.JobID)
+					}
+				case jobqueue.JobSuperseded:
+					if running.cancel(ev.JobID, errBuildSuperseded) {
+						log.Printf("Cancelling superseded build %s", ev.JobID)
+					}
+				default:
+					// A job may be available, try to claim jobs
+					claimAndProcess()
+				}
+			case <-time.After(wait):
+				// A delayed job is due, or periodic poll as fallback (in case a wakeup was missed)
 				claimAndProcess()
 			}
 		}
 	}()
 
-	// Wait for shutdown signal
-	select {
-	case sig := <-sigChan:
-		log.Printf("Received signal %v, initiating graceful shutdown...", sig)
-	case <-done:
-		log.Printf("Main loop exited, initiating shutdown...")
+	// Wait for shutdown signal, entering drain mode on SIGUSR1
+	for shutdown := false; !shutdown; {
+		select {
+		case <-drainChan:
+			if !draining.Swap(true) {
+				log.Printf("Received SIGUSR1, draining: running builds will finish, no new jobs will be claimed")
+			}
+		case sig := <-sigChan:
+			log.Printf("Received signal %v, initiating graceful shutdown...", sig)
+			shutdown = true
+		case <-done:
+			log.Printf("Main loop exited, initiating shutdown...")
+			shutdown = true
+		}
 	}
 
-	// Cancel context to stop accepting new jobs
-	cancel()
+	// Stop accepting new jobs, but let running builds finish within the grace period
+	draining.Store(true)
 
-	// Wait for in-flight jobs with timeout
 	waitDone := make(chan struct{})
 	go func() {
 		wg.Wait()
 		close(waitDone)
 	}()
 
-	shutdownTimeout := 60 * time.Second
+	gracePeriod := cfg.ShutdownGracePeriod()
 	select {
 	case <-waitDone:
 		log.Printf("All jobs completed, shutting down")
-	case <-time.After(shutdownTimeout):
-		log.Printf("Shutdown timeout after %v, forcing exit", shutdownTimeout)
+	case <-time.After(gracePeriod):
+		// Builds still running are stopped and handed back to the queue for another worker
+		log.Printf("Shutdown grace period of %v exceeded, requeueing %d running job(s)", gracePeriod, len(running.ids()))
+		running.cancelAll(errWorkerShutdown)
+		select {
+		case <-waitDone:
+			log.Printf("Running jobs requeued, shutting down")
+		case <-time.After(30 * time.Second):
+			log.Printf("Timed out requeueing running jobs, forcing exit")
+		}
+	}
+	cancel()
+
+	deregisterCtx, deregisterCancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer deregisterCancel()
+	if db != nil {
+		if err := deregisterWorker(deregisterCtx, db, workerID); err != nil {
+			log.Printf("Failed to deregister worker: %v", err)
+		}
 	}
 }
@@ -0,0 +1,133 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log"
+	"mycrocloud/worker/api_client"
+	"mycrocloud/worker/jobqueue"
+	"mycrocloud/worker/logcollector"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// Non-terminal outcomes returned by ProcessJob. They are never acked;
+// the job is handed back to the queue instead.
+const (
+	JobRetrying = "retrying" // infrastructure failure, re-queued with backoff
+	JobRequeued = "requeued" // interrupted by worker shutdown or no host had room, re-queued immediately without using up an attempt
+)
+
+// openQueue creates the job queue selected by queue.driver. db is nil for the http and memory
+// drivers when no database_url is configured.
+func openQueue(db *sql.DB, tokens *api_client.TokenSource, cfg Config) (jobqueue.Queue, error) {
+	switch cfg.Queue.Driver {
+	case "postgres":
+		if db == nil {
+			return nil, fmt.Errorf("the postgres queue driver requires database_url")
+		}
+		return jobqueue.NewPostgres(db, cfg.DatabaseURL)
+	case "http":
+		if cfg.API.BaseURL == "" {
+			return nil, fmt.Errorf("the http queue driver requires api.base_url")
+		}
+		return jobqueue.NewHTTP(strings.TrimSuffix(cfg.API.BaseURL, "/")+"/build-jobs", tokens.Token), nil
+	case "memory":
+		q := jobqueue.NewMemory()
+		if cfg.Queue.MemoryJobsDir != "" {
+			if err := loadMemoryJobs(q, cfg.Queue.MemoryJobsDir); err != nil {
+				return nil, err
+			}
+		}
+		return q, nil
+	default:
+		return nil, fmt.Errorf("unknown queue driver %q", cfg.Queue.Driver)
+	}
+}
+
+// logPublisher returns how the live logs of a build are published: via PostgreSQL NOTIFY when
+// connected to the database, otherwise through the API for the http driver. Returns nil
+// (logs are only uploaded when the build ends) if neither is available.
+func logPublisher(db *sql.DB, tokens *api_client.TokenSource, cfg Config) func(buildID string) logcollector.Publisher {
+	return func(buildID string) logcollector.Publisher {
+		switch {
+		case db != nil:
+			return logcollector.NewPostgresPublisher(db, buildID)
+		case cfg.Queue.Driver == "http":
+			// The API only relays lines of jobs leased to the worker
+			logsURL := fmt.Sprintf("%s/build-jobs/%s/logs?worker_id=%s", strings.TrimSuffix(cfg.API.BaseURL, "/"), buildID, url.QueryEscape(cfg.Worker.ID))
+			return logcollector.NewHTTPPublisher(logsURL, tokens.Token)
+		default:
+			return nil
+		}
+	}
+}
+
+// loadMemoryJobs enqueues every *.json build message in dir, for running builds locally.
+func loadMemoryJobs(q *jobqueue.Memory, dir string) error {
+	paths, err := filepath.Glob(filepath.Join(dir, "*.json"))
+	if err != nil {
+		return err
+	}
+	for _, path := range paths {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		var buildMsg BuildMessage
+		if err := json.Unmarshal(data, &buildMsg); err != nil {
+			return fmt.Errorf("%s: %w", path, err)
+		}
+		id := buildMsg.BuildId
+		if id == "" {
+			id = filepath.Base(path)
+		}
+		if err := q.Enqueue(id, string(data), 0, time.Time{}); err != nil {
+			return err
+		}
+		log.Printf("Queued build %s from %s", id, path)
+	}
+	return nil
+}
+
+// queueWorker returns how this worker identifies itself to the job queue.
+func queueWorker(workerID string, cfg Config) jobqueue.Worker {
+	return jobqueue.Worker{ID: workerID, Labels: cfg.Worker.Labels, Lease: cfg.LeaseDuration()}
+}
+
+// heartbeatJob renews the lease of an in-flight job every interval until ctx is done.
+// Transient errors are retried on the next tick; if the lease was lost the loop stops.
+// onCancel is called with the cancellation cause if cancellation was requested, as a fallback for a missed wakeup.
+func heartbeatJob(ctx context.Context, queue jobqueue.Queue, w jobqueue.Worker, job *jobqueue.Job, cfg Config, onCancel func(cause error)) {
+	ticker := time.NewTicker(cfg.HeartbeatInterval())
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			state, err := queue.ExtendLease(ctx, w, job)
+			if err != nil {
+				if ctx.Err() == nil {
+					log.Printf("Failed to renew lease for job %s: %v", job.ID, err)
+				}
+				continue
+			}
+			if !state.Held {
+				log.Printf("Lost lease for job %s, it may be reclaimed by another worker", job.ID)
+				return
+			}
+			if state.Superseded {
+				onCancel(errBuildSuperseded)
+			} else if state.CancelRequested {
+				onCancel(errBuildCancelled)
+			}
+		}
+	}
+}
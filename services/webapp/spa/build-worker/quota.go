@@ -0,0 +1,34 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"mycrocloud/worker/jobqueue"
+	"time"
+)
+
+// monthStart returns the start of the calendar month t is in. Build minutes quotas reset
+// at the start of every month, in UTC.
+func monthStart(t time.Time) time.Time {
+	t = t.UTC()
+	return time.Date(t.Year(), t.Month(), 1, 0, 0, 0, 0, time.UTC)
+}
+
+// buildQuota returns how many build seconds the tenant has left this month, from the
+// usage the queue recorded for its finished jobs. ok is false if the plan has no quota.
+func buildQuota(ctx context.Context, queue jobqueue.Queue, buildMsg BuildMessage, now time.Time) (remaining int64, ok bool, err error) {
+	if buildMsg.Limits == nil || buildMsg.Limits.BuildMinutesPerMonth <= 0 {
+		return 0, false, nil
+	}
+	used, err := queue.UsedSeconds(ctx, buildMsg.TenantID(), monthStart(now))
+	if err != nil {
+		return 0, false, fmt.Errorf("look up build minutes used: %w", err)
+	}
+	return max(int64(buildMsg.Limits.BuildMinutesPerMonth)*60-used, 0), true, nil
+}
+
+// quotaExceededMessage explains to the user that the monthly build minutes are used up.
+func quotaExceededMessage(buildMsg BuildMessage, now time.Time) string {
+	return fmt.Sprintf("the monthly quota of %d build minutes is used up; it resets on %s",
+		buildMsg.Limits.BuildMinutesPerMonth, monthStart(now).AddDate(0, 1, 0).Format("January 2"))
+}
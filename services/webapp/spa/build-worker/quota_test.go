@@ -0,0 +1,75 @@
+package main
+
+import (
+	"context"
+	"mycrocloud/worker/jobqueue"
+	"strings"
+	"testing"
+	"time"
+)
+
+// queueWithUsage returns a queue in which an earlier build of the test app was billed
+// for the given seconds this month.
+func queueWithUsage(t *testing.T, seconds int) *jobqueue.Memory {
+	t.Helper()
+	q := jobqueue.NewMemory()
+	w := jobqueue.Worker{ID: "worker-1", Lease: time.Minute}
+	if err := q.Enqueue("earlier", `{"app_id":1}`, 0, time.Time{}); err != nil {
+		t.Fatal(err)
+	}
+	job, err := q.Claim(context.Background(), w)
+	if err != nil || job == nil {
+		t.Fatalf("Claim = %v, %v", job, err)
+	}
+	if err := q.Ack(context.Background(), w, job, jobqueue.Result{Status: jobqueue.Succeeded, BillableSeconds: seconds}); err != nil {
+		t.Fatal(err)
+	}
+	return q
+}
+
+func TestProcessJobQuotaExceeded(t *testing.T) {
+	api := newFakeAPI(t)
+	cfg := testConfig(api, t)
+	msg := testMessage()
+	msg.Limits = &PlanLimits{BuildMinutesPerMonth: 10}
+	rt := newFakeRuntime(fakeRun{Output: map[string]string{"dist.zip": "zip"}})
+
+	result, _ := ProcessJob(context.Background(), testJob(t, msg, 1), queueWithUsage(t, 600), rt, noLogs, cfg)
+
+	if result.Status != jobqueue.Failed || !strings.HasPrefix(result.FailureReason, "the monthly quota of 10 build minutes is used up") {
+		t.Fatalf("result = %+v, want failed for the used up quota", result)
+	}
+	if rt.created() {
+		t.Errorf("a container was created over quota")
+	}
+	if status := api.finalStatus(t); status.FailureCode != FailureQuotaExceeded {
+		t.Errorf("final status = %+v, want failure code %s", status, FailureQuotaExceeded)
+	}
+}
+
+func TestProcessJobStopsWhenQuotaRunsOut(t *testing.T) {
+	api := newFakeAPI(t)
+	cfg := testConfig(api, t)
+	msg := testMessage()
+	msg.Limits = &PlanLimits{BuildMinutesPerMonth: 1}
+	rt := newFakeRuntime(fakeRun{Hang: true})
+
+	result, _ := ProcessJob(context.Background(), testJob(t, msg, 1), queueWithUsage(t, 59), rt, noLogs, cfg)
+
+	if status := api.finalStatus(t); status.FailureCode != FailureQuotaExceeded {
+		t.Errorf("final status = %+v, want failure code %s", status, FailureQuotaExceeded)
+	}
+	if !rt.wasStopped() {
+		t.Errorf("container was not stopped when the quota ran out")
+	}
+	if result.BillableSeconds != 1 {
+		t.Errorf("billable seconds = %d, want the 1s the build ran", result.BillableSeconds)
+	}
+}
+
+func TestMonthStart(t *testing.T) {
+	now := time.Date(2026, 3, 31, 23, 30, 0, 0, time.FixedZone("UTC-2", -2*60*60))
+	if got, want := monthStart(now), time.Date(2026, 4, 1, 0, 0, 0, 0, time.UTC); !got.Equal(want) {
+		t.Errorf("monthStart = %v, want %v", got, want)
+	}
+}
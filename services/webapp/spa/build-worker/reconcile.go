@@ -0,0 +1,80 @@
+package main
+
+import (
+	"context"
+	"log"
+	"mycrocloud/worker/jobqueue"
+	"time"
+)
+
+// resumedJob is a job whose build container was left running by a previous run of the worker.
+type resumedJob struct {
+	job       *jobqueue.Job
+	container Container
+}
+
+// reconcile finds the build containers this worker started before it restarted (labelled
+// with its worker_id) and matches them to the build_queue rows it still has claimed. The
+// matched jobs are returned to be resumed. Containers of jobs the worker no longer holds
+// are stopped, since nothing would report their outcome. A job whose container never
+// started is handed back to the queue to run again.
+// Containers of other workers sharing the runtime are left alone.
+func reconcile(ctx context.Context, rt BuildRuntime, queue jobqueue.Queue, w jobqueue.Worker) []resumedJob {
+	containers, err := rt.List(ctx)
+	if err != nil {
+		log.Printf("Failed to list build containers, not reattaching to running builds: %v", err)
+		return nil
+	}
+
+	var resumed []resumedJob
+	for _, c := range containers {
+		buildID, workerID := c.Labels["build_id"], c.Labels["worker_id"]
+		if workerID != w.ID {
+			rt.Release(c.ID)
+			continue
+		}
+
+		job, err := queue.Resume(ctx, w, buildID)
+		if err != nil {
+			// Left running; if the lease expires the job is claimed again and this container is stopped then
+			log.Printf("Failed to resume build %s: %v", buildID, err)
+			rt.Release(c.ID)
+			continue
+		}
+
+		switch {
+		case job == nil:
+			if c.Running {
+				log.Printf("Stopping container %s of build %s: the build is no longer claimed by this worker", c.ID, buildID)
+			}
+			stopContainer(rt, c.ID)
+		case c.StartedAt.IsZero():
+			log.Printf("Container %s of build %s never started, handing the build back to the queue", c.ID, buildID)
+			stopContainer(rt, c.ID)
+			if err := queue.Requeue(ctx, w, job, "worker restarted before the build started"); err != nil {
+				log.Printf("Failed to hand back build %s: %v", buildID, err)
+			}
+		default:
+			if a, ok := rt.(adopter); ok {
+				if err := a.Adopt(c); err != nil {
+					// Left running, like a build that couldn't be resumed
+					log.Printf("Failed to resume build %s: %v", buildID, err)
+					continue
+				}
+			}
+			log.Printf("Resuming build %s in container %s", buildID, c.ID)
+			resumed = append(resumed, resumedJob{job: job, container: c})
+		}
+	}
+	return resumed
+}
+
+// stopContainer stops a container that no build is waiting on.
+func stopContainer(rt BuildRuntime, id string) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	if err := rt.Stop(ctx, id); err != nil {
+		log.Printf("Failed to stop container %s: %v", id, err)
+	}
+	rt.Release(id)
+}
@@ -0,0 +1,148 @@
+package main
+
+import (
+	"context"
+	"mycrocloud/worker/jobqueue"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// claimedQueue returns a queue with the test build claimed by w.
+func claimedQueue(t *testing.T, w jobqueue.Worker) (*jobqueue.Memory, jobqueue.Job) {
+	t.Helper()
+	q := jobqueue.NewMemory()
+	job := testJob(t, testMessage(), 1)
+	if err := q.Enqueue(job.ID, job.Payload, 0, time.Time{}); err != nil {
+		t.Fatal(err)
+	}
+	if claimed, err := q.Claim(context.Background(), w); err != nil || claimed == nil {
+		t.Fatalf("Claim = %v, %v", claimed, err)
+	}
+	return q, job
+}
+
+func buildContainer(id, buildID, workerID string, startedAt time.Time) Container {
+	return Container{
+		ID:        id,
+		Labels:    map[string]string{"build_id": buildID, "worker_id": workerID},
+		Running:   !startedAt.IsZero(),
+		StartedAt: startedAt,
+	}
+}
+
+func TestReconcileResumesClaimedBuild(t *testing.T) {
+	api := newFakeAPI(t)
+	cfg := testConfig(api, t)
+	w := jobqueue.Worker{ID: "worker-1", Lease: time.Minute}
+	q, job := claimedQueue(t, w)
+
+	// The build finished writing its artifact while the worker was down
+	jobOut := filepath.Join(cfg.BuildOutputDir, testBuildID)
+	os.MkdirAll(jobOut, 0777)
+	os.WriteFile(filepath.Join(jobOut, "dist.zip"), []byte("zip"), 0644)
+	rt := newFakeRuntime(fakeRun{
+		Logs:       []string{"built in 3s"},
+		Containers: []Container{buildContainer("container-1", job.ID, w.ID, time.Now().Add(-time.Minute))},
+	})
+
+	resumed := reconcile(context.Background(), rt, q, w)
+	if len(resumed) != 1 || resumed[0].job.ID != job.ID {
+		t.Fatalf("resumed = %+v, want the claimed build", resumed)
+	}
+
+	result, err := ResumeJob(context.Background(), *resumed[0].job, q, rt, resumed[0].container, noLogs, cfg)
+	if err != nil || result.Status != jobqueue.Succeeded {
+		t.Fatalf("result = %+v, %v, want succeeded", result, err)
+	}
+	if rt.created() {
+		t.Errorf("a new container was created for the resumed build")
+	}
+	if status := api.finalStatus(t); status.Status != Done {
+		t.Errorf("final status = %+v, want Done", status)
+	}
+}
+
+func TestReconcileTimesOutFromContainerStart(t *testing.T) {
+	api := newFakeAPI(t)
+	cfg := testConfig(api, t)
+	w := jobqueue.Worker{ID: "worker-1", Lease: time.Minute}
+	q, job := claimedQueue(t, w)
+	started := time.Now().Add(-time.Duration(DefaultLimits().DefaultJob.BuildDuration) * time.Second)
+	rt := newFakeRuntime(fakeRun{Hang: true})
+
+	result, _ := ResumeJob(context.Background(), job, q, rt, buildContainer("container-1", job.ID, w.ID, started), noLogs, cfg)
+
+	if !strings.HasPrefix(result.FailureReason, "the build ran past its time limit") || !rt.wasStopped() {
+		t.Errorf("result = %+v, want the build stopped for running past its deadline", result)
+	}
+}
+
+func TestReconcileStopsUnclaimedContainers(t *testing.T) {
+	w := jobqueue.Worker{ID: "worker-1", Lease: time.Minute}
+	q := jobqueue.NewMemory()
+	rt := newFakeRuntime(fakeRun{Containers: []Container{
+		buildContainer("other-worker", "b1", "worker-2", time.Now()),
+		buildContainer("cancelled", "b2", w.ID, time.Now()),
+	}})
+
+	if resumed := reconcile(context.Background(), rt, q, w); len(resumed) != 0 {
+		t.Errorf("resumed = %+v, want none", resumed)
+	}
+	rt.mu.Lock()
+	defer rt.mu.Unlock()
+	if len(rt.stopped) != 1 || rt.stopped[0] != "cancelled" {
+		t.Errorf("stopped = %v, want only this worker's container of a build it no longer holds", rt.stopped)
+	}
+}
+
+func TestReconcileRequeuesUnstartedBuild(t *testing.T) {
+	w := jobqueue.Worker{ID: "worker-1", Lease: time.Minute}
+	q, job := claimedQueue(t, w)
+	rt := newFakeRuntime(fakeRun{Containers: []Container{buildContainer("created", job.ID, w.ID, time.Time{})}})
+
+	if resumed := reconcile(context.Background(), rt, q, w); len(resumed) != 0 {
+		t.Errorf("resumed = %+v, want none", resumed)
+	}
+	if status, _ := q.Status(job.ID); status != "pending" {
+		t.Errorf("job status = %q, want pending", status)
+	}
+	if !rt.wasStopped() {
+		t.Errorf("container that never started was not removed")
+	}
+}
+
+func TestReconcileAdoptsContainerOnDockerPool(t *testing.T) {
+	w := jobqueue.Worker{ID: "worker-1", Lease: time.Minute}
+	q, job := claimedQueue(t, w)
+	h1, _ := testHost("h1", 8*GB, 4000)
+	h2, e2 := testHost("h2", 4*GB, 4000)
+	c := buildContainer("h2-container", job.ID, w.ID, time.Now().Add(-time.Minute))
+	c.Limits = JobLimits{MemoryBytes: 2 * GB, CPUQuota: 100000, CPUPeriod: 100000}
+	e2.run.Containers = []Container{c}
+	p := newTestPool(t, h1, h2)
+
+	if resumed := reconcile(context.Background(), p, q, w); len(resumed) != 1 {
+		t.Fatalf("resumed = %+v, want the claimed build", resumed)
+	}
+	if h2.reservedMemory != 2*GB || h2.reservedCPU != 1000 {
+		t.Errorf("h2 reserved %s and %d millicores, want the resumed build's limits", formatBytes(h2.reservedMemory), h2.reservedCPU)
+	}
+
+	// A later List, e.g. the janitor's, doesn't lose track of the container while its host is down
+	e2.setPingErr(errFakeDaemon)
+	p.checkHealth()
+	if _, err := p.List(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if err := p.Stop(context.Background(), c.ID); err != nil || !e2.wasStopped() {
+		t.Errorf("Stop = %v, want it sent to h2", err)
+	}
+
+	p.Release(c.ID)
+	if h2.reservedMemory != 0 || h2.reservedCPU != 0 {
+		t.Errorf("h2 still has %s reserved after release", formatBytes(h2.reservedMemory))
+	}
+}
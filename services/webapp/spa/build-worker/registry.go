@@ -0,0 +1,147 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"syscall"
+	"time"
+)
+
+// version is the worker build version, set with -ldflags "-X main.version=..."
+var version = "dev"
+
+// WorkerInfo is what a worker advertises about itself in the build_workers table.
+type WorkerInfo struct {
+	ID         string
+	Hostname   string
+	Version    string
+	Labels     map[string]string
+	TotalSlots int
+}
+
+// newWorkerID returns the configured worker id, or the hostname with a random suffix
+// so workers in containers that share a hostname still get distinct identities.
+// The generated id is kept in build_output_dir, so a restarted worker keeps its identity
+// and can reattach to the builds it left running. The id file is locked until release is
+// called; workers sharing a hostname and build_output_dir each take the first id file no
+// other running worker holds, so they never end up with the same id.
+func newWorkerID(cfg Config) (id string, release func()) {
+	if cfg.Worker.ID != "" {
+		return cfg.Worker.ID, func() {}
+	}
+	hostname, _ := os.Hostname()
+	if hostname == "" {
+		hostname = "worker"
+	}
+	_ = os.MkdirAll(cfg.BuildOutputDir, 0755)
+	for n := 0; ; n++ {
+		name := ".worker-id-" + hostname
+		if n > 0 {
+			name += fmt.Sprintf("-%d", n)
+		}
+		f, err := lockFile(filepath.Join(cfg.BuildOutputDir, name), syscall.LOCK_EX|syscall.LOCK_NB)
+		if errors.Is(err, syscall.EWOULDBLOCK) {
+			continue // another worker on the host is using it
+		}
+		if err != nil {
+			log.Printf("Warning: failed to save worker id, builds won't be resumed after a restart: %v", err)
+			return randomWorkerID(hostname), func() {}
+		}
+		release = func() {
+			_ = syscall.Flock(int(f.Fd()), syscall.LOCK_UN)
+			f.Close()
+		}
+		if data, err := io.ReadAll(f); err == nil && len(bytes.TrimSpace(data)) > 0 {
+			return string(bytes.TrimSpace(data)), release
+		}
+		id = randomWorkerID(hostname)
+		if _, err := f.WriteString(id + "\n"); err != nil {
+			log.Printf("Warning: failed to save worker id, builds won't be resumed after a restart: %v", err)
+		}
+		return id, release
+	}
+}
+
+func randomWorkerID(hostname string) string {
+	b := make([]byte, 4)
+	_, _ = rand.Read(b)
+	return fmt.Sprintf("%s-%s", hostname, hex.EncodeToString(b))
+}
+
+// registerWorker adds this worker to the build_workers table, or brings it back online.
+func registerWorker(ctx context.Context, db *sql.DB, info WorkerInfo) error {
+	labels, err := json.Marshal(info.Labels)
+	if err != nil {
+		return err
+	}
+	if info.Labels == nil {
+		labels = []byte("{}")
+	}
+
+	_, err = db.ExecContext(ctx, `
+		INSERT INTO build_workers (id, hostname, version, labels, total_slots, used_slots, running_jobs, status, started_at, heartbeat_at)
+		VALUES ($1, $2, $3, $4::jsonb, $5, 0, '{}', 'online', now(), now())
+		ON CONFLICT (id) DO UPDATE SET
+			hostname = EXCLUDED.hostname, version = EXCLUDED.version, labels = EXCLUDED.labels,
+			total_slots = EXCLUDED.total_slots, used_slots = 0, running_jobs = '{}',
+			status = 'online', started_at = now(), heartbeat_at = now(), stopped_at = NULL
+	`, info.ID, info.Hostname, info.Version, string(labels), info.TotalSlots)
+	return err
+}
+
+// WorkerStatus is the state a worker reports on each heartbeat.
+type WorkerStatus struct {
+	Status      string // online or draining
+	UsedSlots   int
+	RunningJobs []string
+}
+
+// heartbeatWorker reports the worker's status, used slots and running jobs.
+func heartbeatWorker(ctx context.Context, db *sql.DB, workerID string, status WorkerStatus) error {
+	ids, err := json.Marshal(status.RunningJobs)
+	if err != nil {
+		return err
+	}
+	_, err = db.ExecContext(ctx, `
+		UPDATE build_workers
+		SET used_slots = $2, running_jobs = ARRAY(SELECT jsonb_array_elements_text($3::jsonb)), heartbeat_at = now(), status = $4
+		WHERE id = $1
+	`, workerID, status.UsedSlots, string(ids), status.Status)
+	return err
+}
+
+// deregisterWorker marks the worker offline on graceful shutdown.
+func deregisterWorker(ctx context.Context, db *sql.DB, workerID string) error {
+	_, err := db.ExecContext(ctx, `
+		UPDATE build_workers SET status = 'offline', used_slots = 0, running_jobs = '{}', stopped_at = now()
+		WHERE id = $1
+	`, workerID)
+	return err
+}
+
+// runWorkerHeartbeat reports liveness and slot usage every heartbeat interval until ctx is done.
+func runWorkerHeartbeat(ctx context.Context, db *sql.DB, workerID string, cfg Config, status func() WorkerStatus) {
+	ticker := time.NewTicker(cfg.HeartbeatInterval())
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if err := heartbeatWorker(ctx, db, workerID, status()); err != nil && ctx.Err() == nil {
+				log.Printf("Failed to send worker heartbeat: %v", err)
+			}
+		}
+	}
+}
@@ -0,0 +1,31 @@
+package main
+
+import "testing"
+
+func TestNewWorkerIDPerInstance(t *testing.T) {
+	var cfg Config
+	cfg.BuildOutputDir = t.TempDir()
+
+	// Two workers with the same hostname and build_output_dir
+	first, releaseFirst := newWorkerID(cfg)
+	second, releaseSecond := newWorkerID(cfg)
+	defer releaseSecond()
+	if first == second {
+		t.Fatalf("both workers got id %s", first)
+	}
+
+	// The first restarts and keeps its identity
+	releaseFirst()
+	restarted, releaseRestarted := newWorkerID(cfg)
+	defer releaseRestarted()
+	if restarted != first {
+		t.Errorf("restarted worker got id %s, want %s", restarted, first)
+	}
+
+	cfg.Worker.ID = "configured"
+	if id, release := newWorkerID(cfg); id != "configured" {
+		t.Errorf("id = %s, want the configured one", id)
+	} else {
+		release()
+	}
+}
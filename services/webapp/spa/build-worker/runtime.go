@@ -0,0 +1,132 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"mycrocloud/worker/logcollector"
+	"time"
+)
+
+// builderImageLabel marks builder images, so PruneImages only removes those.
+const builderImageLabel = "mycrocloud.builder"
+
+// Mount is a host directory mounted into the build container.
+type Mount struct {
+	Source   string
+	Target   string
+	ReadOnly bool
+}
+
+// ContainerSpec describes a build container.
+type ContainerSpec struct {
+	Image      string
+	Env        []string // KEY=value
+	Labels     map[string]string
+	Mounts     []Mount
+	Limits     JobLimits
+	AutoRemove bool // remove the container once it exits
+}
+
+// ExitStatus is how a build container exited.
+type ExitStatus struct {
+	ExitCode  int
+	OOMKilled bool // killed for exceeding its memory limit
+	Signal    int  // signal that killed the build, 0 if it exited by itself
+
+	DiskLimitExceeded bool // stopped by the runtime for writing more than its disk limit
+}
+
+// signalOf returns the signal a process was killed by, going by the shell convention of
+// exiting with 128+signal, or 0 if exitCode isn't one of those.
+func signalOf(exitCode int) int {
+	if exitCode > 128 && exitCode < 128+65 {
+		return exitCode - 128
+	}
+	return 0
+}
+
+// Sample is a reading of a build container's resource usage. The CPU and network
+// counters are totals since the container started.
+type Sample struct {
+	MemoryBytes    uint64 // in use, not counting reclaimable page cache
+	CPUSeconds     float64
+	NetworkRxBytes uint64
+	NetworkTxBytes uint64
+	DiskBytes      uint64 // written to the container's writable layer, 0 if unknown
+}
+
+// errStatsUnsupported is returned by runtimes that can't measure a container's usage.
+var errStatsUnsupported = errors.New("container stats are not supported by this runtime")
+
+// Container is a build container found by List.
+type Container struct {
+	ID        string
+	Labels    map[string]string
+	Running   bool
+	StartedAt time.Time // zero if it never started
+	Mounts    []Mount
+	Limits    JobLimits // only the memory and CPU limits are filled in
+}
+
+// adopter is implemented by runtimes that reserve resources for the containers they create.
+// Adopt does the same for a container found by List that the worker is taking over.
+type adopter interface {
+	Adopt(c Container) error
+}
+
+// BuildRuntime runs build containers. ProcessJob only talks to the container engine through
+// it, so the job flow can be tested without one.
+type BuildRuntime interface {
+	// Create creates the container and returns its id.
+	Create(ctx context.Context, spec ContainerSpec) (string, error)
+
+	Start(ctx context.Context, id string) error
+
+	// Wait blocks until the container exits. If ctx is done first it returns ctx.Err()
+	// and leaves the container running.
+	Wait(ctx context.Context, id string) (ExitStatus, error)
+
+	// StreamLogs feeds the container's output to the collector until the container
+	// exits or ctx is done.
+	StreamLogs(ctx context.Context, id string, collector *logcollector.Collector)
+
+	// Stats returns the running container's current resource usage, or errStatsUnsupported.
+	Stats(ctx context.Context, id string) (Sample, error)
+
+	// Stop stops the container, killing it if it doesn't exit in time.
+	Stop(ctx context.Context, id string) error
+
+	// List returns the build containers (labelled build_id) that haven't been removed,
+	// including ones that exited.
+	List(ctx context.Context) ([]Container, error)
+
+	// PruneContainers removes build containers that exited more than olderThan ago, or
+	// were created that long ago and never started. Returns how many were removed.
+	PruneContainers(ctx context.Context, olderThan time.Duration) (int, error)
+
+	// PruneImages removes builder images (labelled builderImageLabel) that no container
+	// uses. Returns the bytes reclaimed.
+	PruneImages(ctx context.Context) (uint64, error)
+
+	// Release frees what the runtime reserved for the container. Called once the build is over.
+	Release(id string)
+
+	Close() error
+}
+
+// openRuntime creates the runtime selected by runtime.driver.
+func openRuntime(cfg Config, limits Limits) (BuildRuntime, error) {
+	switch cfg.Runtime.Driver {
+	case "docker":
+		return NewDockerPool(cfg)
+	case "kubernetes":
+		client, err := NewKubernetesClient(cfg.Runtime.Kubernetes.Kubeconfig)
+		if err != nil {
+			return nil, err
+		}
+		return NewKubernetesRuntime(client, cfg, limits)
+	default:
+		return nil, fmt.Errorf("unknown runtime driver %q", cfg.Runtime.Driver)
+	}
+}
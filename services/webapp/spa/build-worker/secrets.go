@@ -0,0 +1,110 @@
+package main
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+// Where the secrets file is mounted in the build container
+const (
+	containerSecretsDir  = "/run/build-secrets"
+	containerSecretsFile = containerSecretsDir + "/env.json"
+)
+
+// EncryptedSecrets are secret env vars encrypted by the API with AES-256-GCM.
+// The build id is the associated data, so they can only be decrypted for that build.
+type EncryptedSecrets struct {
+	Kid        string `json:"kid"`
+	Nonce      string `json:"nonce"`      // base64
+	Ciphertext string `json:"ciphertext"` // base64, followed by the GCM tag
+}
+
+// decryptSecrets returns the secret env vars of the build, or nil if it has none.
+func decryptSecrets(buildMsg BuildMessage, cfg Config) (map[string]string, error) {
+	secrets := buildMsg.SecretEnvVars
+	if secrets == nil {
+		return nil, nil
+	}
+	encodedKey, ok := cfg.Secrets.Keys[secrets.Kid]
+	if !ok {
+		return nil, fmt.Errorf("no secrets key %q configured", secrets.Kid)
+	}
+	key, err := base64.StdEncoding.DecodeString(encodedKey)
+	if err != nil {
+		return nil, fmt.Errorf("invalid secrets key %q: %w", secrets.Kid, err)
+	}
+	nonce, err := base64.StdEncoding.DecodeString(secrets.Nonce)
+	if err != nil {
+		return nil, fmt.Errorf("malformed secrets nonce: %w", err)
+	}
+	ciphertext, err := base64.StdEncoding.DecodeString(secrets.Ciphertext)
+	if err != nil {
+		return nil, fmt.Errorf("malformed secrets ciphertext: %w", err)
+	}
+
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, fmt.Errorf("invalid secrets key %q: %w", secrets.Kid, err)
+	}
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	if len(nonce) != gcm.NonceSize() {
+		return nil, fmt.Errorf("malformed secrets nonce: %d bytes", len(nonce))
+	}
+	plaintext, err := gcm.Open(nil, nonce, ciphertext, []byte(buildMsg.BuildId))
+	if err != nil {
+		return nil, fmt.Errorf("decrypt secrets: %w", err)
+	}
+
+	var envVars map[string]string
+	if err := json.Unmarshal(plaintext, &envVars); err != nil {
+		return nil, fmt.Errorf("decrypt secrets: %w", err)
+	}
+	return envVars, nil
+}
+
+// writeSecretsFile writes the secret env vars to a new directory under builder.secrets_dir,
+// which should be a tmpfs so they never reach disk. The directory name is random so other
+// builds on the host can't guess it. Returns the directory to mount into the container;
+// the caller removes it when the build is done.
+func writeSecretsFile(envVars map[string]string, cfg Config) (string, error) {
+	// Other users can traverse the parent but not list it
+	if err := os.MkdirAll(cfg.Builder.SecretsDir, 0711); err != nil {
+		return "", err
+	}
+	name := make([]byte, 16)
+	if _, err := rand.Read(name); err != nil {
+		return "", err
+	}
+	dir := filepath.Join(cfg.Builder.SecretsDir, hex.EncodeToString(name))
+	if err := os.Mkdir(dir, 0755); err != nil {
+		return "", err
+	}
+
+	data, err := json.Marshal(envVars)
+	if err != nil {
+		os.RemoveAll(dir)
+		return "", err
+	}
+	// The builder runs as a different user than the worker, so the file must be world-readable;
+	// it is only reachable through the random directory name
+	path := filepath.Join(dir, "env.json")
+	if err := os.WriteFile(path, data, 0444); err != nil {
+		os.RemoveAll(dir)
+		return "", err
+	}
+	if err := os.Chmod(path, 0444); err != nil {
+		os.RemoveAll(dir)
+		return "", err
+	}
+	return dir, nil
+}
@@ -0,0 +1,140 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"mycrocloud/worker/jobqueue"
+	"strings"
+	"time"
+)
+
+// Reasons a job payload is rejected
+var (
+	errPayloadUnsigned = errors.New("payload is not signed")
+	errPayloadNoKeys   = errors.New("payload is signed but no signing keys are configured")
+	errPayloadTampered = errors.New("payload signature does not match")
+	errPayloadExpired  = errors.New("signed payload has expired")
+	errPayloadReplayed = errors.New("signed payload was issued for a different build or claim")
+)
+
+// signedPayload is the part of a queued payload that carries the API signature.
+type signedPayload struct {
+	Signed string `json:"signed"`
+}
+
+// signatureHeader is the protected header of a signed payload.
+type signatureHeader struct {
+	Alg string `json:"alg"`
+	Kid string `json:"kid"`
+}
+
+// signatureClaims are the fields of the signed build message that verification checks.
+// WorkerId and Attempt are only set when the API signed the payload again for the claim,
+// which it does for jobs claimed over HTTP.
+type signatureClaims struct {
+	BuildId  string `json:"build_id"`
+	Exp      int64  `json:"exp"`
+	WorkerId string `json:"worker_id"`
+	Attempt  int    `json:"attempt"`
+}
+
+// verifyPayload checks the API signature on a queued payload and returns the signed build
+// message, which is what the worker runs instead of the unsigned copy the queue schedules on.
+// The signature is an HS256 JWS; the message must not have expired and must be for this job,
+// so a signed payload copied into another build_queue row is rejected. Jobs claimed from the
+// API are signed for the claim, and must be for this worker and attempt as well, so a
+// payload can't be run again by handing its job back to the queue within its expiry.
+// Unsigned payloads are accepted as they are unless signing.require is set.
+func verifyPayload(job jobqueue.Job, cfg Config, now time.Time) ([]byte, error) {
+	var payload signedPayload
+	if err := json.Unmarshal([]byte(job.Payload), &payload); err != nil {
+		return nil, err
+	}
+	if payload.Signed == "" {
+		if cfg.Signing.Require {
+			return nil, errPayloadUnsigned
+		}
+		return []byte(job.Payload), nil
+	}
+	if len(cfg.Signing.Keys) == 0 {
+		return nil, errPayloadNoKeys
+	}
+
+	parts := strings.Split(payload.Signed, ".")
+	if len(parts) != 3 {
+		return nil, fmt.Errorf("%w: malformed signature", errPayloadTampered)
+	}
+	headerJSON, err := base64.RawURLEncoding.DecodeString(parts[0])
+	if err != nil {
+		return nil, fmt.Errorf("%w: malformed header", errPayloadTampered)
+	}
+	var header signatureHeader
+	if err := json.Unmarshal(headerJSON, &header); err != nil {
+		return nil, fmt.Errorf("%w: malformed header", errPayloadTampered)
+	}
+	if header.Alg != "HS256" {
+		return nil, fmt.Errorf("%w: unsupported algorithm %q", errPayloadTampered, header.Alg)
+	}
+	encodedKey, ok := cfg.Signing.Keys[header.Kid]
+	if !ok {
+		return nil, fmt.Errorf("%w: unknown key %q", errPayloadTampered, header.Kid)
+	}
+	key, err := base64.StdEncoding.DecodeString(encodedKey)
+	if err != nil {
+		return nil, fmt.Errorf("invalid signing key %q: %w", header.Kid, err)
+	}
+
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, fmt.Errorf("%w: malformed signature", errPayloadTampered)
+	}
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(parts[0] + "." + parts[1]))
+	if !hmac.Equal(signature, mac.Sum(nil)) {
+		return nil, errPayloadTampered
+	}
+
+	body, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return nil, fmt.Errorf("%w: malformed body", errPayloadTampered)
+	}
+	var claims signatureClaims
+	if err := json.Unmarshal(body, &claims); err != nil {
+		return nil, fmt.Errorf("%w: malformed body", errPayloadTampered)
+	}
+	skew := time.Duration(cfg.Signing.ClockSkewSeconds) * time.Second
+	if now.After(time.Unix(claims.Exp, 0).Add(skew)) {
+		return nil, errPayloadExpired
+	}
+	if claims.BuildId != job.ID {
+		return nil, errPayloadReplayed
+	}
+	if claims.Attempt == 0 && cfg.Queue.Driver == "http" {
+		return nil, fmt.Errorf("%w: not signed for the claim", errPayloadReplayed)
+	}
+	if claims.Attempt != 0 && (claims.WorkerId != cfg.Worker.ID || claims.Attempt != job.Attempt) {
+		return nil, errPayloadReplayed
+	}
+	return body, nil
+}
+
+// reportRejected publishes the Rejected status of a job whose payload failed verification.
+// The unverified payload is only used to find the app to report to; the API ignores the
+// status if the build does not belong to that app.
+func reportRejected(job jobqueue.Job, cfg Config) {
+	var reported BuildMessage
+	if err := json.Unmarshal([]byte(job.Payload), &reported); err != nil {
+		log.Printf("Failed to parse rejected job %s: %v", job.ID, err)
+		return
+	}
+	reported.BuildId = job.ID
+	publishBuildStatus(reported, BuildStatusChangedEventMessage{
+		BuildId: job.ID,
+		Status:  Rejected,
+	}, cfg)
+}
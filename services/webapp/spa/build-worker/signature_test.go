@@ -0,0 +1,66 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"mycrocloud/worker/jobqueue"
+	"testing"
+	"time"
+)
+
+// signClaims signs claims the way the API does, returning the queued payload.
+func signClaims(t *testing.T, key []byte, claims map[string]any) string {
+	t.Helper()
+	header, _ := json.Marshal(map[string]string{"alg": "HS256", "kid": "k1", "typ": "build+jws"})
+	body, err := json.Marshal(claims)
+	if err != nil {
+		t.Fatal(err)
+	}
+	input := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(body)
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(input))
+	payload, _ := json.Marshal(map[string]string{"signed": input + "." + base64.RawURLEncoding.EncodeToString(mac.Sum(nil))})
+	return string(payload)
+}
+
+func TestVerifyPayload(t *testing.T) {
+	key := []byte("key")
+	now := time.Now()
+	exp := now.Add(time.Hour).Unix()
+	keys := map[string]string{"k1": base64.StdEncoding.EncodeToString(key)}
+
+	tests := []struct {
+		name    string
+		claims  map[string]any
+		driver  string
+		keys    map[string]string
+		attempt int
+		want    error
+	}{
+		{"signed", map[string]any{"build_id": testBuildID, "exp": exp}, "postgres", keys, 1, nil},
+		{"no keys", map[string]any{"build_id": testBuildID, "exp": exp}, "postgres", nil, 1, errPayloadNoKeys},
+		{"expired", map[string]any{"build_id": testBuildID, "exp": now.Add(-time.Hour).Unix()}, "postgres", keys, 1, errPayloadExpired},
+		{"other build", map[string]any{"build_id": "other", "exp": exp}, "postgres", keys, 1, errPayloadReplayed},
+		{"signed for the claim", map[string]any{"build_id": testBuildID, "exp": exp, "worker_id": "w1", "attempt": 2}, "http", keys, 2, nil},
+		{"not signed for the claim", map[string]any{"build_id": testBuildID, "exp": exp}, "http", keys, 1, errPayloadReplayed},
+		{"earlier attempt", map[string]any{"build_id": testBuildID, "exp": exp, "worker_id": "w1", "attempt": 1}, "http", keys, 2, errPayloadReplayed},
+		{"other worker", map[string]any{"build_id": testBuildID, "exp": exp, "worker_id": "w2", "attempt": 2}, "http", keys, 2, errPayloadReplayed},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var cfg Config
+			cfg.Signing.Keys = tt.keys
+			cfg.Queue.Driver = tt.driver
+			cfg.Worker.ID = "w1"
+			job := jobqueue.Job{ID: testBuildID, Payload: signClaims(t, key, tt.claims), Attempt: tt.attempt}
+
+			_, err := verifyPayload(job, cfg, now)
+			if !errors.Is(err, tt.want) {
+				t.Errorf("verifyPayload = %v, want %v", err, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,48 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"mycrocloud/worker/jobqueue"
+)
+
+// supersedeOlderJobs marks pending builds of the same app and branch as superseded by the
+// newest queued one. The claimed job itself is superseded too if a newer build is already queued.
+// Returns whether the claimed job was superseded.
+func supersedeOlderJobs(ctx context.Context, queue jobqueue.Queue, job *jobqueue.Job, cfg Config) (bool, error) {
+	superseded, err := queue.SupersedeOlder(ctx, job)
+	if err != nil {
+		return false, err
+	}
+
+	claimedSuperseded := false
+	for _, s := range superseded {
+		if s.ID == job.ID {
+			claimedSuperseded = true
+			continue
+		}
+
+		// Nobody will claim a superseded build, so report its final status here
+		var buildMsg BuildMessage
+		if err := json.Unmarshal([]byte(s.Payload), &buildMsg); err != nil {
+			log.Printf("Failed to parse superseded build %s: %v", s.ID, err)
+			continue
+		}
+		publishBuildStatus(buildMsg, BuildStatusChangedEventMessage{
+			BuildId: buildMsg.BuildId,
+			Status:  Superseded,
+		}, cfg)
+	}
+	return claimedSuperseded, nil
+}
+
+// supersedeRunningJobs requests cancellation of older builds of the same app and branch
+// that are already running, notifying the workers that run them.
+func supersedeRunningJobs(ctx context.Context, queue jobqueue.Queue, job *jobqueue.Job) error {
+	ids, err := queue.SupersedeRunning(ctx, job)
+	for _, id := range ids {
+		log.Printf("Cancelling running build %s, superseded by %s", id, job.ID)
+	}
+	return err
+}
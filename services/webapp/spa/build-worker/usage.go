@@ -0,0 +1,179 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log"
+	"math"
+	"mycrocloud/worker/logcollector"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// memoryWarnPercent is how much of its memory limit a build may use before the build log
+// warns that it is close to running out.
+const memoryWarnPercent = 90
+
+// Usage is what a build used, sent with its final status.
+type Usage struct {
+	PeakMemoryBytes uint64  `json:"peak_memory_bytes"`
+	CPUSeconds      float64 `json:"cpu_seconds"`
+	NetworkRxBytes  uint64  `json:"network_rx_bytes"`
+	NetworkTxBytes  uint64  `json:"network_tx_bytes"`
+	PeakDiskBytes   uint64  `json:"peak_disk_bytes"` // writable layer plus output dir
+	DurationSeconds float64 `json:"duration_seconds"`
+}
+
+// meter samples the resource usage of a build container while it runs, and enforces its
+// disk limit: the container's writable layer and its output dir together may not grow past
+// it. The runtime may cap the writable layer as well, but nothing else caps the output dir.
+type meter struct {
+	rt          BuildRuntime
+	containerID string
+	outputDir   string
+	memoryLimit int64
+	diskLimit   int64
+	collector   *logcollector.Collector
+	started     time.Time
+
+	// onDiskExceeded is called once, from the sampling goroutine, when the disk limit is exceeded
+	onDiskExceeded func()
+
+	stop func()
+	done chan struct{}
+
+	mu           sync.Mutex
+	usage        Usage
+	warned       bool
+	diskExceeded bool
+}
+
+// startMeter samples the container and its output dir every interval until finish is
+// called. started is when the container started, which the build's duration is counted from.
+func startMeter(rt BuildRuntime, containerID string, outputDir string, jobLimits JobLimits, collector *logcollector.Collector,
+	started time.Time, interval time.Duration, onDiskExceeded func()) *meter {
+	ctx, stop := context.WithCancel(context.Background())
+	m := &meter{
+		rt:             rt,
+		containerID:    containerID,
+		outputDir:      outputDir,
+		memoryLimit:    jobLimits.MemoryBytes,
+		diskLimit:      jobLimits.DiskBytes,
+		collector:      collector,
+		started:        started,
+		onDiskExceeded: onDiskExceeded,
+		stop:           stop,
+		done:           make(chan struct{}),
+	}
+	go m.run(ctx, interval)
+	return m
+}
+
+func (m *meter) run(ctx context.Context, interval time.Duration) {
+	defer close(m.done)
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	statsSupported := true
+	for {
+		var sample Sample
+		if statsSupported {
+			s, err := m.rt.Stats(ctx, m.containerID)
+			switch {
+			case errors.Is(err, errStatsUnsupported):
+				// The output dir is still watched
+				statsSupported = false
+			case err == nil:
+				sample = s
+				m.record(sample)
+			}
+			// Other errors are expected around the container exiting; the next sample will do
+		}
+		m.checkDisk(sample.DiskBytes)
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// record adds a sample, warning in the build log the first time memory use gets close to
+// the limit.
+func (m *meter) record(s Sample) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.usage.PeakMemoryBytes = max(m.usage.PeakMemoryBytes, s.MemoryBytes)
+	m.usage.CPUSeconds = max(m.usage.CPUSeconds, s.CPUSeconds)
+	m.usage.NetworkRxBytes = max(m.usage.NetworkRxBytes, s.NetworkRxBytes)
+	m.usage.NetworkTxBytes = max(m.usage.NetworkTxBytes, s.NetworkTxBytes)
+
+	if !m.warned && m.memoryLimit > 0 && s.MemoryBytes*100 >= uint64(m.memoryLimit)*memoryWarnPercent {
+		m.warned = true
+		m.collector.Append(fmt.Sprintf("Warning: the build is using %s of its %s memory limit",
+			formatBytes(int64(s.MemoryBytes)), formatBytes(m.memoryLimit)), "stderr", "app.worker", "")
+	}
+}
+
+// checkDisk adds the size of the output dir to the writable layer's and stops the build
+// the first time their total exceeds the disk limit.
+func (m *meter) checkDisk(layerBytes uint64) {
+	if m.outputDir == "" {
+		return
+	}
+	total := layerBytes + dirSize(m.outputDir)
+
+	m.mu.Lock()
+	m.usage.PeakDiskBytes = max(m.usage.PeakDiskBytes, total)
+	exceeded := m.diskLimit > 0 && total > uint64(m.diskLimit) && !m.diskExceeded
+	if exceeded {
+		m.diskExceeded = true
+	}
+	m.mu.Unlock()
+
+	if exceeded {
+		log.Printf("Container %s wrote %s, over its %s disk limit", m.containerID, formatBytes(int64(total)), formatBytes(m.diskLimit))
+		if m.onDiskExceeded != nil {
+			m.onDiskExceeded()
+		}
+	}
+}
+
+// exceededDisk reports whether the build was stopped for exceeding its disk limit.
+func (m *meter) exceededDisk() bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.diskExceeded
+}
+
+// dirSize returns the total size of the files under dir. Files that disappear while it
+// is walking are skipped.
+func dirSize(dir string) uint64 {
+	var size uint64
+	_ = filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return nil
+		}
+		if d.Type().IsRegular() {
+			if info, err := d.Info(); err == nil {
+				size += uint64(info.Size())
+			}
+		}
+		return nil
+	})
+	return size
+}
+
+// finish stops sampling and returns the build's usage, with its duration up to now.
+func (m *meter) finish() *Usage {
+	m.stop()
+	<-m.done
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	usage := m.usage
+	usage.CPUSeconds = math.Round(usage.CPUSeconds*1000) / 1000
+	usage.DurationSeconds = math.Round(time.Since(m.started).Seconds()*1000) / 1000
+	return &usage
+}
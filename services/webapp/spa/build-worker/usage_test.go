@@ -0,0 +1,91 @@
+package main
+
+import (
+	"context"
+	"mycrocloud/worker/jobqueue"
+	"mycrocloud/worker/logcollector"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func collectedLogs(t *testing.T, c *logcollector.Collector) string {
+	t.Helper()
+	data, err := c.ToJSONL()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(data)
+}
+
+func TestMeterRecordsPeakUsage(t *testing.T) {
+	collector := logcollector.New(testBuildID, nil)
+	defer collector.Close()
+	rt := newFakeRuntime(fakeRun{Usage: &Sample{MemoryBytes: 300 * MB, CPUSeconds: 1.5, NetworkRxBytes: 2048}})
+
+	m := startMeter(rt, "container-1", "", JobLimits{MemoryBytes: 1 * GB}, collector, time.Now().Add(-time.Minute), time.Hour, nil)
+	m.record(Sample{MemoryBytes: 600 * MB, CPUSeconds: 0.5, NetworkTxBytes: 512})
+	m.record(Sample{MemoryBytes: 400 * MB, CPUSeconds: 3.25, NetworkRxBytes: 4096, NetworkTxBytes: 1024})
+	usage := m.finish()
+
+	want := Usage{PeakMemoryBytes: 600 * MB, CPUSeconds: 3.25, NetworkRxBytes: 4096, NetworkTxBytes: 1024}
+	got := *usage
+	got.DurationSeconds = 0
+	if got != want {
+		t.Errorf("usage = %+v, want %+v", got, want)
+	}
+	if usage.DurationSeconds < 60 {
+		t.Errorf("duration = %vs, want it counted from the container start", usage.DurationSeconds)
+	}
+	if strings.Contains(collectedLogs(t, collector), "memory limit") {
+		t.Errorf("warned about memory at 60%% of the limit")
+	}
+}
+
+func TestMeterWarnsNearMemoryLimit(t *testing.T) {
+	collector := logcollector.New(testBuildID, nil)
+	defer collector.Close()
+	m := startMeter(newFakeRuntime(fakeRun{}), "container-1", "", JobLimits{MemoryBytes: 1 * GB}, collector, time.Now(), time.Hour, nil)
+
+	m.record(Sample{MemoryBytes: 950 * MB})
+	m.record(Sample{MemoryBytes: 980 * MB})
+	m.finish()
+
+	if n := strings.Count(collectedLogs(t, collector), "of its 1.00 GB memory limit"); n != 1 {
+		t.Errorf("logged %d memory warnings, want 1", n)
+	}
+}
+
+func TestProcessJobStopsBuildOverDiskLimit(t *testing.T) {
+	api := newFakeAPI(t)
+	cfg := testConfig(api, t)
+	msg := testMessage()
+	msg.Limits = &PlanLimits{DiskMB: 1}
+	// The build fills its output dir and keeps going
+	jobOut := filepath.Join(cfg.BuildOutputDir, testBuildID)
+	rt := newFakeRuntime(fakeRun{
+		Hang:  true,
+		Usage: &Sample{DiskBytes: 512 * 1024},
+		OnStart: func() {
+			os.WriteFile(filepath.Join(jobOut, "node_modules.tar"), make([]byte, 768*1024), 0644)
+		},
+	})
+
+	result := runJob(context.Background(), t, testJob(t, msg, 1), rt, cfg)
+
+	if result.Status != jobqueue.Failed || !strings.HasPrefix(result.FailureReason, "disk limit exceeded") {
+		t.Fatalf("result = %+v, want failed for exceeding the disk limit", result)
+	}
+	if !rt.wasStopped() {
+		t.Errorf("container was not stopped")
+	}
+	status := api.finalStatus(t)
+	if status.FailureCode != FailureDiskLimitExceeded {
+		t.Errorf("final status = %+v, want failure code %s", status, FailureDiskLimitExceeded)
+	}
+	if status.Usage == nil || status.Usage.PeakDiskBytes != 1280*1024 {
+		t.Errorf("usage = %+v, want the writable layer and output dir counted", status.Usage)
+	}
+}
@@ -8,6 +8,7 @@ import (
 	"mycrocloud/worker/api_client"
 	"net/http"
 	"strings"
+	"sync"
 	"time"
 )
 
@@ -15,24 +16,32 @@ var httpClient = &http.Client{
 	Timeout: 30 * time.Second,
 }
 
-// publishBuildStatus sends a build status update to the API via HTTP POST.
-// This replaces the previous RabbitMQ-based status publishing.
-func publishBuildStatus(buildMsg BuildMessage, message BuildStatusChangedEventMessage, cfg Config) {
-	apiClientCfg := api_client.Config{
+// tokenSources holds a token source per Auth0 client, so every API call shares one cached
+// access token that is refreshed before it expires.
+var tokenSources sync.Map // api_client.Config -> *api_client.TokenSource
+
+// tokenSource returns the token source for the Auth0 client in cfg.
+func tokenSource(cfg Config) *api_client.TokenSource {
+	clientCfg := api_client.Config{
 		Domain:       cfg.Auth0.Domain,
 		ClientID:     cfg.Auth0.ClientID,
 		ClientSecret: cfg.Auth0.ClientSecret,
 		Audience:     cfg.Auth0.Audience,
 	}
+	source, _ := tokenSources.LoadOrStore(clientCfg, api_client.NewTokenSource(clientCfg))
+	return source.(*api_client.TokenSource)
+}
 
-	token, err := api_client.GetAccessToken(apiClientCfg)
+// publishBuildStatus sends a build status update to the API via HTTP POST.
+// This replaces the previous RabbitMQ-based status publishing.
+func publishBuildStatus(buildMsg BuildMessage, message BuildStatusChangedEventMessage, cfg Config) {
+	token, err := tokenSource(cfg).Token()
 	if err != nil {
 		log.Printf("Failed to get token for status update: %v", err)
 		return
 	}
 
-	// Extract appId from the artifacts upload path (e.g., "/apps/123/spa/builds/{buildId}/artifacts")
-	appId := extractAppIdFromPath(buildMsg.ArtifactsUploadPath)
+	appId := buildMsg.AppID()
 	if appId == "" {
 		log.Printf("Failed to extract appId from path: %s", buildMsg.ArtifactsUploadPath)
 		return
@@ -0,0 +1,208 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"mycrocloud/worker/logcollector"
+	"net/url"
+	"path"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// currentMessageVersion is the BuildMessage version this worker understands. Messages queued
+// before the version field was added are version 1 and are migrated when they are parsed.
+const currentMessageVersion = 2
+
+// Size limits for env vars, which end up in the container environment
+const (
+	maxEnvVars       = 200
+	maxEnvValueBytes = 32 << 10
+	maxEnvTotalBytes = 256 << 10
+)
+
+var errInvalidPayload = errors.New("invalid build message")
+
+var envVarNameRe = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+
+// reservedEnvVars are set by the worker or needed by build.sh and can't be overridden.
+var reservedEnvVars = []string{
+	"REPO_URL", "WORK_DIR", "OUT_DIR", "INSTALL_CMD", "BUILD_CMD", "NODE_VERSION",
+	"ENV_VARS", "SECRETS_FILE", "PATH", "HOME",
+}
+
+// messageEnvelope is a BuildMessage as queued: the unsigned payload carries the signature
+// and the signed body carries its issue and expiry times and the claim it was signed for,
+// which verifyPayload has checked.
+type messageEnvelope struct {
+	BuildMessage
+	Signed   string `json:"signed,omitempty"`
+	Iat      int64  `json:"iat,omitempty"`
+	Exp      int64  `json:"exp,omitempty"`
+	WorkerId string `json:"worker_id,omitempty"`
+	Attempt  int    `json:"attempt,omitempty"`
+}
+
+// parseBuildMessage decodes a verified payload, migrates it to the current version and
+// validates it. Unknown fields are an error, so a misspelled field fails here rather than
+// as a confusing container failure. On error the message is still decoded as far as
+// possible, so the failure can be reported for the build.
+func parseBuildMessage(payload []byte, cfg Config) (BuildMessage, error) {
+	var envelope messageEnvelope
+	decoder := json.NewDecoder(bytes.NewReader(payload))
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(&envelope); err != nil {
+		var msg BuildMessage
+		_ = json.Unmarshal(payload, &msg)
+		return msg, fmt.Errorf("%w: %v", errInvalidPayload, err)
+	}
+	msg := envelope.BuildMessage
+
+	if msg.Version > currentMessageVersion {
+		return msg, fmt.Errorf("%w: unsupported version %d", errInvalidPayload, msg.Version)
+	}
+	if msg.Version <= 1 {
+		msg = migrateV1(msg)
+	}
+
+	if err := validateBuildMessage(msg, cfg); err != nil {
+		return msg, fmt.Errorf("%w: %v", errInvalidPayload, err)
+	}
+	return msg, nil
+}
+
+// migrateV1 upgrades a message queued before versioning: app_id was only in the artifacts
+// upload path, the repo root could be given as "." and an empty out_dir meant the default.
+func migrateV1(msg BuildMessage) BuildMessage {
+	if msg.AppId == 0 {
+		msg.AppId, _ = strconv.Atoi(extractAppIdFromPath(msg.ArtifactsUploadPath))
+	}
+	if msg.Directory == "." || msg.Directory == "./" {
+		msg.Directory = ""
+	}
+	if msg.OutDir == "" {
+		msg.OutDir = "dist"
+	}
+	msg.Version = currentMessageVersion
+	return msg
+}
+
+// validateBuildMessage checks the fields the build container and uploads depend on.
+func validateBuildMessage(msg BuildMessage, cfg Config) error {
+	required := []struct{ name, value string }{
+		{"build_id", msg.BuildId},
+		{"repo_full_name", msg.RepoFullName},
+		{"clone_url", msg.CloneUrl},
+		{"out_dir", msg.OutDir},
+		{"builder_image", msg.BuilderImage},
+		{"artifacts_upload_path", msg.ArtifactsUploadPath},
+		{"logs_upload_path", msg.LogsUploadPath},
+	}
+	for _, field := range required {
+		if strings.TrimSpace(field.value) == "" {
+			return fmt.Errorf("%s is required", field.name)
+		}
+	}
+
+	if err := validateRelativePath(msg.Directory); err != nil {
+		return fmt.Errorf("directory: %w", err)
+	}
+	if err := validateRelativePath(msg.OutDir); err != nil {
+		return fmt.Errorf("out_dir: %w", err)
+	}
+	if path.Clean(msg.OutDir) == "." {
+		return errors.New("out_dir: must be a directory inside the repository")
+	}
+
+	if err := validateCloneURL(msg.CloneUrl, cfg); err != nil {
+		return fmt.Errorf("clone_url: %w", err)
+	}
+	if err := validateEnvVars(msg.EnvVars); err != nil {
+		return fmt.Errorf("env_vars: %w", err)
+	}
+	return nil
+}
+
+// validateRelativePath rejects paths that could escape the repository checkout.
+func validateRelativePath(p string) error {
+	if p == "" {
+		return nil
+	}
+	if strings.ContainsAny(p, "\\\x00\n\r") {
+		return errors.New("contains invalid characters")
+	}
+	if path.IsAbs(p) {
+		return errors.New("must be relative")
+	}
+	if slices.Contains(strings.Split(p, "/"), "..") {
+		return errors.New("must not contain ..")
+	}
+	return nil
+}
+
+// validateCloneURL only allows https clones from builder.allowed_clone_hosts. The URL
+// carries an access token, so it is never included in the error.
+func validateCloneURL(cloneURL string, cfg Config) error {
+	u, err := url.Parse(cloneURL)
+	if err != nil {
+		return errors.New("malformed URL")
+	}
+	if u.Scheme != "https" {
+		return fmt.Errorf("scheme %q is not allowed", u.Scheme)
+	}
+	host := strings.ToLower(u.Hostname())
+	if !slices.Contains(cfg.Builder.AllowedCloneHosts, host) {
+		return fmt.Errorf("host %q is not allowed", host)
+	}
+	return nil
+}
+
+// validateEnvVars checks env var names and keeps the container environment within size limits.
+func validateEnvVars(envVars map[string]string) error {
+	if len(envVars) > maxEnvVars {
+		return fmt.Errorf("%d variables, at most %d are allowed", len(envVars), maxEnvVars)
+	}
+	total := 0
+	for name, value := range envVars {
+		if !envVarNameRe.MatchString(name) {
+			return fmt.Errorf("invalid name %q", name)
+		}
+		if slices.Contains(reservedEnvVars, strings.ToUpper(name)) {
+			return fmt.Errorf("%s is reserved", name)
+		}
+		if len(value) > maxEnvValueBytes {
+			return fmt.Errorf("%s is larger than %d bytes", name, maxEnvValueBytes)
+		}
+		total += len(name) + len(value)
+	}
+	if total > maxEnvTotalBytes {
+		return fmt.Errorf("variables total %d bytes, at most %d are allowed", total, maxEnvTotalBytes)
+	}
+	return nil
+}
+
+// reportInvalid fails a build whose message didn't validate, with the reason in its logs
+// and status. The job is not retried; the message won't be any more valid next time.
+func reportInvalid(buildMsg BuildMessage, err error, logs func(buildID string) logcollector.Publisher, cfg Config) {
+	log.Printf("Invalid build %s: %v", buildMsg.BuildId, err)
+	if buildMsg.BuildId == "" {
+		return
+	}
+	collector := logcollector.New(buildMsg.BuildId, logs(buildMsg.BuildId))
+	defer collector.Close()
+	collector.Append(fmt.Sprintf("Build failed (%s): %v", FailureInvalidPayload, err), "stderr", "app.worker", "")
+	if buildMsg.LogsUploadPath != "" {
+		uploadBuildLogs(buildMsg, collector, cfg)
+	}
+	publishBuildStatus(buildMsg, BuildStatusChangedEventMessage{
+		BuildId:       buildMsg.BuildId,
+		Status:        Failed,
+		FailureCode:   FailureInvalidPayload,
+		FailureReason: err.Error(),
+	}, cfg)
+}
@@ -6,6 +6,10 @@ shopt -s nullglob
 
 mkdir -p /output
 
+# The step that failed is left in /output/.failed-step for the worker to report
+STEP=setup
+trap 'echo "$STEP" > /output/.failed-step' ERR
+
 BUILD_START_TIME=$(date +%s)
 
 echo "━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━"
@@ -31,6 +35,19 @@ if [ -n "$ENV_VARS_JSON" ]; then
     done
 fi
 
+# --- Export secret environment variables from the mounted file ---
+if [ -n "${SECRETS_FILE:-}" ]; then
+    if [ ! -r "$SECRETS_FILE" ]; then
+        echo "Error: secrets file '$SECRETS_FILE' is not readable; not building without the secret env vars"
+        echo secrets > "$OUTPUT_DIR/.failed-step"
+        exit 1
+    fi
+    for key in $(jq -r 'keys[]' "$SECRETS_FILE"); do
+        value=$(jq -r --arg k "$key" '.[$k]' "$SECRETS_FILE")
+        export "$key"="$value"
+    done
+fi
+
 echo ""
 echo "[1/3] Node.js environment"
 echo "Node.js $(node --version) | npm $(npm --version)"
@@ -38,6 +55,7 @@ echo "Node.js $(node --version) | npm $(npm --version)"
 # --- Main build flow ---
 echo ""
 echo "[2/3] Cloning repository..."
+STEP=clone
 CLONE_START=$(date +%s)
 git clone --depth 1 "$REPO_URL" repo
 CLONE_END=$(date +%s)
@@ -46,6 +64,7 @@ echo "Repository cloned in $((CLONE_END - CLONE_START))s"
 
 echo ""
 echo "[3/3] Installing dependencies..."
+STEP=install
 INSTALL_START=$(date +%s)
 eval "$INSTALL_CMD"
 INSTALL_END=$(date +%s)
@@ -53,6 +72,7 @@ echo "Dependencies installed in $((INSTALL_END - INSTALL_START))s"
 
 echo ""
 echo "[3/3] Building project..."
+STEP=build
 BUILD_CMD_START=$(date +%s)
 eval "$BUILD_CMD"
 BUILD_CMD_END=$(date +%s)
@@ -66,12 +86,14 @@ if [ ! -d "$OUT_DIR" ]; then
     echo "Error: Output directory '$OUT_DIR' was not created"
     echo "Current directory contents:"
     ls -la
+    echo output > "$OUTPUT_DIR/.failed-step"
     exit 1
 fi
 
 # ZIP output directly to the host-mounted volume
 echo ""
 echo "Creating artifact..."
+STEP=artifact
 cd "$OUT_DIR"
 # Remove existing zip and raw files in output dir (just in case of reuse)
 rm -rf "$OUTPUT_DIR"/*